@@ -0,0 +1,96 @@
+package client
+
+import (
+	"conhash/rpcs"
+	"conhash/transport"
+	"context"
+	"errors"
+)
+
+// ErrFailed is returned when the loadbalancer could not
+// serve a request without telling why. Otherwise requests
+// fail with an *rpcs.Error, see rpcs.CodeOf
+var ErrFailed = errors.New("request failed")
+
+// Client reads and writes keys through a loadbalancer
+type Client struct {
+	conn transport.Conn
+}
+
+// Dial connects to the loadbalancer at addr over net/rpc
+func Dial(addr string) (*Client, error) {
+	return DialWith(nil, addr)
+}
+
+// DialWith connects to the loadbalancer at addr over
+// transport, net/rpc if nil
+func DialWith(t transport.Transport, addr string) (*Client, error) {
+	if t == nil {
+		t = transport.NetRPC()
+	}
+	conn, err := t.Dial(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Put stores value under key
+func (c *Client) Put(key string, value []byte) error {
+	args := rpcs.KVArgs{
+		Key:   key,
+		Value: value,
+	}
+	reply := rpcs.Ack{}
+	if err := c.conn.Call("LoadBalancer.Put", &args, &reply); err != nil {
+		return rpcError(err)
+	}
+	if !reply.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// Get returns the value of key and whether it exists
+func (c *Client) Get(key string) ([]byte, bool, error) {
+	args := rpcs.KVArgs{
+		Key: key,
+	}
+	reply := rpcs.KVReply{}
+	if err := c.conn.Call("LoadBalancer.Get", &args, &reply); err != nil {
+		return nil, false, rpcError(err)
+	}
+	if !reply.Success {
+		return nil, false, ErrFailed
+	}
+	return reply.Value, reply.Found, nil
+}
+
+// Delete removes key
+func (c *Client) Delete(key string) error {
+	args := rpcs.KVArgs{
+		Key: key,
+	}
+	reply := rpcs.Ack{}
+	if err := c.conn.Call("LoadBalancer.Delete", &args, &reply); err != nil {
+		return rpcError(err)
+	}
+	if !reply.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// Close closes the connection to the loadbalancer
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// rpcError returns the *rpcs.Error a member answered with,
+// errors of the connection are returned as they are
+func rpcError(err error) error {
+	if e := rpcs.FromError(err); e != nil && e.Code != rpcs.CodeUnknown {
+		return e
+	}
+	return err
+}
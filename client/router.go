@@ -0,0 +1,245 @@
+package client
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"conhash/transport"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrNoNodes is returned when the ring has no member
+// to route a request to
+var ErrNoNodes error = rpcs.Errorf(rpcs.CodeNoNodes, "no node in the ring")
+
+// attempts is the number of times a request is routed,
+// the ring is fetched again before every retry
+const attempts = 3
+
+// DefaultTimeout is the time a call may take unless set
+// otherwise with SetTimeout
+const DefaultTimeout = 10 * time.Second
+
+// Router sends requests to the nodes owning them instead of
+// going through a loadbalancer. It places keys on a copy of the
+// ring of the loadbalancer, fetched again whenever a node rejects
+// its epoch or cannot be reached. It is safe for concurrent use
+type Router struct {
+	lb      string          // address of the loadbalancer
+	pool    *transport.Pool // connections to the loadbalancer and the nodes
+	timeout time.Duration   // time a call may take
+	mu      sync.Mutex      // guards tbl
+	tbl     *table
+}
+
+// table is a copy of the ring of the loadbalancer
+type table struct {
+	epoch uint64
+	ring  *consistent.CRing // set for the ring algorithm
+	other consistent.Ring   // set for the other algorithms
+}
+
+// owner returns the ring entry serving key. The ring algorithm
+// routes to virtual nodes just like the loadbalancer does
+func (t *table) owner(key string) *consistent.CNode {
+	if t.ring != nil {
+		return t.ring.GetNext(key)
+	}
+	return t.other.Lookup(key)
+}
+
+// NewRouter connects to the loadbalancer at addr over
+// net/rpc and fetches its ring
+func NewRouter(addr string) (*Router, error) {
+	return NewRouterWith(nil, addr)
+}
+
+// NewRouterWith connects to the loadbalancer at addr over
+// transport, net/rpc if nil, and fetches its ring
+func NewRouterWith(t transport.Transport, addr string) (*Router, error) {
+	r := &Router{
+		lb:      addr,
+		pool:    transport.NewPoolWith(t),
+		timeout: DefaultTimeout,
+	}
+	if _, err := r.pool.Get(addr); err != nil {
+		return nil, err
+	}
+	if err := r.Refresh(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Refresh fetches the ring of the loadbalancer again. A
+// loadbalancer that restarted is dialed again
+func (r *Router) Refresh() error {
+	reply := rpcs.RingReply{}
+	addrs := []string{r.lb}
+	err := r.pool.CallTimeout(addrs, r.timeout, "LoadBalancer.GetRing", &rpcs.Ack{}, &reply)
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+		// The pool dropped the broken connection
+		err = r.pool.CallTimeout(addrs, r.timeout, "LoadBalancer.GetRing", &rpcs.Ack{}, &reply)
+	}
+	if err != nil {
+		return err
+	}
+	hasher, err := consistent.NewHasher(reply.Hasher)
+	if err != nil {
+		return err
+	}
+	tbl := &table{epoch: reply.Epoch}
+	if reply.Algorithm == "" || reply.Algorithm == consistent.AlgoRing {
+		tbl.ring = consistent.NewRing(hasher)
+		for _, member := range reply.Members {
+			tbl.ring.AddNode(member.Key, member.Weight, member.Meta)
+		}
+	} else {
+		members := make([]*consistent.CNode, 0, len(reply.Members))
+		for _, member := range reply.Members {
+			members = append(members, &consistent.CNode{
+				Key:    member.Key,
+				Weight: member.Weight,
+				Meta:   member.Meta,
+			})
+		}
+		// Built like the loadbalancer builds its own
+		if tbl.other, err = consistent.Place(reply.Algorithm, hasher, members); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.tbl = tbl
+	r.mu.Unlock()
+	return nil
+}
+
+// SetTimeout sets the time a call to the loadbalancer or a node
+// may take, a node not answering in time is taken as out of reach.
+// 0 waits forever. It must be called before the router sends
+// requests
+func (r *Router) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// Epoch returns the epoch of the ring the router uses
+func (r *Router) Epoch() uint64 {
+	return r.current().epoch
+}
+
+// current returns the copy of the ring in use
+func (r *Router) current() *table {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tbl
+}
+
+// Request sends the request of user id to its node and
+// returns the member that served it
+func (r *Router) Request(id string) (string, error) {
+	args := rpcs.ReqArgs{
+		ID: id,
+	}
+	reply := rpcs.Ack{}
+	server, err := r.send(id, &args.NodeID, &args.Epoch, "Node.GetRequest", &args, &reply)
+	if err != nil {
+		return "", err
+	}
+	if !reply.Success {
+		return "", ErrFailed
+	}
+	return server, nil
+}
+
+// Put stores value under key
+func (r *Router) Put(key string, value []byte) error {
+	args := rpcs.KVArgs{
+		Key:   key,
+		Value: value,
+	}
+	reply := rpcs.Ack{}
+	if _, err := r.send(key, &args.NodeID, &args.Epoch, "Node.Put", &args, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// Get returns the value of key and whether it exists
+func (r *Router) Get(key string) ([]byte, bool, error) {
+	args := rpcs.KVArgs{
+		Key: key,
+	}
+	reply := rpcs.KVReply{}
+	if _, err := r.send(key, &args.NodeID, &args.Epoch, "Node.Get", &args, &reply); err != nil {
+		return nil, false, err
+	}
+	if !reply.Success {
+		return nil, false, ErrFailed
+	}
+	return reply.Value, reply.Found, nil
+}
+
+// Delete removes key
+func (r *Router) Delete(key string) error {
+	args := rpcs.KVArgs{
+		Key: key,
+	}
+	reply := rpcs.Ack{}
+	if _, err := r.send(key, &args.NodeID, &args.Epoch, "Node.Delete", &args, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return ErrFailed
+	}
+	return nil
+}
+
+// send calls method on the owner of key and records the key of
+// that node in nodeID and the epoch of the ring in epoch. A node
+// rejecting the epoch or out of reach means the ring changed, it
+// is fetched again and the request routed anew, other errors of
+// the node are returned. send returns the member that served the
+// request
+func (r *Router) send(key string, nodeID *string, epoch *uint64, method string, args interface{}, reply interface{}) (string, error) {
+	var err error
+	for walk := 0; walk < attempts; walk++ {
+		if walk > 0 {
+			if err := r.Refresh(); err != nil {
+				return "", rpcError(err)
+			}
+		}
+		tbl := r.current()
+		node := tbl.owner(key)
+		if node == nil {
+			err = ErrNoNodes
+			continue
+		}
+		*nodeID = node.Key
+		*epoch = tbl.epoch
+		err = r.pool.CallTimeout(transport.Addrs(node.Meta), r.timeout, method, args, reply)
+		switch rpcs.CodeOf(err) {
+		case "":
+			return node.ParentKey, nil
+		case rpcs.CodeWrongOwner:
+		case rpcs.CodeUnknown:
+			err = rpcs.Errorf(rpcs.CodeUnreachable, "node %s did not answer: %v", node.ParentKey, err)
+		default:
+			return "", rpcError(err)
+		}
+	}
+	return "", rpcError(err)
+}
+
+// Close closes the connections to the loadbalancer
+// and the nodes
+func (r *Router) Close() error {
+	r.pool.Close()
+	return nil
+}
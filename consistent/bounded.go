@@ -0,0 +1,122 @@
+package consistent
+
+import (
+	"math"
+	"sync"
+)
+
+// loadTable tracks the load of every member for the
+// consistent hashing with bounded loads mode
+type loadTable struct {
+	mu      sync.Mutex
+	factor  float64        // capacity of a member relative to the average load
+	loads   map[string]int // load of each member by parent key
+	total   int            // sum of all loads
+	lookups uint64         // number of bounded lookups
+	moved   uint64         // lookups placed past the owner of the key
+}
+
+// LoadStats reports the activity of the bounded-load mode
+type LoadStats struct {
+	Lookups uint64         // number of bounded lookups
+	Moved   uint64         // lookups placed on another member than the owner
+	Loads   map[string]int // current load of each member
+}
+
+// EnableBoundedLoad switches the ring to consistent hashing with
+// bounded loads. No member is assigned more than factor times the
+// average load, a factor below 1 is raised to 1
+func (r *CRing) EnableBoundedLoad(factor float64) {
+	if factor < 1 {
+		factor = 1
+	}
+	r.bounded.Store(&loadTable{
+		factor: factor,
+		loads:  make(map[string]int),
+	})
+}
+
+// BoundedLoad reports whether the bounded-load mode is enabled
+func (r *CRing) BoundedLoad() bool {
+	return r.loadTable() != nil
+}
+
+func (r *CRing) loadTable() *loadTable {
+	t, _ := r.bounded.Load().(*loadTable)
+	return t
+}
+
+// PickBounded returns the first of nodes whose member has spare
+// capacity, or the first of them if none has, and assigns one unit
+// of load to its member. nodes are usually the owner of a key and
+// its replicas, the members holding its state. The load must be
+// given back with Release. Without bounded loads it returns the
+// first of nodes
+func (r *CRing) PickBounded(nodes []*CNode) *CNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	t := r.loadTable()
+	if t == nil {
+		return nodes[0]
+	}
+	members := len(r.load().parents)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	capacity := int(math.Ceil(t.factor * float64(t.total+1) / float64(members)))
+	pick := nodes[0]
+	for _, node := range nodes {
+		if t.loads[node.ParentKey] < capacity {
+			pick = node
+			break
+		}
+	}
+	t.loads[pick.ParentKey]++
+	t.total++
+	t.lookups++
+	if pick.Parent != nodes[0].Parent {
+		t.moved++
+	}
+	return pick
+}
+
+// Release gives back a unit of load assigned to the member
+// parentKey by PickBounded
+func (r *CRing) Release(parentKey string) {
+	t := r.loadTable()
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.loads[parentKey] > 0 {
+		t.loads[parentKey]--
+		t.total--
+	}
+	if t.loads[parentKey] == 0 {
+		delete(t.loads, parentKey)
+	}
+}
+
+// LoadStats returns the statistics of the bounded-load mode
+func (r *CRing) LoadStats() LoadStats {
+	t := r.loadTable()
+	if t == nil {
+		return LoadStats{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := LoadStats{
+		Lookups: t.lookups,
+		Moved:   t.moved,
+		Loads:   make(map[string]int, len(t.loads)),
+	}
+	for key, load := range t.loads {
+		stats.Loads[key] = load
+	}
+	return stats
+}
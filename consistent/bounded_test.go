@@ -0,0 +1,58 @@
+package consistent
+
+import "testing"
+
+func TestPickBounded(t *testing.T) {
+	r := NewRing(nil)
+	for _, key := range []string{"a", "b", "c"} {
+		r.AddNode(key, 4, nil)
+	}
+	candidates := []*CNode{r.Member("a"), r.Member("b")}
+
+	if got := r.PickBounded(candidates); got.Key != "a" {
+		t.Fatalf("without bounded loads picked %s, want a", got.Key)
+	}
+	if got := r.PickBounded(nil); got != nil {
+		t.Fatalf("picked %s out of no candidate", got.Key)
+	}
+
+	// Capacity is ceil(1.0 * (total+1) / 3): a takes the first
+	// unit, then b has to take the second
+	r.EnableBoundedLoad(1)
+	tests := []struct {
+		want  string
+		loads map[string]int
+	}{
+		{"a", map[string]int{"a": 1}},
+		{"b", map[string]int{"a": 1, "b": 1}},
+		{"a", map[string]int{"a": 2, "b": 1}},
+		{"b", map[string]int{"a": 2, "b": 2}},
+	}
+	for walk, tt := range tests {
+		got := r.PickBounded(candidates)
+		if got.Key != tt.want {
+			t.Fatalf("pick %d is %s, want %s", walk, got.Key, tt.want)
+		}
+		stats := r.LoadStats()
+		for key, load := range tt.loads {
+			if stats.Loads[key] != load {
+				t.Fatalf("after pick %d %s has load %d, want %d", walk, key, stats.Loads[key], load)
+			}
+		}
+	}
+
+	// Candidates all full still serve, the owner takes the load
+	r.Release("b")
+	r.Release("b")
+	r.Release("a")
+	r.Release("a")
+	full := []*CNode{r.Member("a")}
+	for walk := 0; walk < 3; walk++ {
+		if got := r.PickBounded(full); got.Key != "a" {
+			t.Fatalf("only candidate not picked, got %s", got.Key)
+		}
+	}
+	if stats := r.LoadStats(); stats.Loads["a"] != 3 || stats.Moved != 2 {
+		t.Fatalf("loads %v moved %d, want a at 3 and 2 moved", stats.Loads, stats.Moved)
+	}
+}
@@ -0,0 +1,69 @@
+package consistent
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess reads the ring while members come and go,
+// run it with -race
+func TestConcurrentAccess(t *testing.T) {
+	r := NewRing(nil)
+	for walk := 0; walk < 4; walk++ {
+		r.AddNode("stable"+strconv.Itoa(walk), 10, nil)
+	}
+
+	const (
+		readers = 8
+		writers = 4
+		rounds  = 200
+	)
+	var wg sync.WaitGroup
+	errs := make(chan string, readers*rounds)
+	for walk := 0; walk < readers; walk++ {
+		wg.Add(1)
+		go func(reader int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				key := "user" + strconv.Itoa(reader*rounds+round)
+				node := r.GetNext(key)
+				if node == nil {
+					errs <- "GetNext(" + key + ") found no node"
+					continue
+				}
+				r.GetNextParent(node)
+				r.GetNextParents(node, 2)
+				r.GetNextN(key, 3)
+				r.Members()
+			}
+		}(walk)
+	}
+	for walk := 0; walk < writers; walk++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				key := "node" + strconv.Itoa(writer) + "-" + strconv.Itoa(round%5)
+				if !r.AddNode(key, 5, nil) {
+					r.Reweight(key, 1+round%7)
+				}
+				r.RemoveNode(key)
+			}
+		}(walk)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Only the stable members are left, each with all its nodes
+	if r.Size() != 4 {
+		t.Fatalf("ring has %d members, want 4", r.Size())
+	}
+	if got := r.load().nodes.Len(); got != 40 {
+		t.Fatalf("ring has %d nodes, want 40", got)
+	}
+	checkLookups(t, r)
+}
@@ -1,25 +1,23 @@
 package consistent
 
 import (
-	"conhash/rpcs"
-	"crypto/sha256"
-	"encoding/binary"
-	"fmt"
-	"net/rpc"
+	"context"
+	"log/slog"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // CNode represents a node on the consistent hash ring
 type CNode struct {
-	Port      int
-	Conn      *rpc.Client // Connection to the node
-	Key       string      // id of the node
-	Weight    int         // weight of the node
-	Parent    uint64      // parent hash of the node
-	ParentKey string      // key of the parent node
-	Hash      uint64      // hash of the node
+	Key       string            // id of the node
+	Weight    int               // weight of the node
+	Parent    uint64            // parent hash of the node
+	ParentKey string            // key of the parent node
+	Hash      uint64            // hash of the node
+	Meta      map[string]string // metadata of the member, shared by its virtual nodes
 }
 
 type nodes []*CNode
@@ -28,28 +26,102 @@ func (n nodes) Len() int           { return len(n) }
 func (n nodes) Less(i, j int) bool { return n[i].Hash < n[j].Hash }
 func (n nodes) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
 
-// CRing contains the attributes related to consistent hashing
+// CRing contains the attributes related to consistent hashing.
+// It is safe for concurrent use: readers work on an immutable
+// snapshot of the ring and never block, while writers serialize
+// on a mutex and publish a modified copy of the snapshot
 type CRing struct {
 	suffix  string
-	parents map[string]*CNode
-	nodes   nodes
+	hasher  Hasher
+	mu      sync.Mutex   // serializes writers
+	state   atomic.Value // current *ringState
+	bounded atomic.Value // *loadTable once bounded loads are enabled
+	logger  *slog.Logger
+}
+
+// ringState is an immutable snapshot of the ring
+type ringState struct {
+	parents  map[string]*CNode
+	nodes    nodes
+	nextDiff []int  // index of the next node from another parent
+	prevDiff []int  // index of the previous node from another parent
+	labelled bool   // some member advertises a failure domain
+	epoch    uint64 // number of changes the ring went through
 }
 
 // NewRing returns a new instance of a consistent hash ring
-func NewRing() *CRing {
-	return &CRing{
+// placing keys with hasher, or DefaultHasher if it is nil
+func NewRing(hasher Hasher) *CRing {
+	if hasher == nil {
+		hasher = DefaultHasher()
+	}
+	r := &CRing{
+		suffix: "-",
+		hasher: hasher,
+		logger: slog.Default(),
+	}
+	r.state.Store(&ringState{
 		parents: make(map[string]*CNode),
-		suffix:  "-",
+	})
+	return r
+}
+
+// SetLogger makes the ring log its changes to logger, or to the
+// default logger if it is nil. Call it before sharing the ring
+func (r *CRing) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r.logger = logger
+}
+
+// load returns the current snapshot of the ring
+func (r *CRing) load() *ringState {
+	return r.state.Load().(*ringState)
+}
+
+// clone returns a copy of the snapshot that can be
+// modified without affecting readers of s. The copy
+// belongs to the next epoch
+func (s *ringState) clone() *ringState {
+	c := &ringState{
+		parents: make(map[string]*CNode, len(s.parents)),
+		nodes:   make(nodes, len(s.nodes)),
+		epoch:   s.epoch + 1,
+	}
+	for key, node := range s.parents {
+		c.parents[key] = node
 	}
+	copy(c.nodes, s.nodes)
+	return c
 }
 
-// GenHash produces Sha256 hash of given string
+// Epoch returns the epoch of the ring, it grows with
+// every member added, removed or reweighted
+func (r *CRing) Epoch() uint64 {
+	return r.load().epoch
+}
+
+// SetEpoch moves the ring to epoch, used when a ring is
+// rebuilt from a snapshot of another one
+func (r *CRing) SetEpoch(epoch uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.load().clone()
+	s.epoch = epoch
+	r.state.Store(s)
+}
+
+// GenHash produces the hash of given string using
+// the hasher of the ring
 func (r *CRing) GenHash(key string) uint64 {
-	hasher := sha256.New()
-	hasher.Write([]byte(key))
-	digest := hasher.Sum(nil)
-	digestAsUint64 := binary.LittleEndian.Uint64(digest)
-	return digestAsUint64
+	return r.hasher.Hash(key)
+}
+
+// HasherName returns the name of the hasher of the ring
+func (r *CRing) HasherName() string {
+	return r.hasher.Name()
 }
 
 // GetVirKey returns the next virtual key
@@ -66,26 +138,21 @@ func (r *CRing) GetParKey(key string) string {
 	return strings.TrimSuffix(key, r.suffix)
 }
 
-// AddSolo ...
-func (r *CRing) AddSolo(key string, parentKey string, port int) bool {
+// AddSolo adds a single node that is its own parent, parentKey
+// only records the member it belongs to
+func (r *CRing) AddSolo(key string, parentKey string, meta map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if _, exist := r.parents[key]; exist {
+	if _, exist := r.load().parents[key]; exist {
 		return false
 	}
 
 	hash := r.GenHash(key)
 
-	// Try connecting the node
-	// TODO: Get IP via something else ...
-	conn, err := rpc.DialHTTP("tcp", ":"+strconv.Itoa(port))
-	if err != nil {
-		return false
-	}
-
 	// Setting the parent node
 	node := CNode{
-		Port:      port,
-		Conn:      conn,
+		Meta:      meta,
 		ParentKey: parentKey,
 		Key:       key,
 		Parent:    hash,
@@ -93,137 +160,282 @@ func (r *CRing) AddSolo(key string, parentKey string, port int) bool {
 		Weight:    1,
 	}
 
-	r.parents[key] = &node
-	r.nodes = append(r.nodes, &node)
-	sort.Sort(r.nodes)
+	s := r.load().clone()
+	s.parents[key] = &node
+	s.nodes = append(s.nodes, &node)
+	sort.Sort(s.nodes)
+	s.reindex()
+	r.state.Store(s)
 	return true
 }
 
-// AddNode adds a new node into the ring
-func (r *CRing) AddNode(args *rpcs.JoinArgs) bool {
-	weight := args.Weight
-	key := args.ID
-
-	if _, exist := r.parents[key]; exist {
-		return false
-	}
+// AddNode adds a new member with weight virtual nodes
+// into the ring
+func (r *CRing) AddNode(key string, weight int, meta map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// Try connecting the node
-	// TODO: Get IP via something else ...
-	conn, err := rpc.DialHTTP("tcp", ":"+strconv.Itoa(args.Port))
-	if err != nil {
+	if _, exist := r.load().parents[key]; exist {
 		return false
 	}
 
 	hash := r.GenHash(key)
 	// Setting the parent node
 	node := CNode{
-		Port:      args.Port,
-		Conn:      conn,
+		Meta:      meta,
 		ParentKey: key,
 		Parent:    hash,
 		Hash:      hash,
 		Key:       key,
 		Weight:    weight,
 	}
-	r.parents[key] = &node
-	r.nodes = append(r.nodes, &node)
+	s := r.load().clone()
+	s.parents[key] = &node
+	s.nodes = append(s.nodes, &node)
 	weight--
 
 	for weight > 0 {
 		seed := r.GetVirKey(key, weight)
 		hash := r.GenHash(seed)
 		virNode := CNode{
-			Port:      args.Port,
-			Conn:      conn,
+			Meta:      meta,
 			ParentKey: node.Key,
 			Parent:    node.Hash,
 			Hash:      hash,
 			Key:       seed,
 			Weight:    node.Weight,
 		}
-		r.nodes = append(r.nodes, &virNode)
+		s.nodes = append(s.nodes, &virNode)
 		weight--
 	}
-	sort.Sort(r.nodes)
+	sort.Sort(s.nodes)
+	s.reindex()
+	r.state.Store(s)
 
 	return true
 }
 
 // RemoveSolo remove a single node from ring
 func (r *CRing) RemoveSolo(key string) bool {
-	if _, exist := r.parents[key]; !exist {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.load().parents[key]; !exist {
 		return false
 	}
 
+	s := r.load().clone()
 	walk := 0
-	for walk != r.nodes.Len() {
-		if r.nodes[walk].Key == key {
-			r.nodes = append(r.nodes[:walk], r.nodes[walk+1:]...)
+	for walk != s.nodes.Len() {
+		if s.nodes[walk].Key == key {
+			s.nodes = append(s.nodes[:walk], s.nodes[walk+1:]...)
 			break
 		}
 		walk++
 	}
 
-	delete(r.parents, key)
+	delete(s.parents, key)
+	s.reindex()
+	r.state.Store(s)
 	return true
 }
 
 // RemoveNode removes a node from the ring provided its key
 // as the argument
-func (r *CRing) RemoveNode(key string) {
-	parent, exist := r.parents[key]
+func (r *CRing) RemoveNode(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parent, exist := r.load().parents[key]
 
 	if !exist {
-		return
+		return false
 	}
 
-	walk := r.nodes.Len() - 1
+	s := r.load().clone()
+	walk := s.nodes.Len() - 1
 	for walk >= 0 {
-		node := r.nodes[walk]
+		node := s.nodes[walk]
 		if node.Parent == parent.Hash {
-			r.nodes = append(r.nodes[:walk], r.nodes[walk+1:]...)
+			s.nodes = append(s.nodes[:walk], s.nodes[walk+1:]...)
 		}
 		walk--
 	}
 
-	fmt.Println("Length:", r.nodes.Len())
-	delete(r.parents, key)
+	r.logger.Debug("member removed", "node", key, "nodes", s.nodes.Len(), "epoch", s.epoch)
+	delete(s.parents, key)
+	s.reindex()
+	r.state.Store(s)
+	return true
+}
+
+// Reweight changes the number of virtual nodes of the member key
+// and returns the virtual nodes it added or removed
+func (r *CRing) Reweight(key string, weight int) (added []*CNode, removed []*CNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parent, exist := r.load().parents[key]
+	if !exist || weight < 1 || weight == parent.Weight {
+		return nil, nil
+	}
+
+	// Published nodes are shared with readers, so every node of
+	// the member is replaced by a copy carrying the new weight
+	s := r.load().clone()
+	member := *parent
+	member.Weight = weight
+	s.parents[key] = &member
+
+	gone := make(map[string]bool)
+	for walk := weight; walk < parent.Weight; walk++ {
+		gone[r.GetVirKey(key, walk)] = true
+	}
+	kept := s.nodes[:0]
+	for _, node := range s.nodes {
+		if node.Parent != parent.Hash {
+			kept = append(kept, node)
+		} else if gone[node.Key] {
+			removed = append(removed, node)
+		} else if node == parent {
+			kept = append(kept, &member)
+		} else {
+			virNode := *node
+			virNode.Weight = weight
+			kept = append(kept, &virNode)
+		}
+	}
+	for walk := parent.Weight; walk < weight; walk++ {
+		seed := r.GetVirKey(key, walk)
+		virNode := CNode{
+			Meta:      member.Meta,
+			ParentKey: member.Key,
+			Parent:    member.Hash,
+			Hash:      r.GenHash(seed),
+			Key:       seed,
+			Weight:    weight,
+		}
+		kept = append(kept, &virNode)
+		added = append(added, &virNode)
+	}
+	s.nodes = kept
+	sort.Sort(s.nodes)
+	s.reindex()
+	r.state.Store(s)
+	return added, removed
+}
+
+// Member returns the parent node of the member key
+func (r *CRing) Member(key string) *CNode {
+	return r.load().parents[key]
+}
+
+// reindex rebuilds the successor and predecessor indexes
+// of the nodes from a different parent. It must be called
+// whenever the sorted nodes change
+func (s *ringState) reindex() {
+	size := s.nodes.Len()
+	s.nextDiff = make([]int, size)
+	s.prevDiff = make([]int, size)
+	s.labelled = false
+	for _, node := range s.nodes {
+		if isLabelled(node) {
+			s.labelled = true
+			break
+		}
+	}
+	if size == 0 {
+		return
+	}
+
+	// Walk the ring twice so that the indexes wrap around
+	next := make([]int, 2*size)
+	next[2*size-1] = -1
+	for walk := 2*size - 2; walk >= 0; walk-- {
+		if s.nodes[(walk+1)%size].Parent != s.nodes[walk%size].Parent {
+			next[walk] = walk + 1
+		} else {
+			next[walk] = next[walk+1]
+		}
+	}
+	prev := make([]int, 2*size)
+	prev[0] = -1
+	for walk := 1; walk < 2*size; walk++ {
+		if s.nodes[(walk-1)%size].Parent != s.nodes[walk%size].Parent {
+			prev[walk] = walk - 1
+		} else {
+			prev[walk] = prev[walk-1]
+		}
+	}
+
+	for walk := 0; walk < size; walk++ {
+		s.nextDiff[walk] = next[walk]
+		if next[walk] != -1 {
+			s.nextDiff[walk] %= size
+		}
+		s.prevDiff[walk] = prev[walk+size]
+		if prev[walk+size] != -1 {
+			s.prevDiff[walk] %= size
+		}
+	}
+}
+
+// search returns the index of the first node whose hash
+// is greater than hash, or at least hash if inclusive
+func (s *ringState) search(hash uint64, inclusive bool) int {
+	return sort.Search(s.nodes.Len(), func(i int) bool {
+		if inclusive {
+			return s.nodes[i].Hash >= hash
+		}
+		return s.nodes[i].Hash > hash
+	})
+}
+
+// GetPrev returns the node before node in the ring whatever
+// its parent, the hash range of node starts right after it
+func (r *CRing) GetPrev(node *CNode) *CNode {
+	s := r.load()
+	if s.nodes.Len() == 0 {
+		return nil
+	}
+	walk := s.search(node.Hash, true) - 1
+	if walk == -1 {
+		walk = s.nodes.Len() - 1
+	}
+	return s.nodes[walk]
 }
 
 // GetPrevParent returns the previous node in the ring
 // from other parent...
 func (r *CRing) GetPrevParent(node *CNode) *CNode {
-	if r.Size() == 1 {
+	return r.load().prevParent(node)
+}
+
+func (s *ringState) prevParent(node *CNode) *CNode {
+	if len(s.parents) == 1 || s.nodes.Len() == 0 {
 		return nil
 	}
 
-	walk := r.nodes.Len() - 1
-	for walk != -1 {
-		curr := r.nodes[walk]
-		if curr.Hash < node.Hash && curr.Parent != node.Parent {
-			return curr
-		}
-		walk--
+	walk := s.search(node.Hash, true) - 1
+	if walk == -1 {
+		walk = s.nodes.Len() - 1
 	}
-
-	walk = r.nodes.Len() - 1
-	for walk != -1 {
-		curr := r.nodes[walk]
-		if curr.Parent != node.Parent {
-			return curr
-		}
-		walk--
+	if s.nodes[walk].Parent != node.Parent {
+		return s.nodes[walk]
+	}
+	if walk = s.prevDiff[walk]; walk == -1 {
+		return nil
 	}
-	return nil
+	return s.nodes[walk]
 }
 
 // GetNextExcept returns the next parent in the consistent ring
 // except other than they key specified
 func (r *CRing) GetNextExcept(node *CNode, key string) *CNode {
-	ret := r.GetNextParent(node)
-	for ret.ParentKey == key {
-		ret = r.GetNextParent(ret)
+	s := r.load()
+	ret := s.nextParent(node)
+	for ret != nil && ret.ParentKey == key {
+		ret = s.nextParent(ret)
 	}
 	return ret
 }
@@ -239,64 +451,59 @@ func (r *CRing) GetNextParentWithKey(key string) *CNode {
 
 }
 
-// GetNextParent returns the next parent in the consistent ring
+// GetNextParent returns the next parent in the consistent ring,
+// the member that owned the range of node before it joined. It
+// ignores failure domains, replicas are picked by GetNextParents
 func (r *CRing) GetNextParent(node *CNode) *CNode {
-	if r.Size() == 1 {
+	return r.load().nextParent(node)
+}
+
+func (s *ringState) nextParent(node *CNode) *CNode {
+	if len(s.parents) == 1 || s.nodes.Len() == 0 {
 		return nil
 	}
 
-	walk := 0
-	for walk != r.nodes.Len() {
-		curr := r.nodes[walk]
-		if curr.Hash > node.Hash && curr.Parent != node.Parent {
-			return curr
-		}
-		walk++
+	// Get the first node in ring from other parent
+	walk := s.search(node.Hash, false)
+	if walk == s.nodes.Len() {
+		walk = 0
 	}
-	walk = 0
-	// Otherwise get the first node in ring from other parent
-	for walk != r.nodes.Len() {
-		curr := r.nodes[walk]
-		if curr.Parent != node.Parent {
-			return curr
-		}
-		walk++
+	if s.nodes[walk].Parent != node.Parent {
+		return s.nodes[walk]
+	}
+	if walk = s.nextDiff[walk]; walk == -1 {
+		return nil
 	}
-	return nil
+	return s.nodes[walk]
 }
 
 // Size returns the number of physical nodes in the ring
 func (r *CRing) Size() int {
-	return len(r.parents)
+	return len(r.load().parents)
 }
 
 // GetNext returns the next node in the consistent ring
 // after the key hash
 func (r *CRing) GetNext(key string) *CNode {
-	if r.Size() == 0 {
+	s := r.load()
+	if len(s.parents) == 0 || s.nodes.Len() == 0 {
 		return nil
 	}
 
-	hash := r.GenHash(key)
-	walk := 0
-
-	for walk != r.nodes.Len() {
-		curr := r.nodes[walk]
-		if curr.Hash >= hash {
-			return curr
-		}
-		walk++
+	walk := s.search(r.GenHash(key), true)
+	if walk == s.nodes.Len() {
+		return s.nodes[0]
 	}
-	return r.nodes[0]
+	return s.nodes[walk]
 }
 
-// Display prints the ring on the console
+// Display logs every node of the ring at debug level
 func (r *CRing) Display() {
-	walk := 0
-	for walk < r.nodes.Len() {
-		node := r.nodes[walk]
-		fmt.Println("Hash:", node.Hash, "\tKey:", node.Key)
-		walk++
+	if !r.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	s := r.load()
+	for _, node := range s.nodes {
+		r.logger.Debug("ring node", "node", node.Key, "hash", node.Hash, "epoch", s.epoch)
 	}
-	fmt.Println("=====================")
 }
@@ -0,0 +1,386 @@
+package consistent
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// fixedHasher places keys at chosen hashes so that tests
+// know the layout of the ring, other keys use FNV-1a
+type fixedHasher map[string]uint64
+
+func (h fixedHasher) Name() string { return "fixed" }
+
+func (h fixedHasher) Hash(key string) uint64 {
+	if hash, exist := h[key]; exist {
+		return hash
+	}
+	return fnvHasher{}.Hash(key)
+}
+
+// newFixedRing returns a ring of a at 100 and 300 and b at 200
+// and 400, with keys hashing in between
+func newFixedRing() *CRing {
+	r := NewRing(fixedHasher{
+		"a": 100, "a-1": 300,
+		"b": 200, "b-1": 400,
+		"k0": 0, "k50": 50, "k100": 100, "k150": 150,
+		"k250": 250, "k400": 400, "k450": 450,
+	})
+	r.AddNode("a", 2, nil)
+	r.AddNode("b", 2, nil)
+	return r
+}
+
+func TestGetNext(t *testing.T) {
+	r := newFixedRing()
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"k0", "a"},
+		{"k50", "a"},
+		{"k100", "a"}, // a node owns its own hash
+		{"k150", "b"},
+		{"k250", "a-1"},
+		{"k400", "b-1"},
+		{"k450", "a"}, // past the last node wraps around
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := r.GetNext(tt.key); got == nil || got.Key != tt.want {
+				t.Errorf("GetNext(%s) = %v, want %s", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	r := NewRing(nil)
+	if node := r.GetNext("key"); node != nil {
+		t.Errorf("GetNext on an empty ring returned %s", node.Key)
+	}
+	if nodes := r.GetNextN("key", 2); len(nodes) != 0 {
+		t.Errorf("GetNextN on an empty ring returned %d nodes", len(nodes))
+	}
+	if node := r.Lookup("key"); node != nil {
+		t.Errorf("Lookup on an empty ring returned %s", node.Key)
+	}
+	if r.RemoveNode("a") {
+		t.Error("RemoveNode of a missing member succeeded")
+	}
+	if r.Size() != 0 || len(r.Members()) != 0 {
+		t.Errorf("empty ring has %d members", r.Size())
+	}
+	r.AddNode("a", 3, nil)
+	r.RemoveNode("a")
+	if node := r.GetNext("key"); node != nil {
+		t.Errorf("GetNext on an emptied ring returned %s", node.Key)
+	}
+}
+
+func TestParents(t *testing.T) {
+	r := newFixedRing()
+	r.AddNode("c", 1, nil) // hashes with FNV-1a, far past 400
+	tests := []struct {
+		name string
+		node string
+		next string
+		prev string
+	}{
+		{"first", "a", "b", "c"},
+		{"middle", "b", "a-1", "a"},
+		{"last before c", "b-1", "c", "a-1"},
+		{"wraps", "c", "a", "b-1"},
+	}
+	nodes := make(map[string]*CNode)
+	for _, node := range r.load().nodes {
+		nodes[node.Key] = node
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := nodes[tt.node]
+			if got := r.GetNextParent(node); got == nil || got.Key != tt.next {
+				t.Errorf("GetNextParent(%s) = %v, want %s", tt.node, got, tt.next)
+			}
+			if got := r.GetPrevParent(node); got == nil || got.Key != tt.prev {
+				t.Errorf("GetPrevParent(%s) = %v, want %s", tt.node, got, tt.prev)
+			}
+		})
+	}
+}
+
+func TestParentsIgnoreDomains(t *testing.T) {
+	r := NewRing(fixedHasher{
+		"a": 100, "a-1": 300,
+		"b": 200, "b-1": 400,
+		"c": 250,
+	})
+	r.AddNode("a", 2, map[string]string{MetaZone: "z1"})
+	r.AddNode("b", 2, map[string]string{MetaZone: "z1"})
+	r.AddNode("c", 1, map[string]string{MetaZone: "z2"})
+	tests := []struct {
+		node string
+		next string
+		prev string
+	}{
+		{"a", "b", "b-1"},
+		{"b", "c", "a"},
+		{"c", "a-1", "b"},
+		{"a-1", "b-1", "c"},
+	}
+	nodes := make(map[string]*CNode)
+	for _, node := range r.load().nodes {
+		nodes[node.Key] = node
+	}
+	for _, tt := range tests {
+		t.Run(tt.node, func(t *testing.T) {
+			node := nodes[tt.node]
+			if got := r.GetNextParent(node); got == nil || got.Key != tt.next {
+				t.Errorf("GetNextParent(%s) = %v, want %s", tt.node, got, tt.next)
+			}
+			if got := r.GetPrev(node); got == nil || got.Key != tt.prev {
+				t.Errorf("GetPrev(%s) = %v, want %s", tt.node, got, tt.prev)
+			}
+		})
+	}
+	// Replicas of a still leave zone z1
+	if replicas := r.GetNextParents(nodes["a"], 1); len(replicas) != 1 || replicas[0].ParentKey != "c" {
+		t.Errorf("GetNextParents(a) = %v, want c", replicas)
+	}
+}
+
+func TestSingleMember(t *testing.T) {
+	r := NewRing(nil)
+	r.AddNode("a", 4, nil)
+	node := r.GetNext("key")
+	if node == nil || node.ParentKey != "a" {
+		t.Fatalf("GetNext = %v, want a node of a", node)
+	}
+	if next := r.GetNextParent(node); next != nil {
+		t.Errorf("GetNextParent with one member = %s", next.Key)
+	}
+	if prev := r.GetPrevParent(node); prev != nil {
+		t.Errorf("GetPrevParent with one member = %s", prev.Key)
+	}
+	if replicas := r.GetNextParents(node, 2); len(replicas) != 0 {
+		t.Errorf("GetNextParents with one member returned %d nodes", len(replicas))
+	}
+}
+
+// linearNext is the reference lookup: the first node at or after
+// the hash of key, the first node of the ring past the last one
+func linearNext(r *CRing, key string) *CNode {
+	nodes := r.load().nodes
+	hash := r.GenHash(key)
+	for _, node := range nodes {
+		if node.Hash >= hash {
+			return node
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+func TestAddRemoveLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		members int
+		weight  int
+	}{
+		{"one member one node", 1, 1},
+		{"few members one node", 3, 1},
+		{"few members", 3, 10},
+		{"many members", 20, 10},
+		{"heavy members", 5, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRing(nil)
+			for walk := 0; walk < tt.members; walk++ {
+				key := "node" + strconv.Itoa(walk)
+				if !r.AddNode(key, tt.weight, nil) {
+					t.Fatalf("AddNode(%s) failed", key)
+				}
+				if r.AddNode(key, tt.weight, nil) {
+					t.Fatalf("AddNode(%s) twice succeeded", key)
+				}
+			}
+			if got := r.load().nodes.Len(); got != tt.members*tt.weight {
+				t.Fatalf("ring has %d nodes, want %d", got, tt.members*tt.weight)
+			}
+			if !sort.IsSorted(r.load().nodes) {
+				t.Fatal("nodes are not sorted")
+			}
+			checkLookups(t, r)
+
+			removed := "node0"
+			if !r.RemoveNode(removed) {
+				t.Fatalf("RemoveNode(%s) failed", removed)
+			}
+			if r.Member(removed) != nil {
+				t.Fatalf("%s is still a member", removed)
+			}
+			for _, node := range r.load().nodes {
+				if node.ParentKey == removed {
+					t.Fatalf("node %s of %s is still in the ring", node.Key, removed)
+				}
+			}
+			if got := r.load().nodes.Len(); got != (tt.members-1)*tt.weight {
+				t.Fatalf("ring has %d nodes after remove, want %d", got, (tt.members-1)*tt.weight)
+			}
+			checkLookups(t, r)
+		})
+	}
+}
+
+// checkLookups compares GetNext with the reference lookup
+func checkLookups(t *testing.T, r *CRing) {
+	t.Helper()
+	for walk := 0; walk < 1000; walk++ {
+		key := "user" + strconv.Itoa(walk)
+		if got, want := r.GetNext(key), linearNext(r, key); got != want {
+			t.Fatalf("GetNext(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	r := NewRing(nil)
+	steps := []struct {
+		name   string
+		change func() bool
+		epoch  uint64
+	}{
+		{"add", func() bool { return r.AddNode("a", 2, nil) }, 1},
+		{"add again", func() bool { return !r.AddNode("a", 2, nil) }, 1},
+		{"add other", func() bool { return r.AddNode("b", 2, nil) }, 2},
+		{"reweight", func() bool { added, _ := r.Reweight("a", 4); return len(added) == 2 }, 3},
+		{"remove", func() bool { return r.RemoveNode("b") }, 4},
+		{"remove missing", func() bool { return !r.RemoveNode("b") }, 4},
+	}
+	for _, step := range steps {
+		if !step.change() {
+			t.Fatalf("%s failed", step.name)
+		}
+		if r.Epoch() != step.epoch {
+			t.Fatalf("epoch after %s is %d, want %d", step.name, r.Epoch(), step.epoch)
+		}
+	}
+}
+
+func TestReweight(t *testing.T) {
+	tests := []struct {
+		name           string
+		from, to       int
+		added, removed int
+	}{
+		{"grow", 2, 5, 3, 0},
+		{"shrink", 5, 2, 0, 3},
+		{"same", 3, 3, 0, 0},
+		{"below one", 3, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRing(nil)
+			r.AddNode("a", tt.from, nil)
+			r.AddNode("b", 3, nil)
+			added, removed := r.Reweight("a", tt.to)
+			if len(added) != tt.added || len(removed) != tt.removed {
+				t.Fatalf("added %d and removed %d, want %d and %d", len(added), len(removed), tt.added, tt.removed)
+			}
+			want := tt.from + tt.added - tt.removed
+			count := 0
+			for _, node := range r.load().nodes {
+				if node.ParentKey == "a" {
+					count++
+					if node.Weight != want {
+						t.Fatalf("node %s has weight %d, want %d", node.Key, node.Weight, want)
+					}
+				}
+			}
+			if count != want {
+				t.Fatalf("a has %d nodes, want %d", count, want)
+			}
+			checkLookups(t, r)
+		})
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	tests := []struct {
+		name  string
+		zones map[string]string
+	}{
+		{"no labels", map[string]string{}},
+		{"labelled", map[string]string{"a": "z1", "b": "z1", "c": "z1", "d": "z2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRing(nil)
+			for _, key := range []string{"a", "b", "c", "d"} {
+				r.AddNode(key, 4, map[string]string{MetaZone: tt.zones[key]})
+			}
+			replicas := r.Replicas(2)
+			if len(replicas) != 16 {
+				t.Fatalf("Replicas has %d nodes, want 16", len(replicas))
+			}
+			for _, node := range r.load().nodes {
+				want := r.GetNextParents(node, 2)
+				got := replicas[node.Key]
+				if len(got) != len(want) {
+					t.Fatalf("%s has %d replicas, want %d", node.Key, len(got), len(want))
+				}
+				for walk := range want {
+					if got[walk] != want[walk] {
+						t.Fatalf("replica %d of %s is %s, want %s", walk, node.Key, got[walk].Key, want[walk].Key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGetNextParentsDomains(t *testing.T) {
+	tests := []struct {
+		name   string
+		zones  map[string]string
+		spread bool // a replica has to leave the zone of a
+	}{
+		{"no labels", map[string]string{}, false},
+		{"two zones", map[string]string{"a": "z1", "b": "z1", "c": "z2", "d": "z2"}, true},
+		{"one zone", map[string]string{"a": "z1", "b": "z1", "c": "z1", "d": "z1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRing(nil)
+			for _, key := range []string{"a", "b", "c", "d"} {
+				r.AddNode(key, 4, map[string]string{MetaZone: tt.zones[key]})
+			}
+			for _, node := range r.load().nodes {
+				if node.ParentKey != "a" {
+					continue
+				}
+				replicas := r.GetNextParents(node, 2)
+				if len(replicas) != 2 {
+					t.Fatalf("%s has %d replicas, want 2", node.Key, len(replicas))
+				}
+				outside := 0
+				for _, replica := range replicas {
+					if replica.ParentKey == "a" {
+						t.Fatalf("%s is replicated on its own member", node.Key)
+					}
+					if zone := tt.zones[replica.ParentKey]; zone != "" && zone != tt.zones["a"] {
+						outside++
+					}
+				}
+				if tt.spread && outside == 0 {
+					t.Fatalf("replicas of %s all share its zone", node.Key)
+				}
+			}
+		})
+	}
+}
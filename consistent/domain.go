@@ -0,0 +1,70 @@
+package consistent
+
+// Metadata keys of the failure domain of a member. Replica
+// selection avoids placing copies in the same zone, then in
+// the same rack, before falling back to any other member
+const (
+	MetaZone = "zone"
+	MetaRack = "rack"
+)
+
+// Levels of failure domains from the widest to none at all
+const (
+	levelZone = iota
+	levelRack
+	levelNone
+)
+
+// shareDomain reports whether two members are in the same
+// failure domain at level. Unlabelled members share nothing
+func shareDomain(a *CNode, b *CNode, level int) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	zoneA, zoneB := a.Meta[MetaZone], b.Meta[MetaZone]
+	switch level {
+	case levelZone:
+		return zoneA != "" && zoneA == zoneB
+	case levelRack:
+		rackA, rackB := a.Meta[MetaRack], b.Meta[MetaRack]
+		return rackA != "" && zoneA == zoneB && rackA == rackB
+	}
+	return false
+}
+
+// isLabelled reports whether the member advertises
+// a failure domain
+func isLabelled(node *CNode) bool {
+	return node.Meta[MetaZone] != "" || node.Meta[MetaRack] != ""
+}
+
+// spread picks up to n of the candidates, which are in ring order
+// and belong to distinct members. It first avoids every failure
+// domain already used by chosen, then only racks and finally takes
+// the remaining candidates in ring order
+func spread(candidates []*CNode, chosen []*CNode, n int) []*CNode {
+	var picked []*CNode
+	taken := make([]bool, len(candidates))
+	chosen = append([]*CNode(nil), chosen...)
+
+	for level := levelZone; level <= levelNone && len(picked) < n; level++ {
+		for walk, candidate := range candidates {
+			if taken[walk] || len(picked) == n {
+				continue
+			}
+			conflict := false
+			for _, other := range chosen {
+				if shareDomain(candidate, other, level) {
+					conflict = true
+					break
+				}
+			}
+			if !conflict {
+				taken[walk] = true
+				picked = append(picked, candidate)
+				chosen = append(chosen, candidate)
+			}
+		}
+	}
+	return picked
+}
@@ -0,0 +1,224 @@
+package consistent
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+)
+
+// Hasher maps a key onto the 64-bit hash space of the ring
+type Hasher interface {
+	// Name identifies the hash function, two rings agree on
+	// placement only if their hashers have the same name
+	Name() string
+	// Hash returns the 64-bit hash of key
+	Hash(key string) uint64
+}
+
+// Names of the built-in hashers
+const (
+	SHA256  = "sha256"
+	FNV1a   = "fnv1a"
+	XXHash  = "xxhash"
+	Murmur3 = "murmur3"
+)
+
+// NewHasher returns the built-in hasher registered under name
+func NewHasher(name string) (Hasher, error) {
+	switch name {
+	case SHA256:
+		return sha256Hasher{}, nil
+	case FNV1a:
+		return fnvHasher{}, nil
+	case XXHash:
+		return xxHasher{}, nil
+	case Murmur3:
+		return murmurHasher{}, nil
+	}
+	return nil, fmt.Errorf("unknown hasher %q", name)
+}
+
+// DefaultHasher returns the hasher used when none is specified.
+// It is the Sha256 hasher the ring has always used
+func DefaultHasher() Hasher {
+	return sha256Hasher{}
+}
+
+// sha256Hasher truncates the Sha256 digest to a little-endian uint64
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string { return SHA256 }
+
+func (sha256Hasher) Hash(key string) uint64 {
+	digest := sha256.Sum256([]byte(key))
+	return binary.LittleEndian.Uint64(digest[:])
+}
+
+// fnvHasher is the 64-bit FNV-1a hash
+type fnvHasher struct{}
+
+func (fnvHasher) Name() string { return FNV1a }
+
+func (fnvHasher) Hash(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return hasher.Sum64()
+}
+
+// xxHasher is XXH64 with a zero seed
+type xxHasher struct{}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (xxHasher) Name() string { return XXHash }
+
+func (xxHasher) Hash(key string) uint64 {
+	b := []byte(key)
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		// Seeded lanes wrap around, so they are built at runtime
+		v1, v2, v3, v4 := xxPrime1, xxPrime2, uint64(0), uint64(0)
+		v1 += xxPrime2
+		v4 -= xxPrime1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+
+	for len(b) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+		b = b[8:]
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, lane uint64) uint64 {
+	acc += lane * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// murmurHasher is the first half of MurmurHash3 x64_128 with a zero seed
+type murmurHasher struct{}
+
+const (
+	murmurC1 uint64 = 0x87c37b91114253d5
+	murmurC2 uint64 = 0x4cf5ad432745937f
+)
+
+func (murmurHasher) Name() string { return Murmur3 }
+
+func (murmurHasher) Hash(key string) uint64 {
+	b := []byte(key)
+	n := len(b)
+	var h1, h2 uint64
+
+	for len(b) >= 16 {
+		k1 := binary.LittleEndian.Uint64(b[0:8])
+		k2 := binary.LittleEndian.Uint64(b[8:16])
+		b = b[16:]
+
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	// Tail, the first 8 bytes feed k1 and the rest feed k2
+	var k1, k2 uint64
+	for i := len(b) - 1; i >= 8; i-- {
+		k2 ^= uint64(b[i]) << (8 * uint(i-8))
+	}
+	if len(b) > 8 {
+		k2 *= murmurC2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= murmurC1
+		h2 ^= k2
+	}
+	head := len(b)
+	if head > 8 {
+		head = 8
+	}
+	for i := head - 1; i >= 0; i-- {
+		k1 ^= uint64(b[i]) << (8 * uint(i))
+	}
+	if len(b) > 0 {
+		k1 *= murmurC1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= murmurC2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = murmurMix(h1)
+	h2 = murmurMix(h2)
+	h1 += h2
+	return h1
+}
+
+func murmurMix(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
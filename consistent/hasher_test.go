@@ -0,0 +1,105 @@
+package consistent
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// hasherNames are the names of the built-in hashers
+var hasherNames = []string{SHA256, FNV1a, XXHash, Murmur3}
+
+// hashSink keeps the compiler from dropping the hashes benchmarked
+var hashSink uint64
+
+func TestNewHasher(t *testing.T) {
+	for _, name := range hasherNames {
+		hasher, err := NewHasher(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if hasher.Name() != name {
+			t.Errorf("hasher %s is named %s", name, hasher.Name())
+		}
+		if hasher.Hash("key") != hasher.Hash("key") {
+			t.Errorf("%s hashes the same key apart", name)
+		}
+		if hasher.Hash("key") == hasher.Hash("kez") {
+			t.Errorf("%s hashes distinct keys together", name)
+		}
+	}
+	if _, err := NewHasher("md5"); err == nil {
+		t.Error("unknown hasher accepted")
+	}
+}
+
+// keySpread places keys on a ring of members with weight virtual nodes
+// each. It returns the standard deviation of the keys per member, in
+// percent of the mean, and the keys of the busiest member over the mean
+func keySpread(hasher Hasher, members, weight, keys int) (float64, float64) {
+	r := NewRing(hasher)
+	for walk := 0; walk < members; walk++ {
+		r.AddNode("node-"+strconv.Itoa(walk), weight, nil)
+	}
+	counts := make(map[string]int)
+	for walk := 0; walk < keys; walk++ {
+		counts[r.GetNext("user-"+strconv.Itoa(walk)).ParentKey]++
+	}
+
+	mean := float64(keys) / float64(members)
+	var variance, peak float64
+	for _, count := range counts {
+		variance += (float64(count) - mean) * (float64(count) - mean)
+		peak = math.Max(peak, float64(count))
+	}
+	variance /= float64(members)
+	return 100 * math.Sqrt(variance) / mean, peak / mean
+}
+
+// FNV-1a is left out: keys differing in their last bytes barely
+// change its high bits, BenchmarkDistribution shows the skew
+func TestHasherDistribution(t *testing.T) {
+	for _, name := range []string{SHA256, XXHash, Murmur3} {
+		hasher, _ := NewHasher(name)
+		deviation, peak := keySpread(hasher, 10, 100, 100000)
+		if deviation > 15 || peak > 1.3 {
+			t.Errorf("%s spreads keys unevenly: deviation %.1f%%, busiest %.2f times the mean", name, deviation, peak)
+		}
+	}
+}
+
+// BenchmarkHash measures the throughput of every hasher on keys
+// of the size of user ids and on longer ones
+func BenchmarkHash(b *testing.B) {
+	for _, name := range hasherNames {
+		hasher, _ := NewHasher(name)
+		for _, size := range []int{16, 64, 1024} {
+			key := strings.Repeat("k", size)
+			b.Run(name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for walk := 0; walk < b.N; walk++ {
+					hashSink = hasher.Hash(key)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDistribution places 100k keys on 10 members of 100
+// virtual nodes with every hasher. Besides the time of a round it
+// reports the deviation of the keys per member in percent of the
+// mean and the keys of the busiest member over the mean
+func BenchmarkDistribution(b *testing.B) {
+	for _, name := range hasherNames {
+		hasher, _ := NewHasher(name)
+		b.Run(name, func(b *testing.B) {
+			var deviation, peak float64
+			for walk := 0; walk < b.N; walk++ {
+				deviation, peak = keySpread(hasher, 10, 100, 100000)
+			}
+			b.ReportMetric(deviation, "deviation%")
+			b.ReportMetric(peak, "busiest/mean")
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package consistent
+
+import (
+	"strconv"
+	"sync"
+)
+
+// JumpRing places keys with Jump Consistent Hash. Every unit of
+// weight of a member is a bucket. Removing a member moves the
+// buckets of the last member into its place: the keys of those
+// buckets move along with the keys of the member, so about twice
+// the share of the member changes owner, 17% of the keys when one
+// of 11 members leaves. A ring built anew without the member, as
+// Place builds it, shifts the buckets of the members after it
+type JumpRing struct {
+	mu      sync.RWMutex
+	hasher  Hasher
+	members map[string]*CNode
+	buckets []*CNode // members in bucket order
+}
+
+// NewJumpRing returns an empty jump hash ring
+func NewJumpRing(hasher Hasher) *JumpRing {
+	if hasher == nil {
+		hasher = DefaultHasher()
+	}
+	return &JumpRing{
+		hasher:  hasher,
+		members: make(map[string]*CNode),
+	}
+}
+
+// jump maps key onto one of buckets, see
+// "A Fast, Minimal Memory, Consistent Hash Algorithm"
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Add appends the buckets of a member
+func (r *JumpRing) Add(key string, weight int, meta map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.members[key]; exist {
+		return false
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	member := newMember(r.hasher, key, weight, meta)
+	r.members[key] = member
+	for walk := 0; walk < weight; walk++ {
+		r.buckets = append(r.buckets, member)
+	}
+	return true
+}
+
+// Remove fills the buckets of a member with the
+// trailing buckets and shrinks the table
+func (r *JumpRing) Remove(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	member, exist := r.members[key]
+	if !exist {
+		return false
+	}
+	delete(r.members, key)
+
+	walk := len(r.buckets) - 1
+	for walk >= 0 {
+		if r.buckets[walk] == member {
+			last := len(r.buckets) - 1
+			r.buckets[walk] = r.buckets[last]
+			r.buckets = r.buckets[:last]
+		}
+		walk--
+	}
+	return true
+}
+
+// Lookup returns the member of the bucket of key
+func (r *JumpRing) Lookup(key string) *CNode {
+	nodes := r.LookupN(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// LookupN rehashes key with an increasing salt until
+// n distinct members are found
+func (r *JumpRing) LookupN(key string, n int) []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.buckets) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+
+	var members []*CNode
+	seen := make(map[string]bool)
+	hash := r.hasher.Hash(key)
+	for salt := 0; len(members) < n; salt++ {
+		if salt > 0 {
+			hash = r.hasher.Hash(key + "#" + strconv.Itoa(salt))
+		}
+		member := r.buckets[jump(hash, len(r.buckets))]
+		if !seen[member.Key] {
+			seen[member.Key] = true
+			members = append(members, member)
+		}
+		// Fill up in bucket order once salting stops finding members
+		if salt == 4*len(r.buckets) {
+			for _, member := range r.buckets {
+				if len(members) < n && !seen[member.Key] {
+					seen[member.Key] = true
+					members = append(members, member)
+				}
+			}
+		}
+	}
+	return members
+}
+
+// Members returns the members sorted by key
+func (r *JumpRing) Members() []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortMembers(r.members)
+}
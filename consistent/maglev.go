@@ -0,0 +1,138 @@
+package consistent
+
+import "sync"
+
+// MaglevTableSize is the default size of the lookup table,
+// it must be prime and well above the number of members
+const MaglevTableSize = 65537
+
+// MaglevRing places keys with a Maglev lookup table that
+// is rebuilt whenever the members change
+type MaglevRing struct {
+	mu      sync.RWMutex
+	hasher  Hasher
+	size    uint64
+	members map[string]*CNode
+	table   []*CNode
+}
+
+// NewMaglevRing returns an empty Maglev ring whose lookup
+// table has size entries, or MaglevTableSize if size is too small
+func NewMaglevRing(hasher Hasher, size int) *MaglevRing {
+	if hasher == nil {
+		hasher = DefaultHasher()
+	}
+	if size < 2 {
+		size = MaglevTableSize
+	}
+	return &MaglevRing{
+		hasher:  hasher,
+		size:    uint64(size),
+		members: make(map[string]*CNode),
+	}
+}
+
+// populate fills the lookup table, each member claims its next
+// preferred free entry once per unit of weight in every round
+func (r *MaglevRing) populate() {
+	members := sortMembers(r.members)
+	if len(members) == 0 {
+		r.table = nil
+		return
+	}
+
+	offsets := make([]uint64, len(members))
+	skips := make([]uint64, len(members))
+	nexts := make([]uint64, len(members))
+	for i, member := range members {
+		offsets[i] = r.hasher.Hash(member.Key) % r.size
+		skips[i] = r.hasher.Hash(member.Key+"#skip")%(r.size-1) + 1
+	}
+
+	table := make([]*CNode, r.size)
+	filled := uint64(0)
+	for filled < r.size {
+		for i, member := range members {
+			for turn := 0; turn < member.Weight && filled < r.size; turn++ {
+				entry := (offsets[i] + nexts[i]*skips[i]) % r.size
+				for table[entry] != nil {
+					nexts[i]++
+					entry = (offsets[i] + nexts[i]*skips[i]) % r.size
+				}
+				table[entry] = member
+				nexts[i]++
+				filled++
+			}
+		}
+	}
+	r.table = table
+}
+
+// Add adds a member and rebuilds the lookup table
+func (r *MaglevRing) Add(key string, weight int, meta map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.members[key]; exist {
+		return false
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	r.members[key] = newMember(r.hasher, key, weight, meta)
+	r.populate()
+	return true
+}
+
+// Remove removes a member and rebuilds the lookup table
+func (r *MaglevRing) Remove(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.members[key]; !exist {
+		return false
+	}
+	delete(r.members, key)
+	r.populate()
+	return true
+}
+
+// Lookup returns the member of the table entry of key
+func (r *MaglevRing) Lookup(key string) *CNode {
+	nodes := r.LookupN(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// LookupN walks the lookup table from the entry of key
+// collecting distinct members
+func (r *MaglevRing) LookupN(key string, n int) []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.table) == 0 || n <= 0 {
+		return nil
+	}
+
+	var members []*CNode
+	seen := make(map[string]bool)
+	entry := r.hasher.Hash(key) % r.size
+	for steps := uint64(0); steps < r.size && len(members) < n; steps++ {
+		member := r.table[entry]
+		if !seen[member.Key] {
+			seen[member.Key] = true
+			members = append(members, member)
+		}
+		entry = (entry + 1) % r.size
+	}
+	return members
+}
+
+// Members returns the members sorted by key
+func (r *MaglevRing) Members() []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortMembers(r.members)
+}
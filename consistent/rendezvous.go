@@ -0,0 +1,102 @@
+package consistent
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// RendezvousRing places keys with weighted rendezvous (highest
+// random weight) hashing, every member scores every key and the
+// highest score wins
+type RendezvousRing struct {
+	mu      sync.RWMutex
+	hasher  Hasher
+	members map[string]*CNode
+}
+
+// NewRendezvousRing returns an empty rendezvous ring
+func NewRendezvousRing(hasher Hasher) *RendezvousRing {
+	if hasher == nil {
+		hasher = DefaultHasher()
+	}
+	return &RendezvousRing{
+		hasher:  hasher,
+		members: make(map[string]*CNode),
+	}
+}
+
+// score returns the weighted score of member for key
+func (r *RendezvousRing) score(member *CNode, key string) float64 {
+	hash := r.hasher.Hash(member.Key + "#" + key)
+	// Map the hash into (0, 1) so that the logarithm is finite
+	unit := (float64(hash>>11) + 0.5) / float64(uint64(1)<<53)
+	return -float64(member.Weight) / math.Log(unit)
+}
+
+// Add adds a member
+func (r *RendezvousRing) Add(key string, weight int, meta map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.members[key]; exist {
+		return false
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	r.members[key] = newMember(r.hasher, key, weight, meta)
+	return true
+}
+
+// Remove removes a member
+func (r *RendezvousRing) Remove(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exist := r.members[key]; !exist {
+		return false
+	}
+	delete(r.members, key)
+	return true
+}
+
+// Lookup returns the member with the highest score for key
+func (r *RendezvousRing) Lookup(key string) *CNode {
+	nodes := r.LookupN(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// LookupN returns the n members with the highest
+// scores for key
+func (r *RendezvousRing) LookupN(key string, n int) []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.members) == 0 || n <= 0 {
+		return nil
+	}
+
+	members := sortMembers(r.members)
+	scores := make(map[string]float64, len(members))
+	for _, member := range members {
+		scores[member.Key] = r.score(member, key)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return scores[members[i].Key] > scores[members[j].Key]
+	})
+	if n < len(members) {
+		members = members[:n]
+	}
+	return members
+}
+
+// Members returns the members sorted by key
+func (r *RendezvousRing) Members() []*CNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortMembers(r.members)
+}
@@ -0,0 +1,194 @@
+package consistent
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Ring is a placement algorithm mapping keys onto the
+// physical members of a cluster. The loadbalancer places with
+// the one it is configured with, see Place
+type Ring interface {
+	// Add adds a member with the given weight and metadata,
+	// it returns false if the member already exists
+	Add(key string, weight int, meta map[string]string) bool
+	// Remove removes a member, it returns false if the
+	// member does not exist
+	Remove(key string) bool
+	// Lookup returns the member owning key
+	Lookup(key string) *CNode
+	// LookupN returns up to n distinct members for key,
+	// starting with its owner
+	LookupN(key string, n int) []*CNode
+	// Members returns all members sorted by key
+	Members() []*CNode
+}
+
+// Names of the placement algorithms
+const (
+	AlgoRing       = "ring"
+	AlgoJump       = "jump"
+	AlgoMaglev     = "maglev"
+	AlgoRendezvous = "rendezvous"
+)
+
+// NewAlgorithm returns an empty ring of the placement
+// algorithm registered under name
+func NewAlgorithm(name string, hasher Hasher) (Ring, error) {
+	switch name {
+	case AlgoRing:
+		return NewRing(hasher), nil
+	case AlgoJump:
+		return NewJumpRing(hasher), nil
+	case AlgoMaglev:
+		return NewMaglevRing(hasher, MaglevTableSize), nil
+	case AlgoRendezvous:
+		return NewRendezvousRing(hasher), nil
+	}
+	return nil, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// Place returns a ring of the algorithm registered under name
+// holding members, added in the order given. Processes building
+// it from the same members place every key alike, whatever
+// changes brought the members there
+func Place(name string, hasher Hasher, members []*CNode) (Ring, error) {
+	ring, err := NewAlgorithm(name, hasher)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		ring.Add(member.Key, member.Weight, member.Meta)
+	}
+	return ring, nil
+}
+
+// newMember returns the record of a physical member for
+// the algorithms without virtual nodes
+func newMember(hasher Hasher, key string, weight int, meta map[string]string) *CNode {
+	hash := hasher.Hash(key)
+	return &CNode{
+		Key:       key,
+		ParentKey: key,
+		Weight:    weight,
+		Parent:    hash,
+		Hash:      hash,
+		Meta:      meta,
+	}
+}
+
+// sortMembers returns the members of the map sorted by key
+func sortMembers(members map[string]*CNode) []*CNode {
+	sorted := make([]*CNode, 0, len(members))
+	for _, member := range members {
+		sorted = append(sorted, member)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// Add adds a member with weight virtual nodes into the ring
+func (r *CRing) Add(key string, weight int, meta map[string]string) bool {
+	return r.AddNode(key, weight, meta)
+}
+
+// Remove removes a member and all its virtual nodes
+func (r *CRing) Remove(key string) bool {
+	return r.RemoveNode(key)
+}
+
+// Lookup returns the member owning the virtual node
+// after the key hash
+func (r *CRing) Lookup(key string) *CNode {
+	nodes := r.LookupN(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// LookupN returns the first n distinct members clockwise
+// from the key hash
+func (r *CRing) LookupN(key string, n int) []*CNode {
+	s := r.load()
+	nodes := s.distinct(s.search(r.GenHash(key), true), n, "")
+	for walk, node := range nodes {
+		if parent, exist := s.parents[node.ParentKey]; exist {
+			nodes[walk] = parent
+		}
+	}
+	return nodes
+}
+
+// GetNextN returns the first n nodes clockwise from the key
+// hash that belong to distinct members
+func (r *CRing) GetNextN(key string, n int) []*CNode {
+	s := r.load()
+	return s.distinct(s.search(r.GenHash(key), true), n, "")
+}
+
+// GetNextParents returns the first n nodes after node that belong
+// to distinct members other than the member of node
+func (r *CRing) GetNextParents(node *CNode, n int) []*CNode {
+	s := r.load()
+	return s.distinct(s.search(node.Hash, false), n, node.ParentKey)
+}
+
+// Replicas returns the replicas of every node of the ring, keyed by
+// node, as GetNextParents picks them. Comparing the replicas before
+// and after a change tells which members have to move copies
+func (r *CRing) Replicas(n int) map[string][]*CNode {
+	s := r.load()
+	replicas := make(map[string][]*CNode, s.nodes.Len())
+	for _, node := range s.nodes {
+		replicas[node.Key] = s.distinct(s.search(node.Hash, false), n, node.ParentKey)
+	}
+	return replicas
+}
+
+// distinct walks the ring clockwise from index start and returns
+// up to n nodes of distinct members, skipping the member skip
+func (s *ringState) distinct(start int, n int, skip string) []*CNode {
+	size := s.nodes.Len()
+	if size == 0 || n <= 0 {
+		return nil
+	}
+
+	// Failure domains can only be honoured by looking at
+	// every member, otherwise the first n are enough
+	limit := n
+	if s.labelled {
+		limit = size
+	}
+
+	var nodes []*CNode
+	seen := make(map[string]bool)
+	if skip != "" {
+		seen[skip] = true
+	}
+	walk := start % size
+	for steps := 0; steps < size && len(nodes) < limit; steps++ {
+		curr := s.nodes[walk]
+		if !seen[curr.ParentKey] {
+			seen[curr.ParentKey] = true
+			nodes = append(nodes, curr)
+		}
+		walk = (walk + 1) % size
+	}
+
+	if s.labelled {
+		var chosen []*CNode
+		if origin, exist := s.parents[skip]; exist {
+			chosen = append(chosen, origin)
+		}
+		nodes = spread(nodes, chosen, n)
+	}
+	return nodes
+}
+
+// Members returns the physical members of the ring
+func (r *CRing) Members() []*CNode {
+	return sortMembers(r.load().parents)
+}
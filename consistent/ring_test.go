@@ -0,0 +1,205 @@
+package consistent
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// algorithms are the placement algorithms other than the ring
+var algorithms = []string{AlgoJump, AlgoMaglev, AlgoRendezvous}
+
+// newAlgorithm returns a ring of algorithm holding the members
+// m0 up to m(len(weights)-1) with their weights
+func newAlgorithm(t *testing.T, algorithm string, weights ...int) Ring {
+	t.Helper()
+	ring, err := NewAlgorithm(algorithm, xxHasher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for walk, weight := range weights {
+		ring.Add("m"+strconv.Itoa(walk), weight, map[string]string{"addr": strconv.Itoa(walk)})
+	}
+	return ring
+}
+
+// owners returns the owner of key-0 up to key-(keys-1)
+func owners(ring Ring, keys int) []string {
+	owners := make([]string, keys)
+	for walk := range owners {
+		owners[walk] = ring.Lookup("key-" + strconv.Itoa(walk)).Key
+	}
+	return owners
+}
+
+func TestAlgorithmAddRemove(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			ring := newAlgorithm(t, algorithm)
+			if ring.Lookup("k") != nil || ring.LookupN("k", 2) != nil {
+				t.Fatal("empty ring placed a key")
+			}
+			tests := []struct {
+				name string
+				op   func() bool
+				want bool
+				size int
+			}{
+				{"add", func() bool { return ring.Add("b", 2, nil) }, true, 1},
+				{"add another", func() bool { return ring.Add("a", 1, nil) }, true, 2},
+				{"add again", func() bool { return ring.Add("a", 3, nil) }, false, 2},
+				{"add without weight", func() bool { return ring.Add("c", 0, nil) }, true, 3},
+				{"remove", func() bool { return ring.Remove("c") }, true, 2},
+				{"remove again", func() bool { return ring.Remove("c") }, false, 2},
+				{"remove unknown", func() bool { return ring.Remove("z") }, false, 2},
+			}
+			for _, tt := range tests {
+				if got := tt.op(); got != tt.want {
+					t.Fatalf("%s returned %v", tt.name, got)
+				}
+				if size := len(ring.Members()); size != tt.size {
+					t.Fatalf("%s left %d members, want %d", tt.name, size, tt.size)
+				}
+			}
+
+			members := ring.Members()
+			if members[0].Key != "a" || members[1].Key != "b" || members[0].Weight != 1 || members[1].Weight != 2 {
+				t.Fatalf("members %+v %+v", members[0], members[1])
+			}
+			for walk := 0; walk < 100; walk++ {
+				key := "key-" + strconv.Itoa(walk)
+				if owner := ring.Lookup(key); owner == nil || owner.ParentKey != owner.Key {
+					t.Fatalf("%s placed on %+v", key, owner)
+				}
+			}
+		})
+	}
+}
+
+func TestAlgorithmLookupN(t *testing.T) {
+	for _, algorithm := range algorithms {
+		ring := newAlgorithm(t, algorithm, 1, 2, 3, 1, 2)
+		tests := []struct {
+			n    int
+			want int
+		}{
+			{-1, 0},
+			{0, 0},
+			{1, 1},
+			{3, 3},
+			{5, 5},
+			{8, 5}, // never more than the members
+		}
+		for _, tt := range tests {
+			for walk := 0; walk < 200; walk++ {
+				key := "key-" + strconv.Itoa(walk)
+				nodes := ring.LookupN(key, tt.n)
+				if len(nodes) != tt.want {
+					t.Fatalf("%s: LookupN(%s, %d) returned %d members, want %d", algorithm, key, tt.n, len(nodes), tt.want)
+				}
+				seen := make(map[string]bool)
+				for _, node := range nodes {
+					if seen[node.Key] {
+						t.Fatalf("%s: LookupN(%s, %d) returned %s twice", algorithm, key, tt.n, node.Key)
+					}
+					seen[node.Key] = true
+				}
+				if tt.want > 0 && nodes[0].Key != ring.Lookup(key).Key {
+					t.Fatalf("%s: LookupN(%s, %d) starts with %s, not the owner", algorithm, key, tt.n, nodes[0].Key)
+				}
+				if tt.want > 0 && nodes[0].Meta["addr"] != nodes[0].Key[1:] {
+					t.Fatalf("%s: %s lost its metadata", algorithm, nodes[0].Key)
+				}
+			}
+		}
+	}
+}
+
+func TestAlgorithmWeights(t *testing.T) {
+	const keys = 30000
+	weights := []int{1, 2, 3, 4}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			ring := newAlgorithm(t, algorithm, weights...)
+			counts := make(map[string]int)
+			for _, owner := range owners(ring, keys) {
+				counts[owner]++
+			}
+			for walk, weight := range weights {
+				member := "m" + strconv.Itoa(walk)
+				share := float64(counts[member]) / keys
+				want := float64(weight) / 10
+				if math.Abs(share-want) > 0.25*want {
+					t.Errorf("%s of weight %d owns %.3f of the keys, want about %.3f", member, weight, share, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAlgorithmPlace(t *testing.T) {
+	for _, algorithm := range algorithms {
+		built := newAlgorithm(t, algorithm, 2, 2, 2)
+		placed, err := Place(algorithm, xxHasher{}, built.Members())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := owners(built, 1000), owners(placed, 1000)
+		for walk := range a {
+			if a[walk] != b[walk] {
+				t.Fatalf("%s: key-%d on %s, placed again on %s", algorithm, walk, a[walk], b[walk])
+			}
+		}
+	}
+	if _, err := Place("modulo", nil, nil); err == nil {
+		t.Fatal("unknown algorithm placed keys")
+	}
+}
+
+// TestAlgorithmRemove removes the first of 11 members of equal
+// weight, which owns about 9% of the keys. Jump hash moves the
+// trailing buckets into the place of the member, so about twice
+// as many keys change owner
+func TestAlgorithmRemove(t *testing.T) {
+	const keys, members = 20000, 11
+	tests := []struct {
+		algorithm    string
+		others       float64 // share of keys of other members moved at most
+		moved, slack float64 // keys moved and the tolerance
+	}{
+		{AlgoJump, 0.10, 0.17, 0.03},
+		{AlgoMaglev, 0.03, 0.10, 0.03},
+		{AlgoRendezvous, 0, 0.09, 0.02},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			weights := make([]int, members)
+			for walk := range weights {
+				weights[walk] = 10
+			}
+			ring := newAlgorithm(t, tt.algorithm, weights...)
+			before := owners(ring, keys)
+			ring.Remove("m0")
+			after := owners(ring, keys)
+
+			moved, others := 0, 0
+			for walk := range before {
+				if after[walk] == "m0" {
+					t.Fatalf("key-%d still on the removed member", walk)
+				}
+				if before[walk] != after[walk] {
+					moved++
+					if before[walk] != "m0" {
+						others++
+					}
+				}
+			}
+			if share := float64(moved) / keys; math.Abs(share-tt.moved) > tt.slack {
+				t.Errorf("%.3f of the keys moved, want %.2f", share, tt.moved)
+			}
+			if share := float64(others) / keys; share > tt.others {
+				t.Errorf("%.3f of the keys of other members moved, at most %.2f", share, tt.others)
+			}
+		})
+	}
+}
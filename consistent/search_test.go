@@ -0,0 +1,127 @@
+package consistent
+
+import (
+	"strconv"
+	"testing"
+)
+
+// The scans below are the lookups of the ring before they were
+// rebuilt on binary search, kept as reference and baseline
+
+// scanNext walks the ring up to the first node at hash or after
+func scanNext(s *ringState, hash uint64) *CNode {
+	for _, node := range s.nodes {
+		if node.Hash >= hash {
+			return node
+		}
+	}
+	return s.nodes[0]
+}
+
+// scanNextParent walks the ring from node up to the first node
+// of another parent
+func scanNextParent(s *ringState, node *CNode) *CNode {
+	size := s.nodes.Len()
+	start := 0
+	for start < size && s.nodes[start].Hash <= node.Hash {
+		start++
+	}
+	for steps := 0; steps < size; steps++ {
+		curr := s.nodes[(start+steps)%size]
+		if curr.Parent != node.Parent {
+			return curr
+		}
+	}
+	return nil
+}
+
+// scanPrevParent walks the ring back from node down to the first
+// node of another parent
+func scanPrevParent(s *ringState, node *CNode) *CNode {
+	size := s.nodes.Len()
+	start := size - 1
+	for start >= 0 && s.nodes[start].Hash >= node.Hash {
+		start--
+	}
+	for steps := 0; steps < size; steps++ {
+		curr := s.nodes[((start-steps)%size+size)%size]
+		if curr.Parent != node.Parent {
+			return curr
+		}
+	}
+	return nil
+}
+
+// newLargeRing returns a ring of members with weight virtual nodes
+// each and the keys of lookups spread over it
+func newLargeRing(members, weight, keys int) (*CRing, []string) {
+	r := NewRing(nil)
+	for walk := 0; walk < members; walk++ {
+		r.AddNode("node"+strconv.Itoa(walk), weight, nil)
+	}
+	lookups := make([]string, keys)
+	for walk := range lookups {
+		lookups[walk] = "user" + strconv.Itoa(walk)
+	}
+	return r, lookups
+}
+
+func TestSearchMatchesScan(t *testing.T) {
+	r, keys := newLargeRing(20, 50, 2000)
+	s := r.load()
+	for _, key := range keys {
+		if got, want := r.GetNext(key), scanNext(s, r.GenHash(key)); got != want {
+			t.Fatalf("GetNext(%s) is %s, the scan finds %s", key, got.Key, want.Key)
+		}
+	}
+	for _, node := range s.nodes {
+		if got, want := r.GetNextParent(node), scanNextParent(s, node); got != want {
+			t.Fatalf("GetNextParent(%s) is %s, the scan finds %s", node.Key, got.Key, want.Key)
+		}
+		if got, want := r.GetPrevParent(node), scanPrevParent(s, node); got != want {
+			t.Fatalf("GetPrevParent(%s) is %s, the scan finds %s", node.Key, got.Key, want.Key)
+		}
+	}
+}
+
+// BenchmarkLookup compares the lookups of a ring of 100 members of
+// 128 virtual nodes, 12800 in all, with the scans they replaced
+func BenchmarkLookup(b *testing.B) {
+	r, keys := newLargeRing(100, 128, 1024)
+	s := r.load()
+	nodes := make([]*CNode, len(keys))
+	for walk, key := range keys {
+		nodes[walk] = r.GetNext(key)
+	}
+
+	b.Run("GetNext/search", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			r.GetNext(keys[walk%len(keys)])
+		}
+	})
+	b.Run("GetNext/scan", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			scanNext(s, r.GenHash(keys[walk%len(keys)]))
+		}
+	})
+	b.Run("GetNextParent/search", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			r.GetNextParent(nodes[walk%len(nodes)])
+		}
+	})
+	b.Run("GetNextParent/scan", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			scanNextParent(s, nodes[walk%len(nodes)])
+		}
+	})
+	b.Run("GetPrevParent/search", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			r.GetPrevParent(nodes[walk%len(nodes)])
+		}
+	})
+	b.Run("GetPrevParent/scan", func(b *testing.B) {
+		for walk := 0; walk < b.N; walk++ {
+			scanPrevParent(s, nodes[walk%len(nodes)])
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package consistent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Formats of an encoded snapshot
+const (
+	FormatJSON   = "json"
+	FormatBinary = "binary"
+)
+
+// snapshotMagic starts every snapshot in the binary
+// format, its last byte is the version of the format
+var snapshotMagic = []byte{'C', 'R', 'S', 1}
+
+// ErrSnapshot is returned when a snapshot cannot be decoded
+var ErrSnapshot = errors.New("malformed ring snapshot")
+
+// Snapshot is a complete copy of a ring, precise enough to
+// restore it without hashing the keys again
+type Snapshot struct {
+	Epoch   uint64           `json:"epoch"`
+	Hasher  string           `json:"hasher"`
+	Members []SnapshotMember `json:"members"`
+}
+
+// SnapshotMember is a member of the ring and its nodes on the
+// ring, sorted by hash. The member itself is one of them
+type SnapshotMember struct {
+	Key       string            `json:"key"`
+	ParentKey string            `json:"parent"`
+	Weight    int               `json:"weight"`
+	Hash      uint64            `json:"hash"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Nodes     []SnapshotNode    `json:"nodes"`
+}
+
+// SnapshotNode is a node of a member on the ring
+type SnapshotNode struct {
+	Key  string `json:"key"`
+	Hash uint64 `json:"hash"`
+}
+
+// Snapshot returns a copy of the ring with its members
+// sorted by key
+func (r *CRing) Snapshot() *Snapshot {
+	s := r.load()
+	snap := &Snapshot{
+		Epoch:  s.epoch,
+		Hasher: r.HasherName(),
+	}
+	byParent := make(map[uint64][]SnapshotNode)
+	for _, node := range s.nodes {
+		byParent[node.Parent] = append(byParent[node.Parent], SnapshotNode{
+			Key:  node.Key,
+			Hash: node.Hash,
+		})
+	}
+	for _, parent := range sortMembers(s.parents) {
+		snap.Members = append(snap.Members, SnapshotMember{
+			Key:       parent.Key,
+			ParentKey: parent.ParentKey,
+			Weight:    parent.Weight,
+			Hash:      parent.Hash,
+			Meta:      parent.Meta,
+			Nodes:     byParent[parent.Hash],
+		})
+	}
+	return snap
+}
+
+// Restore replaces the members and the epoch of the ring with
+// the ones of snap. It fails if snap was taken with another
+// hasher or its hashes do not match the keys
+func (r *CRing) Restore(snap *Snapshot) error {
+	if snap.Hasher != "" && snap.Hasher != r.HasherName() {
+		return fmt.Errorf("snapshot uses hasher %s instead of %s", snap.Hasher, r.HasherName())
+	}
+
+	s := &ringState{
+		parents: make(map[string]*CNode, len(snap.Members)),
+		epoch:   snap.Epoch,
+	}
+	for _, member := range snap.Members {
+		if _, exist := s.parents[member.Key]; exist {
+			return fmt.Errorf("member %s appears twice in snapshot", member.Key)
+		}
+		if r.GenHash(member.Key) != member.Hash {
+			return fmt.Errorf("hash of member %s does not match snapshot", member.Key)
+		}
+		parent := &CNode{
+			Meta:      member.Meta,
+			ParentKey: member.ParentKey,
+			Key:       member.Key,
+			Parent:    member.Hash,
+			Hash:      member.Hash,
+			Weight:    member.Weight,
+		}
+		s.parents[member.Key] = parent
+		for _, node := range member.Nodes {
+			if r.GenHash(node.Key) != node.Hash {
+				return fmt.Errorf("hash of node %s does not match snapshot", node.Key)
+			}
+			if node.Key == member.Key {
+				s.nodes = append(s.nodes, parent)
+				continue
+			}
+			s.nodes = append(s.nodes, &CNode{
+				Meta:      member.Meta,
+				ParentKey: member.ParentKey,
+				Key:       node.Key,
+				Parent:    member.Hash,
+				Hash:      node.Hash,
+				Weight:    member.Weight,
+			})
+		}
+	}
+	sort.Sort(s.nodes)
+	s.reindex()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Store(s)
+	return nil
+}
+
+// Encode encodes the snapshot in format
+func (snap *Snapshot) Encode(format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(snap, "", "  ")
+	case FormatBinary:
+		return snap.MarshalBinary()
+	}
+	return nil, fmt.Errorf("unknown snapshot format %q", format)
+}
+
+// DecodeSnapshot decodes a snapshot encoded in format
+func DecodeSnapshot(format string, data []byte) (*Snapshot, error) {
+	snap := &Snapshot{}
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, err
+		}
+	case FormatBinary:
+		if err := snap.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %q", format)
+	}
+	return snap, nil
+}
+
+// MarshalBinary encodes the snapshot in the binary format.
+// Integers are varints, hashes take 8 bytes and strings are
+// prefixed with their length
+func (snap *Snapshot) MarshalBinary() ([]byte, error) {
+	w := snapshotWriter{}
+	w.buf.Write(snapshotMagic)
+	w.uvarint(snap.Epoch)
+	w.string(snap.Hasher)
+	w.uvarint(uint64(len(snap.Members)))
+	for _, member := range snap.Members {
+		w.string(member.Key)
+		w.string(member.ParentKey)
+		w.uvarint(uint64(member.Weight))
+		w.hash(member.Hash)
+
+		keys := make([]string, 0, len(member.Meta))
+		for key := range member.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		w.uvarint(uint64(len(keys)))
+		for _, key := range keys {
+			w.string(key)
+			w.string(member.Meta[key])
+		}
+
+		w.uvarint(uint64(len(member.Nodes)))
+		for _, node := range member.Nodes {
+			w.string(node.Key)
+			w.hash(node.Hash)
+		}
+	}
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a snapshot in the binary format
+func (snap *Snapshot) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return ErrSnapshot
+	}
+	rd := snapshotReader{r: bytes.NewReader(data[len(snapshotMagic):])}
+	decoded := Snapshot{
+		Epoch:  rd.uvarint(),
+		Hasher: rd.string(),
+	}
+	members := rd.count()
+	for walk := 0; walk < members && rd.err == nil; walk++ {
+		member := SnapshotMember{
+			Key:       rd.string(),
+			ParentKey: rd.string(),
+			Weight:    int(rd.uvarint()),
+			Hash:      rd.hash(),
+		}
+		if metas := rd.count(); metas > 0 {
+			member.Meta = make(map[string]string, metas)
+			for meta := 0; meta < metas && rd.err == nil; meta++ {
+				key := rd.string()
+				member.Meta[key] = rd.string()
+			}
+		}
+		nodes := rd.count()
+		for node := 0; node < nodes && rd.err == nil; node++ {
+			member.Nodes = append(member.Nodes, SnapshotNode{
+				Key:  rd.string(),
+				Hash: rd.hash(),
+			})
+		}
+		decoded.Members = append(decoded.Members, member)
+	}
+	if rd.err != nil {
+		return rd.err
+	}
+	*snap = decoded
+	return nil
+}
+
+// snapshotWriter appends the fields of a binary snapshot
+type snapshotWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func (w *snapshotWriter) hash(v uint64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	w.buf.Write(tmp[:])
+}
+
+func (w *snapshotWriter) string(v string) {
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+// snapshotReader reads the fields of a binary snapshot, it
+// keeps the first error and returns zero values after it
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (rd *snapshotReader) uvarint() uint64 {
+	if rd.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(rd.r)
+	if err != nil {
+		rd.err = ErrSnapshot
+	}
+	return v
+}
+
+// count reads a number of items, each taking at least
+// a byte, so that it is bounded by the remaining data
+func (rd *snapshotReader) count() int {
+	v := rd.uvarint()
+	if v > uint64(rd.r.Len()) {
+		rd.err = ErrSnapshot
+		return 0
+	}
+	return int(v)
+}
+
+func (rd *snapshotReader) hash() uint64 {
+	var tmp [8]byte
+	if rd.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(rd.r, tmp[:]); err != nil {
+		rd.err = ErrSnapshot
+		return 0
+	}
+	return binary.BigEndian.Uint64(tmp[:])
+}
+
+func (rd *snapshotReader) string() string {
+	size := rd.count()
+	if rd.err != nil {
+		return ""
+	}
+	tmp := make([]byte, size)
+	if _, err := io.ReadFull(rd.r, tmp); err != nil {
+		rd.err = ErrSnapshot
+		return ""
+	}
+	return string(tmp)
+}
@@ -0,0 +1,128 @@
+package consistent
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// newSnapshotRing returns a ring of members with distinct weights,
+// labels on some of them and an epoch past a few changes
+func newSnapshotRing() *CRing {
+	r := NewRing(nil)
+	r.AddNode("n0", 3, map[string]string{MetaZone: "z1", "addr": "10.0.0.1:5555"})
+	r.AddNode("n1", 5, map[string]string{MetaZone: "z2"})
+	r.AddNode("n2", 1, nil)
+	r.AddNode("n3", 2, nil)
+	r.RemoveNode("n3")
+	return r
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	r := newSnapshotRing()
+	snap := r.Snapshot()
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			data, err := snap.Encode(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodeSnapshot(format, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, snap) {
+				t.Fatalf("decoded %+v, want %+v", decoded, snap)
+			}
+
+			restored := NewRing(nil)
+			if err := restored.Restore(decoded); err != nil {
+				t.Fatal(err)
+			}
+			if restored.Epoch() != r.Epoch() || restored.Size() != r.Size() {
+				t.Fatalf("restored epoch %d and %d members, want %d and %d",
+					restored.Epoch(), restored.Size(), r.Epoch(), r.Size())
+			}
+			if again := restored.Snapshot(); !reflect.DeepEqual(again, snap) {
+				t.Fatalf("restored ring snapshots to %+v, want %+v", again, snap)
+			}
+			for walk := 0; walk < 1000; walk++ {
+				key := "user-" + strconv.Itoa(walk)
+				if got, want := restored.GetNext(key), r.GetNext(key); got.Key != want.Key {
+					t.Fatalf("%s owned by %s after a restore, %s before", key, got.Key, want.Key)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+	snap := newSnapshotRing().Snapshot()
+	for _, format := range []string{FormatJSON, FormatBinary} {
+		data, err := snap.Encode(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for size := 0; size < len(data); size++ {
+			if _, err := DecodeSnapshot(format, data[:size]); err == nil {
+				t.Fatalf("%s snapshot cut at %d of %d bytes decoded", format, size, len(data))
+			} else if format == FormatBinary && !errors.Is(err, ErrSnapshot) {
+				t.Fatalf("binary snapshot cut at %d bytes: %v", size, err)
+			}
+		}
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	r := newSnapshotRing()
+	data, err := r.Snapshot().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the encoding itself
+	wrongMagic := append([]byte("XRS\x01"), data[len(snapshotMagic):]...)
+	newerVersion := append([]byte("CRS\x02"), data[len(snapshotMagic):]...)
+	hugeCount := append(append([]byte(nil), snapshotMagic...), 0xff, 0xff, 0xff, 0xff, 0x0f)
+	for name, data := range map[string][]byte{
+		"wrong magic":   wrongMagic,
+		"newer version": newerVersion,
+		"huge count":    hugeCount,
+	} {
+		if _, err := DecodeSnapshot(FormatBinary, data); !errors.Is(err, ErrSnapshot) {
+			t.Errorf("%s: decoded with %v", name, err)
+		}
+	}
+	if _, err := DecodeSnapshot(FormatJSON, []byte(`{"epoch": "one"}`)); err == nil {
+		t.Error("JSON snapshot of the wrong type decoded")
+	}
+	if _, err := DecodeSnapshot("yaml", data); err == nil {
+		t.Error("unknown format decoded")
+	}
+
+	// Snapshots that decode but do not describe the ring
+	tests := []struct {
+		name   string
+		damage func(snap *Snapshot)
+	}{
+		{"other hasher", func(snap *Snapshot) { snap.Hasher = XXHash }},
+		{"member hash", func(snap *Snapshot) { snap.Members[0].Hash++ }},
+		{"node hash", func(snap *Snapshot) { snap.Members[1].Nodes[1].Hash ^= 1 << 63 }},
+		{"duplicate member", func(snap *Snapshot) { snap.Members[2] = snap.Members[0] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap := r.Snapshot()
+			tt.damage(snap)
+			restored := NewRing(nil)
+			restored.AddNode("kept", 1, nil)
+			if err := restored.Restore(snap); err == nil {
+				t.Fatal("damaged snapshot restored")
+			}
+			if restored.Member("kept") == nil || restored.Size() != 1 {
+				t.Fatal("failed restore changed the ring")
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package gossip
+
+import (
+	"conhash/transport"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Well known metadata of the members of a conhash cluster
+const (
+	MetaRole   = "role"
+	MetaWeight = "weight"
+	MetaHasher = "hasher"
+	RoleNode   = "node"
+	RoleLB     = "lb"
+)
+
+// Default settings of a memberlist
+const (
+	defaultInterval       = time.Second
+	defaultIndirectChecks = 3
+	defaultSuspectPeriods = 5
+	defaultRetransmit     = 4
+	defaultSyncEvery      = 10
+	maxPiggyback          = 16 // updates carried by one message
+)
+
+// State of a member
+type State int
+
+// States of a member, a later state overrides an earlier
+// one of the same incarnation
+const (
+	Alive State = iota
+	Suspect
+	Dead
+	Left
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Member is the view of one member of the cluster. Only the member
+// itself raises its incarnation, to refute a suspicion or to
+// announce new metadata
+type Member struct {
+	Name        string            `protobuf:"1"`
+	Addrs       []string          `protobuf:"2"` // RPC addresses, the advertised one first
+	Meta        map[string]string `protobuf:"3"`
+	Incarnation uint64            `protobuf:"4"`
+	State       State             `protobuf:"5"`
+}
+
+// Config contains the settings of a memberlist
+type Config struct {
+	Name  string
+	Addrs []string
+	Meta  map[string]string
+	// Interval is the protocol period, one member is probed every
+	// period. It defaults to a second
+	Interval       time.Duration
+	Timeout        time.Duration // time a direct ping may take, Interval/3 if 0
+	IndirectChecks int           // members asked to ping a silent member, 3 if 0
+	SuspectTimeout time.Duration // time before a suspect is declared dead, 5 periods if 0
+	Retransmit     int           // an update is sent Retransmit*log(members) times, 4 if 0
+	SyncEvery      int           // periods between two full syncs with a random member, 10 if 0
+	// Notify is called in order with every change of another
+	// member, never concurrently
+	Notify func(Member)
+	// Transport carries the gossip, net/rpc if nil
+	Transport transport.Transport
+	Logger    *slog.Logger // receives the diagnostics, slog.Default() if nil
+}
+
+// Memberlist runs the SWIM membership protocol. Members probe each
+// other over the RPC servers they already run, suspect the members
+// that do not answer a direct nor an indirect ping and declare them
+// dead unless they refute the suspicion in time. Changes spread by
+// piggybacking on the probes
+type Memberlist struct {
+	mu        sync.Mutex
+	config    Config
+	members   map[string]*Member
+	suspected map[string]time.Time
+	probes    []string // names left to probe in this round
+	queue     []*broadcast
+	events    []Member // changes not yet notified
+	wake      chan struct{}
+	pool      *transport.Pool
+	done      chan struct{}
+	stop      sync.Once
+}
+
+// broadcast is an update piggybacked on messages
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// New returns the memberlist of a cluster only
+// made of the local member
+func New(config Config) *Memberlist {
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+	if config.Timeout <= 0 || config.Timeout >= config.Interval {
+		config.Timeout = config.Interval / 3
+	}
+	if config.IndirectChecks <= 0 {
+		config.IndirectChecks = defaultIndirectChecks
+	}
+	if config.SuspectTimeout <= 0 {
+		config.SuspectTimeout = defaultSuspectPeriods * config.Interval
+	}
+	if config.Retransmit <= 0 {
+		config.Retransmit = defaultRetransmit
+	}
+	if config.SyncEvery <= 0 {
+		config.SyncEvery = defaultSyncEvery
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	m := &Memberlist{
+		config:    config,
+		members:   make(map[string]*Member),
+		suspected: make(map[string]time.Time),
+		wake:      make(chan struct{}, 1),
+		pool:      transport.NewPoolWith(config.Transport),
+		done:      make(chan struct{}),
+	}
+	m.members[config.Name] = &Member{
+		Name:  config.Name,
+		Addrs: config.Addrs,
+		Meta:  copyMeta(config.Meta),
+		State: Alive,
+	}
+	return m
+}
+
+// Register serves the gossip of the memberlist on server
+func (m *Memberlist) Register(server transport.Server) error {
+	return server.RegisterName("Gossip", &Service{m: m})
+}
+
+// Start starts probing the members and notifying changes
+func (m *Memberlist) Start() {
+	go m.run()
+	go m.deliver()
+}
+
+// Join syncs the full state with the first of the seeds that
+// answers. Seeds are RPC addresses of any member of the cluster
+func (m *Memberlist) Join(seeds []string) error {
+	err := errors.New("no seed to join")
+	for _, seed := range seeds {
+		if contains(m.config.Addrs, seed) {
+			continue
+		}
+		if err = m.sync([]string{seed}); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Leave announces that the local member leaves and stops
+// the memberlist
+func (m *Memberlist) Leave() {
+	m.mu.Lock()
+	self := m.members[m.config.Name]
+	self.State = Left
+	self.Incarnation++
+	m.enqueue(*self)
+	m.mu.Unlock()
+
+	// Tell a few members right away since probing stops
+	for _, member := range m.random(m.config.IndirectChecks, "") {
+		m.ping(member)
+	}
+	m.Stop()
+}
+
+// Stop stops the memberlist without telling the others
+func (m *Memberlist) Stop() {
+	m.stop.Do(func() {
+		close(m.done)
+		m.pool.Close()
+	})
+}
+
+// SetMeta announces new metadata of the local member
+func (m *Memberlist) SetMeta(meta map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	self := m.members[m.config.Name]
+	self.Meta = copyMeta(meta)
+	self.Incarnation++
+	m.enqueue(*self)
+}
+
+// Members returns every known member sorted by name,
+// including the local one and the dead
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot()
+}
+
+func (m *Memberlist) snapshot() []Member {
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, copyMember(*member))
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+// run probes one member every protocol period
+func (m *Memberlist) run() {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for period := 1; ; period++ {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		m.probe()
+		m.expire()
+		if period%m.config.SyncEvery == 0 {
+			if peers := m.random(1, ""); len(peers) > 0 {
+				m.sync(peers[0].Addrs)
+			}
+		}
+	}
+}
+
+// probe pings the next member, then asks others to ping it,
+// and suspects it if nobody could reach it
+func (m *Memberlist) probe() {
+	target, ok := m.next()
+	if !ok || m.ping(target) || m.indirect(target) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if curr := m.members[target.Name]; curr != nil && curr.State == Alive {
+		suspect := copyMember(*curr)
+		suspect.State = Suspect
+		m.apply(suspect)
+	}
+}
+
+// next returns the member to probe, every member is probed
+// once per round in a random order
+func (m *Memberlist) next() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for refilled := false; ; {
+		for len(m.probes) > 0 {
+			name := m.probes[0]
+			m.probes = m.probes[1:]
+			if member := m.members[name]; member != nil && probeable(member) {
+				return copyMember(*member), true
+			}
+		}
+		if refilled {
+			return Member{}, false
+		}
+		refilled = true
+		for name, member := range m.members {
+			if name != m.config.Name && probeable(member) {
+				m.probes = append(m.probes, name)
+			}
+		}
+		rand.Shuffle(len(m.probes), func(i, j int) {
+			m.probes[i], m.probes[j] = m.probes[j], m.probes[i]
+		})
+	}
+}
+
+// ping sends a direct ping carrying the pending updates
+func (m *Memberlist) ping(target Member) bool {
+	args := PingArgs{
+		From:    m.config.Name,
+		Updates: m.piggyback(),
+	}
+	reply := PingReply{}
+	if err := m.pool.CallTimeout(target.Addrs, m.config.Timeout, "Gossip.Ping", &args, &reply); err != nil {
+		return false
+	}
+	m.merge(reply.Updates)
+	return true
+}
+
+// indirect asks other members to ping target and reports
+// whether any of them reached it
+func (m *Memberlist) indirect(target Member) bool {
+	helpers := m.random(m.config.IndirectChecks, target.Name)
+	results := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper Member) {
+			args := PingReqArgs{
+				From:    m.config.Name,
+				Target:  target.Name,
+				Addrs:   target.Addrs,
+				Updates: m.piggyback(),
+			}
+			reply := PingReply{}
+			timeout := m.config.Interval - m.config.Timeout
+			err := m.pool.CallTimeout(helper.Addrs, timeout, "Gossip.PingReq", &args, &reply)
+			if err == nil {
+				m.merge(reply.Updates)
+			}
+			results <- err == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
+// sync exchanges the full state with the member at addrs
+func (m *Memberlist) sync(addrs []string) error {
+	args := SyncArgs{
+		Members: m.Members(),
+	}
+	reply := SyncReply{}
+	if err := m.pool.CallTimeout(addrs, m.config.Interval, "Gossip.Sync", &args, &reply); err != nil {
+		return err
+	}
+	m.merge(reply.Members)
+	return nil
+}
+
+// expire declares dead the members suspected for too long
+func (m *Memberlist) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, since := range m.suspected {
+		curr := m.members[name]
+		if curr == nil || curr.State != Suspect {
+			delete(m.suspected, name)
+		} else if time.Since(since) >= m.config.SuspectTimeout {
+			dead := copyMember(*curr)
+			dead.State = Dead
+			m.apply(dead)
+		}
+	}
+}
+
+// random returns up to n random probeable members
+// other than the local one and skip
+func (m *Memberlist) random(n int, skip string) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var members []Member
+	for name, member := range m.members {
+		if name != m.config.Name && name != skip && member.State == Alive {
+			members = append(members, copyMember(*member))
+		}
+	}
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+	if len(members) > n {
+		members = members[:n]
+	}
+	return members
+}
+
+// merge applies the updates received from another member
+func (m *Memberlist) merge(updates []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range updates {
+		m.apply(update)
+	}
+}
+
+// apply records an update unless it is older than what is known.
+// An update suspecting the local member is refuted by raising its
+// incarnation. Must be called with mu held
+func (m *Memberlist) apply(update Member) {
+	if update.Name == m.config.Name {
+		self := m.members[m.config.Name]
+		stale := update.Incarnation < self.Incarnation ||
+			(update.Incarnation == self.Incarnation && update.State == Alive)
+		if self.State == Alive && !stale {
+			self.Incarnation = update.Incarnation + 1
+			m.config.Logger.Info("refuting rumour", "state", update.State.String(), "incarnation", self.Incarnation)
+			m.enqueue(*self)
+		}
+		return
+	}
+
+	curr, exist := m.members[update.Name]
+	if exist && !overrides(update, *curr) {
+		return
+	}
+	member := copyMember(update)
+	m.members[member.Name] = &member
+	if member.State == Suspect {
+		m.suspected[member.Name] = time.Now()
+	} else {
+		delete(m.suspected, member.Name)
+	}
+	m.enqueue(member)
+
+	if !exist || curr.State != member.State {
+		m.config.Logger.Info("member changed", "member", member.Name, "state", member.State.String())
+	}
+	// Members never seen alive are of no interest
+	if exist || member.State == Alive || member.State == Suspect {
+		m.events = append(m.events, copyMember(member))
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// overrides reports whether update is newer than curr
+func overrides(update Member, curr Member) bool {
+	switch update.State {
+	case Alive:
+		return update.Incarnation > curr.Incarnation
+	case Suspect:
+		return update.Incarnation > curr.Incarnation ||
+			(update.Incarnation == curr.Incarnation && curr.State == Alive)
+	}
+	// Dead and left members stay so within their incarnation
+	if curr.State == Dead || curr.State == Left {
+		return update.Incarnation > curr.Incarnation
+	}
+	return update.Incarnation >= curr.Incarnation
+}
+
+// enqueue schedules an update for dissemination, replacing
+// any older update of the same member
+func (m *Memberlist) enqueue(member Member) {
+	for walk, queued := range m.queue {
+		if queued.member.Name == member.Name {
+			m.queue = append(m.queue[:walk], m.queue[walk+1:]...)
+			break
+		}
+	}
+	m.queue = append(m.queue, &broadcast{member: copyMember(member)})
+}
+
+// piggyback returns the updates to carry on a message. Every
+// update is sent a number of times growing with the logarithm
+// of the cluster size, the least sent first
+func (m *Memberlist) piggyback() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := m.config.Retransmit * int(math.Ceil(math.Log2(float64(len(m.members)+1))))
+	sort.SliceStable(m.queue, func(i, j int) bool {
+		return m.queue[i].transmits < m.queue[j].transmits
+	})
+
+	var updates []Member
+	var queue []*broadcast
+	for _, queued := range m.queue {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, copyMember(queued.member))
+			queued.transmits++
+		}
+		if queued.transmits < limit {
+			queue = append(queue, queued)
+		}
+	}
+	m.queue = queue
+	return updates
+}
+
+// deliver calls Notify with the changes in order
+func (m *Memberlist) deliver() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.wake:
+		}
+		for {
+			m.mu.Lock()
+			events := m.events
+			m.events = nil
+			m.mu.Unlock()
+			if len(events) == 0 {
+				break
+			}
+			for _, event := range events {
+				if m.config.Notify != nil {
+					m.config.Notify(event)
+				}
+			}
+		}
+	}
+}
+
+// probeable reports whether a member takes part in probing
+func probeable(member *Member) bool {
+	return member.State == Alive || member.State == Suspect
+}
+
+func copyMember(member Member) Member {
+	member.Addrs = append([]string(nil), member.Addrs...)
+	member.Meta = copyMeta(member.Meta)
+	return member
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	copied := make(map[string]string, len(meta))
+	for key, value := range meta {
+		copied[key] = value
+	}
+	return copied
+}
+
+// contains reports whether values holds value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package gossip
+
+import (
+	"conhash/transport"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quiet discards the diagnostics of the members
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testInterval is the protocol period of the members of a test
+const testInterval = 50 * time.Millisecond
+
+// peer is a member of a test cluster with the changes
+// it was notified of
+type peer struct {
+	list     *Memberlist
+	listener *transport.Listener
+	mu       sync.Mutex
+	events   []Member
+}
+
+func (p *peer) notify(member Member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, member)
+}
+
+// states returns the states p was notified of for name, in order
+func (p *peer) states(name string) []State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var states []State
+	for _, event := range p.events {
+		if event.Name == name {
+			states = append(states, event.State)
+		}
+	}
+	return states
+}
+
+// member returns the view p has of name
+func (p *peer) member(name string) (Member, bool) {
+	for _, member := range p.list.Members() {
+		if member.Name == name {
+			return member, true
+		}
+	}
+	return Member{}, false
+}
+
+// stop stops p without telling the others, as a crash would
+func (p *peer) stop() {
+	p.list.Stop()
+	p.listener.Close()
+}
+
+// newPeers starts size members named m0 up to m(size-1) and joins
+// every one of them through m0
+func newPeers(t *testing.T, size int, suspect time.Duration) []*peer {
+	t.Helper()
+	var peers []*peer
+	for walk := 0; walk < size; walk++ {
+		listener, err := transport.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &peer{listener: listener}
+		p.list = New(Config{
+			Name:           "m" + strconv.Itoa(walk),
+			Addrs:          []string{listener.Addr().String()},
+			Meta:           map[string]string{MetaRole: RoleNode},
+			Interval:       testInterval,
+			SuspectTimeout: suspect,
+			Notify:         p.notify,
+			Logger:         quiet,
+		})
+		server := transport.NetRPC().NewServer()
+		p.list.Register(server)
+		go server.Serve(listener)
+		p.list.Start()
+		t.Cleanup(p.stop)
+		peers = append(peers, p)
+	}
+	for _, p := range peers[1:] {
+		if err := p.list.Join(peers[0].list.config.Addrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return peers
+}
+
+// eventually fails t unless cond holds within timeout
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(testInterval / 5)
+	}
+}
+
+func TestConvergence(t *testing.T) {
+	peers := newPeers(t, 5, 0)
+	for _, p := range peers {
+		p := p
+		eventually(t, 40*testInterval, func() bool {
+			alive := 0
+			for _, member := range p.list.Members() {
+				if member.State == Alive {
+					alive++
+				}
+			}
+			return alive == len(peers)
+		}, "%s knows %v", p.list.config.Name, p.list.Members())
+	}
+
+	// New metadata spreads through gossip alone
+	peers[4].list.SetMeta(map[string]string{MetaRole: RoleNode, MetaWeight: "4"})
+	for _, p := range peers {
+		p := p
+		eventually(t, 40*testInterval, func() bool {
+			member, _ := p.member("m4")
+			return member.Meta[MetaWeight] == "4" && member.Incarnation == 1
+		}, "%s did not learn the metadata of m4", p.list.config.Name)
+	}
+}
+
+func TestSuspicionTimeout(t *testing.T) {
+	const suspect = 10 * testInterval
+	peers := newPeers(t, 4, suspect)
+	eventually(t, 40*testInterval, func() bool {
+		member, _ := peers[0].member("m3")
+		return len(peers[0].list.Members()) == 4 && member.State == Alive
+	}, "m0 does not know m3")
+
+	crashed := time.Now()
+	peers[3].stop()
+	for _, p := range peers[:3] {
+		p := p
+		eventually(t, suspect+40*testInterval, func() bool {
+			member, _ := p.member("m3")
+			return member.State == Dead
+		}, "%s did not declare m3 dead", p.list.config.Name)
+	}
+	if elapsed := time.Since(crashed); elapsed < suspect {
+		t.Fatalf("m3 was declared dead after %v, before its suspicion timed out", elapsed)
+	}
+
+	// The member that timed the suspicion out saw it suspected first
+	for _, p := range peers[:3] {
+		states := p.states("m3")
+		if len(states) >= 2 && states[len(states)-2] == Suspect && states[len(states)-1] == Dead {
+			return
+		}
+	}
+	t.Fatal("no member suspected m3 before declaring it dead")
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	peers := newPeers(t, 3, 40*testInterval)
+	eventually(t, 40*testInterval, func() bool {
+		member, _ := peers[0].member("m2")
+		return member.State == Alive
+	}, "m0 does not know m2")
+
+	// A false rumour that m2 is suspect, as a lost ping would start
+	rumour, _ := peers[0].member("m2")
+	rumour.State = Suspect
+	peers[0].list.merge([]Member{rumour})
+	if member, _ := peers[0].member("m2"); member.State != Suspect {
+		t.Fatalf("m0 sees m2 %s", member.State)
+	}
+
+	for _, p := range peers {
+		p := p
+		eventually(t, 30*testInterval, func() bool {
+			member, _ := p.member("m2")
+			return member.State == Alive && member.Incarnation > rumour.Incarnation
+		}, "%s did not learn that m2 refuted the rumour", p.list.config.Name)
+	}
+	for _, p := range peers[:2] {
+		for _, state := range p.states("m2") {
+			if state == Dead {
+				t.Fatalf("%s declared alive m2 dead", p.list.config.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package gossip
+
+import "errors"
+
+// PingArgs is a direct ping carrying updates
+type PingArgs struct {
+	From    string   `protobuf:"1"`
+	Updates []Member `protobuf:"2"`
+}
+
+// PingReply acknowledges a ping and carries updates back
+type PingReply struct {
+	Updates []Member `protobuf:"1"`
+}
+
+// PingReqArgs asks a member to ping Target on behalf of From
+type PingReqArgs struct {
+	From    string   `protobuf:"1"`
+	Target  string   `protobuf:"2"`
+	Addrs   []string `protobuf:"3"`
+	Updates []Member `protobuf:"4"`
+}
+
+// SyncArgs pushes the full state of a member
+type SyncArgs struct {
+	Members []Member `protobuf:"1"`
+}
+
+// SyncReply pulls the full state of the member synced with
+type SyncReply struct {
+	Members []Member `protobuf:"1"`
+}
+
+// Service is the RPC service through which members gossip
+type Service struct {
+	m *Memberlist
+}
+
+// Ping acknowledges a direct ping
+func (s *Service) Ping(args *PingArgs, reply *PingReply) error {
+	s.m.merge(args.Updates)
+	reply.Updates = s.m.piggyback()
+	return nil
+}
+
+// PingReq pings the target on behalf of the sender and
+// fails if the target did not answer in time
+func (s *Service) PingReq(args *PingReqArgs, reply *PingReply) error {
+	s.m.merge(args.Updates)
+	target := Member{Name: args.Target, Addrs: args.Addrs}
+	if !s.m.ping(target) {
+		return errors.New("no ack from " + args.Target)
+	}
+	reply.Updates = s.m.piggyback()
+	return nil
+}
+
+// Sync merges the full state of the sender and
+// replies with the local one
+func (s *Service) Sync(args *SyncArgs, reply *SyncReply) error {
+	s.m.merge(args.Members)
+	reply.Members = s.m.Members()
+	return nil
+}
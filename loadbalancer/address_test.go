@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"conhash/node"
+	"conhash/store"
+	"conhash/transport"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestDistinctHosts runs the loadbalancer and every node on its own
+// loopback address, the nodes all on the same port. Members must be
+// told apart, called and replicated to by the address they advertise
+func TestDistinctHosts(t *testing.T) {
+	const keys = 30
+	port := freePort(t)
+	lb, err := New(Config{
+		Addr:        net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		CallTimeout: 2 * time.Second,
+		Logger:      quiet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartLB(port); err != nil {
+		t.Fatal(err)
+	}
+	c := &cluster{
+		t:      t,
+		lb:     lb.(*loadBalancer),
+		addr:   net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		nodes:  make(map[string]node.Node),
+		stores: make(map[string]store.Store),
+	}
+	t.Cleanup(c.close)
+
+	shared := freePort(t)
+	hosts := make(map[string]string)
+	for walk := 0; walk < 3; walk++ {
+		id := "n" + strconv.Itoa(walk)
+		hosts[id] = net.JoinHostPort("127.0.0."+strconv.Itoa(walk+2), strconv.Itoa(shared))
+		states := store.NewMemory()
+		n := node.New(node.Config{
+			Port:        shared,
+			Listen:      hosts[id],
+			ID:          id,
+			Weight:      4,
+			Store:       states,
+			CallTimeout: 2 * time.Second,
+			Logger:      quiet,
+		})
+		if err := n.StartNode(c.addr); err != nil {
+			t.Fatalf("node %s did not join: %v", id, err)
+		}
+		c.nodes[id] = n
+		c.stores[id] = states
+	}
+
+	for id, addr := range hosts {
+		member := c.lb.ring.Member(id)
+		if member == nil {
+			t.Fatalf("%s is not a member", id)
+		}
+		if got := transport.Addrs(member.Meta); len(got) != 1 || got[0] != addr {
+			t.Fatalf("%s advertises %v, want %s", id, got, addr)
+		}
+	}
+	c.put(keys)
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+
+	// Ranges move between hosts sharing a port
+	c.leave("n1")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+}
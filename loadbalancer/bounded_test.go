@@ -0,0 +1,37 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBoundedLoadCountsWrites(t *testing.T) {
+	const keys = 20
+	c := newCluster(t, Config{LoadFactor: 1.25})
+	for walk := 0; walk < 3; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "")
+	}
+	c.put(keys)
+	c.checkReads(keys)
+
+	stats := c.lb.ring.LoadStats()
+	if stats.Lookups != 2*keys {
+		t.Fatalf("%d lookups for %d writes and reads", stats.Lookups, keys)
+	}
+	if len(stats.Loads) != 0 {
+		t.Fatalf("loads %v are left once every request replied", stats.Loads)
+	}
+
+	w := httptest.NewRecorder()
+	c.lb.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/loads", nil))
+	loads := httpLoads{}
+	if err := json.NewDecoder(w.Body).Decode(&loads); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !loads.Enabled || loads.Lookups != 2*keys || loads.Moved != stats.Moved {
+		t.Fatalf("GET /v1/loads answered %d %+v", w.Code, loads)
+	}
+}
@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"conhash/node"
+	"conhash/rpcs"
+	"conhash/store"
+	"conhash/transport"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// quiet discards the logs of the members of a cluster
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// cluster runs a loadbalancer and its nodes in the test process.
+// Every node keeps its states in a memory store the test inspects
+type cluster struct {
+	t      *testing.T
+	lb     *loadBalancer
+	addr   string
+	nodes  map[string]node.Node
+	stores map[string]store.Store
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// newCluster starts a loadbalancer configured by config
+func newCluster(t *testing.T, config Config) *cluster {
+	t.Helper()
+	config.Logger = quiet
+	if config.CallTimeout == 0 {
+		config.CallTimeout = 2 * time.Second
+	}
+	lb, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	if err := lb.StartLB(port); err != nil {
+		t.Fatal(err)
+	}
+	c := &cluster{
+		t:      t,
+		lb:     lb.(*loadBalancer),
+		addr:   transport.PortAddr(port),
+		nodes:  make(map[string]node.Node),
+		stores: make(map[string]store.Store),
+	}
+	t.Cleanup(c.close)
+	return c
+}
+
+// close stops the loadbalancer first, so that it does not
+// fail over the nodes stopping after it
+func (c *cluster) close() {
+	c.lb.Close()
+	for _, n := range c.nodes {
+		n.Close()
+	}
+}
+
+// join starts the node id in zone and makes it join the ring
+func (c *cluster) join(id string, weight int, zone string) {
+	c.t.Helper()
+	states := store.NewMemory()
+	n := node.New(node.Config{
+		Port:        freePort(c.t),
+		ID:          id,
+		Weight:      weight,
+		Zone:        zone,
+		Store:       states,
+		CallTimeout: 2 * time.Second,
+		Logger:      quiet,
+	})
+	if err := n.StartNode(c.addr); err != nil {
+		c.t.Fatalf("node %s did not join: %v", id, err)
+	}
+	c.nodes[id] = n
+	c.stores[id] = states
+}
+
+// leave makes the node id leave the ring
+func (c *cluster) leave(id string) {
+	c.t.Helper()
+	if err := c.lb.Leave(&rpcs.LeaveArgs{ID: id}, &rpcs.Ack{}); err != nil {
+		c.t.Fatalf("node %s did not leave: %v", id, err)
+	}
+}
+
+// fail stops the node id and fails it over
+func (c *cluster) fail(id string) {
+	c.t.Helper()
+	c.nodes[id].Close()
+	delete(c.nodes, id)
+	c.lb.fail(id)
+	if c.lb.ring.Member(id) != nil {
+		c.t.Fatalf("node %s is still a member", id)
+	}
+}
+
+// put writes keys key-0 up to key-(keys-1) through the loadbalancer
+func (c *cluster) put(keys int) {
+	c.t.Helper()
+	for walk := 0; walk < keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		args := rpcs.KVArgs{Key: key, Value: []byte("value-" + key)}
+		if err := c.lb.Put(&args, &rpcs.Ack{}); err != nil {
+			c.t.Fatalf("put of %s failed: %v", key, err)
+		}
+	}
+}
+
+// checkPlacement checks that every key written by put is stored,
+// with its value and its owner as primary, on its owner and its
+// replicas placed by the loadbalancer and on no other member.
+// Keys owned by a member in loose are only checked on its owner
+// and replicas
+func (c *cluster) checkPlacement(keys int, loose ...string) {
+	c.t.Helper()
+	for walk := 0; walk < keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		placed := c.lb.holders(key)
+		owner := placed[0]
+		holders := make(map[string]bool)
+		for _, holder := range placed {
+			holders[holder.ParentKey] = true
+		}
+		for id, states := range c.stores {
+			if c.lb.ring.Member(id) == nil {
+				continue
+			}
+			state, exist, err := states.Get(key)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			switch {
+			case holders[id] && !exist:
+				c.t.Errorf("%s owned by %s is missing on %s", key, owner.Key, id)
+			case holders[id] && string(state.Value) != "value-"+key:
+				c.t.Errorf("%s on %s has value %q", key, id, state.Value)
+			case holders[id] && state.Primary != owner.Key:
+				c.t.Errorf("%s on %s has primary %s, want %s", key, id, state.Primary, owner.Key)
+			case !holders[id] && exist:
+				c.t.Errorf("%s owned by %s is still on %s", key, owner.Key, id)
+			}
+		}
+	}
+}
+
+// checkReads reads every key written by put through the loadbalancer
+func (c *cluster) checkReads(keys int) {
+	c.t.Helper()
+	for walk := 0; walk < keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		reply := rpcs.KVReply{}
+		if err := c.lb.Get(&rpcs.KVArgs{Key: key}, &reply); err != nil {
+			c.t.Errorf("get of %s failed: %v", key, err)
+		} else if !reply.Found || string(reply.Value) != "value-"+key {
+			c.t.Errorf("get of %s returned %q, found %v", key, reply.Value, reply.Found)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package loadbalancer
+
+import (
+	"conhash/client"
+	"conhash/consistent"
+	"conhash/node"
+	"conhash/rpcs"
+	"conhash/transport"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// conformanceTransports are the transports TestConformance runs
+// over, grpc_test.go adds gRPC under the grpc build tag
+var conformanceTransports = []string{transport.NameNetRPC}
+
+// conformance is a loadbalancer and nodes running over one
+// transport, with the clients talking to them
+type conformance struct {
+	transport transport.Transport
+	members   int
+	keys      int
+	ports     []int // ports of the nodes
+	router    *client.Router
+	conn      transport.Conn
+}
+
+// kvStore is what the loadbalancer client and the router share
+type kvStore interface {
+	Put(key string, value []byte) error
+	Get(key string) ([]byte, bool, error)
+	Delete(key string) error
+}
+
+// TestConformance checks the behaviour of the services the clients
+// rely on over every transport: reads and writes through the
+// loadbalancer and straight to the nodes, the ring, its export,
+// leadership, membership changes and the rejection of a request
+// routed with a stale ring. Run it with -tags grpc for gRPC too
+func TestConformance(t *testing.T) {
+	for _, name := range conformanceTransports {
+		t.Run(name, func(t *testing.T) {
+			testConformance(t, name)
+		})
+	}
+}
+
+// testConformance runs the checks of TestConformance over
+// the transport registered under name
+func testConformance(t *testing.T, name string) {
+	rpcTransport, err := transport.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conformance{transport: rpcTransport, members: 3, keys: 20}
+	lb, err := New(Config{
+		RequestTimeout: 500 * time.Millisecond,
+		CallTimeout:    2 * time.Second,
+		Transport:      rpcTransport,
+		Logger:         quiet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	if err := lb.StartLB(port); err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	lbAddr := transport.PortAddr(port)
+
+	for walk := 0; walk < c.members; walk++ {
+		c.ports = append(c.ports, freePort(t))
+		n := node.New(node.Config{
+			Port:        c.ports[walk],
+			ID:          "n" + strconv.Itoa(walk),
+			Weight:      3,
+			CallTimeout: 2 * time.Second,
+			Transport:   rpcTransport,
+			Logger:      quiet,
+		})
+		if err := n.StartNode(lbAddr); err != nil {
+			t.Fatalf("node %d did not join: %v", walk, err)
+		}
+		defer n.Close()
+	}
+
+	kv, err := client.DialWith(rpcTransport, lbAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if c.router, err = client.NewRouterWith(rpcTransport, lbAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.router.Close()
+	if c.conn, err = rpcTransport.Dial(context.Background(), lbAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"loadbalancer reads and writes", func() error { return c.readWrite(kv) }},
+		{"direct reads and writes", func() error { return c.readWrite(c.router) }},
+		{"forward", c.forward},
+		{"ring", c.ring},
+		{"export", c.export},
+		{"leader", func() error { return c.leader(lbAddr) }},
+		{"stale epoch", c.stale},
+		{"errors", c.typedErrors},
+		{"reweight", c.reweight},
+		{"leave", c.leave},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.check(); err != nil {
+				t.Errorf("over %s: %v", rpcTransport.Name(), err)
+			}
+		})
+	}
+}
+
+// readWrite writes keys, reads them back, deletes them and
+// checks they are gone
+func (c *conformance) readWrite(kv kvStore) error {
+	for walk := 0; walk < c.keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		if err := kv.Put(key, []byte("value-"+key)); err != nil {
+			return fmt.Errorf("put %s: %v", key, err)
+		}
+	}
+	for walk := 0; walk < c.keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		value, found, err := kv.Get(key)
+		if err != nil || !found || string(value) != "value-"+key {
+			return fmt.Errorf("get %s: %q %v %v", key, value, found, err)
+		}
+	}
+	for walk := 0; walk < c.keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		if err := kv.Delete(key); err != nil {
+			return fmt.Errorf("delete %s: %v", key, err)
+		}
+		if _, found, err := kv.Get(key); err != nil || found {
+			return fmt.Errorf("get deleted %s: %v %v", key, found, err)
+		}
+	}
+	return nil
+}
+
+// forward checks the loadbalancer and the router send a user
+// to the same member
+func (c *conformance) forward() error {
+	for walk := 0; walk < c.keys; walk++ {
+		id := "user-" + strconv.Itoa(walk)
+		args := rpcs.ReqArgs{ID: id}
+		reply := rpcs.ReqReply{}
+		if err := c.conn.Call("LoadBalancer.Forward", &args, &reply); err != nil || !reply.Success {
+			return fmt.Errorf("forward %s: %v %v", id, reply.Success, err)
+		}
+		server, err := c.router.Request(id)
+		if err != nil {
+			return fmt.Errorf("request %s: %v", id, err)
+		}
+		if server != reply.Server {
+			return fmt.Errorf("%s served by %s and %s", id, reply.Server, server)
+		}
+	}
+	return nil
+}
+
+// ring checks the ring holds every node with its weight
+func (c *conformance) ring() error {
+	reply := rpcs.RingReply{}
+	if err := c.conn.Call("LoadBalancer.GetRing", &rpcs.Ack{}, &reply); err != nil {
+		return err
+	}
+	if reply.Epoch == 0 || reply.Hasher == "" || len(reply.Members) != c.members {
+		return fmt.Errorf("epoch %d, hasher %q, %d members", reply.Epoch, reply.Hasher, len(reply.Members))
+	}
+	for _, member := range reply.Members {
+		if member.Weight != 3 {
+			return fmt.Errorf("member %s has weight %d", member.Key, member.Weight)
+		}
+	}
+	return nil
+}
+
+// export checks both formats of the snapshot decode to the
+// same ring
+func (c *conformance) export() error {
+	var snaps []*consistent.Snapshot
+	for _, format := range []string{consistent.FormatJSON, consistent.FormatBinary} {
+		args := rpcs.ExportArgs{Format: format}
+		reply := rpcs.ExportReply{}
+		if err := c.conn.Call("LoadBalancer.ExportRing", &args, &reply); err != nil {
+			return fmt.Errorf("%s: %v", format, err)
+		}
+		snap, err := consistent.DecodeSnapshot(format, reply.Data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", format, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	a, _ := snaps[0].MarshalBinary()
+	b, _ := snaps[1].MarshalBinary()
+	if string(a) != string(b) {
+		return fmt.Errorf("json and binary snapshots differ")
+	}
+	if len(snaps[0].Members) != c.members {
+		return fmt.Errorf("snapshot has %d members", len(snaps[0].Members))
+	}
+	return nil
+}
+
+// leader checks a lone loadbalancer leads
+func (c *conformance) leader(addr string) error {
+	reply := rpcs.LeaderReply{}
+	if err := c.conn.Call("LoadBalancer.Leader", &rpcs.Ack{}, &reply); err != nil {
+		return err
+	}
+	if reply.Leader != addr {
+		return fmt.Errorf("leader is %q", reply.Leader)
+	}
+	return nil
+}
+
+// stale checks a node rejects a request carrying an older
+// epoch with an error naming its own
+func (c *conformance) stale() error {
+	conn, err := c.transport.Dial(context.Background(), transport.PortAddr(c.ports[0]))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	args := rpcs.KVArgs{Key: "key-0", Epoch: 1}
+	reply := rpcs.KVReply{}
+	err = conn.Call("Node.Get", &args, &reply)
+	epoch, ok := rpcs.WrongOwnerEpoch(err)
+	if !ok {
+		return fmt.Errorf("got %v instead of a wrong owner", err)
+	}
+	if epoch != c.router.Epoch() {
+		return fmt.Errorf("node expects epoch %d, ring has %d", epoch, c.router.Epoch())
+	}
+	return nil
+}
+
+// typedErrors checks the codes of failed calls survive
+// the transport
+func (c *conformance) typedErrors() error {
+	// n0 at the address of n1, n0 at its own address rejoins
+	join := rpcs.JoinArgs{Port: c.ports[1], ID: "n0", Weight: 3, Hasher: consistent.SHA256}
+	calls := []struct {
+		method string
+		args   interface{}
+		code   rpcs.Code
+	}{
+		{"LoadBalancer.Join", &join, rpcs.CodeDuplicateID},
+		{"LoadBalancer.Join", &rpcs.JoinArgs{ID: "x", Weight: 3, Hasher: "none"}, rpcs.CodeInvalid},
+		{"LoadBalancer.Leave", &rpcs.LeaveArgs{ID: "x"}, rpcs.CodeNotMember},
+		{"LoadBalancer.Reweight", &rpcs.ReweightArgs{ID: "n0", Weight: 0}, rpcs.CodeInvalid},
+	}
+	for _, call := range calls {
+		err := c.conn.Call(call.method, call.args, &rpcs.Ack{})
+		if code := rpcs.CodeOf(err); code != call.code {
+			return fmt.Errorf("%s returned %v instead of %s", call.method, err, call.code)
+		}
+	}
+	return nil
+}
+
+// reweight changes the weight of a node and checks the ring
+func (c *conformance) reweight() error {
+	args := rpcs.ReweightArgs{ID: "n0", Weight: 5}
+	reply := rpcs.Ack{}
+	if err := c.conn.Call("LoadBalancer.Reweight", &args, &reply); err != nil || !reply.Success {
+		return fmt.Errorf("%v %v", reply.Success, err)
+	}
+	ringReply := rpcs.RingReply{}
+	if err := c.conn.Call("LoadBalancer.GetRing", &rpcs.Ack{}, &ringReply); err != nil {
+		return err
+	}
+	for _, member := range ringReply.Members {
+		if member.Key == "n0" && member.Weight != 5 {
+			return fmt.Errorf("n0 has weight %d", member.Weight)
+		}
+	}
+	return c.readWrite(c.router)
+}
+
+// leave removes a node and checks the others still serve
+// every key
+func (c *conformance) leave() error {
+	args := rpcs.LeaveArgs{ID: "n" + strconv.Itoa(c.members-1)}
+	reply := rpcs.Ack{}
+	if err := c.conn.Call("LoadBalancer.Leave", &args, &reply); err != nil || !reply.Success {
+		return fmt.Errorf("%v %v", reply.Success, err)
+	}
+	ringReply := rpcs.RingReply{}
+	if err := c.conn.Call("LoadBalancer.GetRing", &rpcs.Ack{}, &ringReply); err != nil {
+		return err
+	}
+	if len(ringReply.Members) != c.members-1 {
+		return fmt.Errorf("ring has %d members", len(ringReply.Members))
+	}
+	return c.readWrite(c.router)
+}
@@ -0,0 +1,22 @@
+package loadbalancer
+
+import "conhash/rpcs"
+
+// Membership changes handed to handleRequests. Unlike the exchanges
+// of loadbalancer_api.go they reply with an error, so that callers
+// learn why a change was refused.
+
+type joinChange struct {
+	args *rpcs.JoinArgs
+	rep  chan error
+}
+
+type leaveChange struct {
+	args *rpcs.LeaveArgs
+	rep  chan error
+}
+
+type reweightChange struct {
+	args *rpcs.ReweightArgs
+	rep  chan error
+}
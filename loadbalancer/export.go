@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"os"
+)
+
+// ExportRing returns a snapshot of the ring so that it can
+// be inspected, diffed or restored
+func (lb *loadBalancer) ExportRing(args *rpcs.ExportArgs, reply *rpcs.ExportReply) error {
+	format := args.Format
+	if format == "" {
+		format = consistent.FormatJSON
+	}
+	data, err := lb.ring.Snapshot().Encode(format)
+	if err != nil {
+		return err
+	}
+	*reply = rpcs.ExportReply{Data: data}
+	return nil
+}
+
+// saveRing writes a snapshot of the ring to the ring file,
+// if any. It is called on every change of the ring
+func (lb *loadBalancer) saveRing() {
+	if lb.ringFile == "" {
+		return
+	}
+	data, err := lb.ring.Snapshot().Encode(lb.ringFormat)
+	if err == nil {
+		err = writeFile(lb.ringFile, data)
+	}
+	if err != nil {
+		lb.logger.Error("unable to write ring", "file", lb.ringFile, "err", err)
+	}
+}
+
+// loadRing restores the ring from the ring file, if any. The
+// raft log of peers or of RaftDir would be applied on top of it,
+// so the file is only used when there is neither
+func (lb *loadBalancer) loadRing() error {
+	if lb.ringFile == "" || lb.raftDir != "" || len(lb.peers) > 0 {
+		return nil
+	}
+	data, err := os.ReadFile(lb.ringFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snap, err := consistent.DecodeSnapshot(lb.ringFormat, data)
+	if err != nil {
+		return err
+	}
+	if err := lb.ring.Restore(snap); err != nil {
+		return err
+	}
+	lb.updatePlacement()
+	lb.logger.Info("loaded ring", "members", len(snap.Members), "epoch", snap.Epoch, "file", lb.ringFile)
+	return nil
+}
+
+// writeFile replaces the file at path with data atomically
+func writeFile(path string, data []byte) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
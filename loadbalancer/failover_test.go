@@ -0,0 +1,162 @@
+package loadbalancer
+
+import (
+	"conhash/node"
+	"conhash/rpcs"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nodeEnv makes a child process of the test binary run a node
+// instead of the tests. It holds the ID of the node, its port
+// and the address of the loadbalancer separated by commas
+const nodeEnv = "CONHASH_TEST_NODE"
+
+func TestMain(m *testing.M) {
+	if spec := os.Getenv(nodeEnv); spec != "" {
+		serveNode(spec)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// serveNode runs the node of spec until the process is killed
+func serveNode(spec string) {
+	fields := strings.Split(spec, ",")
+	port, _ := strconv.Atoi(fields[1])
+	n := node.New(node.Config{
+		Port:   port,
+		ID:     fields[0],
+		Weight: 3,
+		Logger: quiet,
+	})
+	if err := n.StartNode(fields[2]); err != nil {
+		fmt.Fprintln(os.Stderr, "node", fields[0], "did not join:", err)
+		os.Exit(1)
+	}
+	select {}
+}
+
+// spawn starts the node id in a child process and waits until it
+// joined. The function returned kills the node, which then never
+// leaves the ring, and waits for it to exit
+func (c *cluster) spawn(id string) func() {
+	c.t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s,%d,%s", nodeEnv, id, freePort(c.t), c.addr))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		c.t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	kill := func() {
+		cmd.Process.Kill()
+		<-exited
+	}
+	c.t.Cleanup(kill)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.lb.ring.Member(id) == nil {
+		select {
+		case <-exited:
+			c.t.Fatalf("node %s exited before joining", id)
+		default:
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("node %s did not join", id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return kill
+}
+
+// TestFailover writes keys, then reads them in a loop and kills the
+// node serving the first key half way through. Every read must still
+// succeed. Failure detection is off so reads only survive by failover
+func TestFailover(t *testing.T) {
+	const keys, rounds = 50, 4
+	c := newCluster(t, Config{RequestTimeout: 500 * time.Millisecond})
+	kills := make(map[string]func())
+	for walk := 0; walk < 3; walk++ {
+		id := "n" + strconv.Itoa(walk)
+		kills[id] = c.spawn(id)
+	}
+	c.put(keys)
+
+	served := make(map[string]int)
+	killed := ""
+	total := keys * rounds
+	for read := 0; read < total; read++ {
+		key := "key-" + strconv.Itoa(read%keys)
+		reply := rpcs.KVReply{}
+		err := c.lb.Get(&rpcs.KVArgs{Key: key}, &reply)
+		if err != nil || !reply.Success || !reply.Found || string(reply.Value) != "value-"+key {
+			t.Errorf("read %d of %s failed: %v, found %v", read, key, err, reply.Found)
+		} else if killed != "" && reply.Server == killed {
+			t.Errorf("read %d of %s served by the killed node %s", read, key, killed)
+		} else {
+			served[reply.Server]++
+		}
+
+		// Kill the primary of the first key mid-run
+		if read == total/2 {
+			killed = c.lb.ring.GetNext("key-0").ParentKey
+			kills[killed]()
+		}
+	}
+	if served[killed] == 0 || c.lb.ring.Member(killed) == nil {
+		t.Fatalf("reads served by %v, %s killed", served, killed)
+	}
+}
+
+// TestForwardFailover kills the owner of a user and forwards the
+// user again. The replica serving the request must keep the state
+// under the virtual node of the owner, where the hand-over of its
+// range finds it
+func TestForwardFailover(t *testing.T) {
+	c := newCluster(t, Config{RequestTimeout: 500 * time.Millisecond})
+	kill := c.spawn("n0")
+	c.join("n1", 3, "")
+	c.join("n2", 3, "")
+
+	user := ""
+	for walk := 0; user == ""; walk++ {
+		if id := "user-" + strconv.Itoa(walk); c.lb.ring.GetNext(id).ParentKey == "n0" {
+			user = id
+		}
+	}
+	owner := c.lb.ring.GetNext(user)
+	forward := func() string {
+		t.Helper()
+		reply, err := c.lb.forward(&rpcs.ReqArgs{ID: user})
+		if err != nil || !reply.Success {
+			t.Fatalf("forward of %s failed: %v", user, err)
+		}
+		return reply.Server
+	}
+	if server := forward(); server != "n0" {
+		t.Fatalf("%s owned by n0 served by %s", user, server)
+	}
+
+	kill()
+	server := forward()
+	if server == "n0" {
+		t.Fatalf("%s served by the killed node", user)
+	}
+	state, exist, err := c.stores[server].Get(user)
+	if err != nil || !exist {
+		t.Fatalf("%s missing on %s: %v", user, server, err)
+	}
+	if state.Primary != owner.Key {
+		t.Fatalf("%s on %s has primary %s, want %s", user, server, state.Primary, owner.Key)
+	}
+}
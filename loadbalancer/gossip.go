@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/gossip"
+	"conhash/rpcs"
+	"conhash/transport"
+	"strconv"
+)
+
+// observe is notified of the changes of the gossip membership.
+// Nodes gossiped dead are failed over and nodes that left are
+// removed by the leader, as long as they are still part of the
+// ring. A node gossiped dead that turns out alive joins again
+func (lb *loadBalancer) observe(member gossip.Member) {
+	if member.Meta[gossip.MetaRole] != gossip.RoleNode {
+		return
+	}
+	if member.State == gossip.Dead {
+		lb.markDead(member.Name)
+	}
+	if !lb.raft.IsLeader() {
+		return
+	}
+	inRing := lb.ring.Member(member.Name) != nil
+	switch {
+	case member.State == gossip.Dead && inRing:
+		lb.logger.Warn("gossip reports node dead", "node", member.Name)
+		lb.fail(member.Name)
+	case member.State == gossip.Left && inRing:
+		lb.logger.Info("gossip reports node left", "node", member.Name)
+		ex := leaveChange{
+			args: &rpcs.LeaveArgs{ID: member.Name},
+			rep:  make(chan error),
+		}
+		select {
+		case lb.leaveCh <- ex:
+			<-ex.rep
+		case <-lb.done:
+		}
+	case member.State == gossip.Alive && !inRing && lb.wasDead(member.Name, false):
+		lb.logger.Info("gossip reports node alive again", "node", member.Name)
+		ex := joinChange{
+			args: joinArgs(member),
+			rep:  make(chan error),
+		}
+		select {
+		case lb.joinCh <- ex:
+			if err := <-ex.rep; err != nil {
+				lb.logger.Warn("node alive again did not join", "node", member.Name, "err", err)
+			}
+		case <-lb.done:
+		}
+	}
+}
+
+// markDead records that the node key was found dead. It
+// joins again once gossiped alive, unlike a node that left
+func (lb *loadBalancer) markDead(key string) {
+	lb.deadMu.Lock()
+	defer lb.deadMu.Unlock()
+	lb.dead[key] = true
+}
+
+// wasDead reports whether the node key was found dead since it
+// last joined, which it forgets if forget is set
+func (lb *loadBalancer) wasDead(key string, forget bool) bool {
+	lb.deadMu.Lock()
+	defer lb.deadMu.Unlock()
+	dead := lb.dead[key]
+	if forget {
+		delete(lb.dead, key)
+	}
+	return dead
+}
+
+// joinArgs returns the join of a node from its gossip metadata
+func joinArgs(member gossip.Member) *rpcs.JoinArgs {
+	weight, _ := strconv.Atoi(member.Meta[gossip.MetaWeight])
+	addrs := transport.Addrs(member.Meta)
+	args := &rpcs.JoinArgs{
+		ID:     member.Name,
+		Weight: weight,
+		Hasher: member.Meta[gossip.MetaHasher],
+		Zone:   member.Meta[consistent.MetaZone],
+		Rack:   member.Meta[consistent.MetaRack],
+	}
+	if len(addrs) > 0 {
+		args.Addr, args.Addrs = addrs[0], addrs[1:]
+	}
+	return args
+}
@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"conhash/gossip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// gossiped returns the member id as the gossip of the
+// loadbalancer knows it
+func (c *cluster) gossiped(id string) gossip.Member {
+	c.t.Helper()
+	for _, member := range c.lb.gossip.Members() {
+		if member.Name == id {
+			return member
+		}
+	}
+	c.t.Fatalf("%s is not in the gossip", id)
+	return gossip.Member{}
+}
+
+// A node closed for a restart stays in the ring, only an
+// explicit leave is gossiped
+func TestCloseStaysInRing(t *testing.T) {
+	const keys = 40
+	c := newCluster(t, Config{})
+	for walk := 0; walk < 4; walk++ {
+		c.join("n"+strconv.Itoa(walk), 3, "")
+	}
+	c.put(keys)
+
+	c.nodes["n3"].Close()
+	time.Sleep(1500 * time.Millisecond)
+	if c.lb.ring.Member("n3") == nil {
+		t.Fatal("closed node left the ring")
+	}
+	if state := c.gossiped("n3").State; state == gossip.Left {
+		t.Fatal("closed node gossiped that it left")
+	}
+
+	if err := c.nodes["n2"].Leave(); err != nil {
+		t.Fatal(err)
+	}
+	delete(c.nodes, "n2")
+	if c.lb.ring.Member("n2") != nil {
+		t.Fatal("node did not leave the ring")
+	}
+	for start := time.Now(); c.gossiped("n2").State != gossip.Left; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("leave was not gossiped")
+		}
+	}
+}
+
+// A node gossiped dead is failed over and joins again once
+// gossiped alive, a node that left does not
+func TestDeadNodeJoinsAgain(t *testing.T) {
+	const keys = 100
+	c := newCluster(t, Config{})
+	for walk := 0; walk < 4; walk++ {
+		c.join("n"+strconv.Itoa(walk), 3, "")
+	}
+	c.put(keys)
+
+	member := c.gossiped("n1")
+	member.State = gossip.Dead
+	c.lb.observe(member)
+	if c.lb.ring.Member("n1") != nil {
+		t.Fatal("dead node is still a member")
+	}
+	c.checkReads(keys)
+
+	// n1 refutes the rumour with a newer incarnation
+	member.State = gossip.Alive
+	member.Incarnation++
+	c.lb.observe(member)
+	if c.lb.ring.Member("n1") == nil {
+		t.Fatal("node alive again did not join")
+	}
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+
+	c.leave("n2")
+	left := c.gossiped("n2")
+	left.Incarnation++
+	c.lb.observe(left)
+	if c.lb.ring.Member("n2") != nil {
+		t.Fatal("node that left joined again")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build grpc
+
+package loadbalancer
+
+import (
+	"conhash/transport"
+	_ "conhash/transport/grpctransport"
+)
+
+// The gRPC transport is only built with -tags grpc
+func init() {
+	conformanceTransports = append(conformanceTransports, transport.NameGRPC)
+}
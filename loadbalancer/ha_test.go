@@ -0,0 +1,189 @@
+package loadbalancer
+
+import (
+	"conhash/node"
+	"conhash/rpcs"
+	"conhash/transport"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// haElection is the election timeout of the loadbalancers of TestHA
+const haElection = 300 * time.Millisecond
+
+// replicated runs loadbalancers sharing a ring through raft and
+// nodes in the test process
+type replicated struct {
+	t     *testing.T
+	ports []int
+	addrs []string
+	lbs   map[string]*loadBalancer
+	nodes []node.Node
+}
+
+// start starts the loadbalancer walk with an empty state
+func (r *replicated) start(walk int) {
+	r.t.Helper()
+	var peers []string
+	for _, peer := range r.addrs {
+		if peer != r.addrs[walk] {
+			peers = append(peers, peer)
+		}
+	}
+	lb, err := New(Config{
+		Peers:             peers,
+		ElectionTimeout:   haElection,
+		SnapshotThreshold: 2,
+		RequestTimeout:    500 * time.Millisecond,
+		CallTimeout:       2 * time.Second,
+		Logger:            quiet,
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := lb.StartLB(r.ports[walk]); err != nil {
+		r.t.Fatal(err)
+	}
+	r.lbs[r.addrs[walk]] = lb.(*loadBalancer)
+}
+
+// join starts the node id joining the ring through the
+// loadbalancer at addr
+func (r *replicated) join(id string, addr string) {
+	r.t.Helper()
+	n := node.New(node.Config{
+		Port:        freePort(r.t),
+		ID:          id,
+		Weight:      3,
+		CallTimeout: 2 * time.Second,
+		Logger:      quiet,
+	})
+	if err := n.StartNode(addr); err != nil {
+		r.t.Fatalf("node %s did not join through %s: %v", id, addr, err)
+	}
+	r.nodes = append(r.nodes, n)
+}
+
+// leader waits for a loadbalancer of addrs other than old to lead
+func (r *replicated) leader(addrs []string, old string) string {
+	r.t.Helper()
+	deadline := time.Now().Add(20 * haElection)
+	for time.Now().Before(deadline) {
+		for _, addr := range addrs {
+			reply := rpcs.LeaderReply{}
+			r.lbs[addr].Leader(&rpcs.Ack{}, &reply)
+			if reply.Leader == addr && addr != old {
+				return addr
+			}
+		}
+		time.Sleep(haElection / 10)
+	}
+	r.t.Fatal("no loadbalancer took the lead")
+	return ""
+}
+
+// checkReads reads every key written through every loadbalancer
+// of addrs, waiting a while for them to catch up with the ring
+func (r *replicated) checkReads(addrs []string, keys int) {
+	r.t.Helper()
+	deadline := time.Now().Add(20 * haElection)
+	for _, addr := range addrs {
+		for walk := 0; walk < keys; walk++ {
+			key := "key-" + strconv.Itoa(walk)
+			for {
+				reply := rpcs.KVReply{}
+				err := r.lbs[addr].Get(&rpcs.KVArgs{Key: key}, &reply)
+				if err == nil && reply.Found && string(reply.Value) == "value-"+key {
+					break
+				} else if time.Now().After(deadline) {
+					r.t.Fatalf("get of %s through %s returned %q, found %v: %v", key, addr, reply.Value, reply.Found, err)
+				}
+				time.Sleep(haElection / 10)
+			}
+		}
+	}
+}
+
+// other returns a member of addrs that is neither a nor b
+func other(addrs []string, a string, b string) string {
+	for _, addr := range addrs {
+		if addr != a && addr != b {
+			return addr
+		}
+	}
+	return ""
+}
+
+// TestHA runs three loadbalancers sharing a ring, writes keys, then
+// closes the leader. Another loadbalancer must take over, every key
+// must stay readable through every one left and a node must still be
+// able to join. The closed loadbalancer then starts again from scratch
+// and must rebuild the ring from the log of the others
+func TestHA(t *testing.T) {
+	const members, keys = 3, 30
+	r := &replicated{t: t, lbs: make(map[string]*loadBalancer)}
+	for walk := 0; walk < 3; walk++ {
+		r.ports = append(r.ports, freePort(t))
+		r.addrs = append(r.addrs, transport.PortAddr(r.ports[walk]))
+	}
+	for walk := range r.addrs {
+		r.start(walk)
+	}
+	t.Cleanup(func() {
+		for _, lb := range r.lbs {
+			lb.Close()
+		}
+		for _, n := range r.nodes {
+			n.Close()
+		}
+	})
+	leader := r.leader(r.addrs, "")
+
+	// Nodes join through a follower, which hands them to the leader
+	follower := other(r.addrs, leader, "")
+	for walk := 0; walk < members; walk++ {
+		r.join("n"+strconv.Itoa(walk), follower)
+	}
+	for walk := 0; walk < keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		args := rpcs.KVArgs{Key: key, Value: []byte("value-" + key)}
+		if err := r.lbs[r.addrs[walk%len(r.addrs)]].Put(&args, &rpcs.Ack{}); err != nil {
+			t.Fatalf("put of %s failed: %v", key, err)
+		}
+	}
+	r.checkReads(r.addrs, keys)
+
+	r.lbs[leader].Close()
+	delete(r.lbs, leader)
+	var alive []string
+	for _, addr := range r.addrs {
+		if addr != leader {
+			alive = append(alive, addr)
+		}
+	}
+	next := r.leader(alive, leader)
+	r.checkReads(alive, keys)
+
+	// Membership changes go on under the new leader
+	r.join("n"+strconv.Itoa(members), other(alive, next, leader))
+	r.checkReads(alive, keys)
+	if size := r.lbs[next].ring.Size(); size != members+1 {
+		t.Fatalf("ring of the new leader has %d members", size)
+	}
+
+	// A fresh loadbalancer catches up from the snapshot and the log
+	for walk, addr := range r.addrs {
+		if addr == leader {
+			r.start(walk)
+		}
+	}
+	r.checkReads([]string{leader}, keys)
+	deadline := time.Now().Add(20 * haElection)
+	for r.lbs[leader].ring.Size() != members+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("restarted loadbalancer has %d members", r.lbs[leader].ring.Size())
+		}
+		time.Sleep(haElection / 10)
+	}
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"conhash/rpcs"
+	"strconv"
+	"testing"
+)
+
+func TestJoinReplicationFactorThree(t *testing.T) {
+	const keys = 200
+	c := newCluster(t, Config{ReplicationFactor: 3})
+	for walk := 0; walk < 4; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "")
+	}
+	c.put(keys)
+	c.checkPlacement(keys)
+
+	c.join("n4", 4, "")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+}
+
+func TestLeaveReplicationFactorThree(t *testing.T) {
+	const keys = 200
+	c := newCluster(t, Config{ReplicationFactor: 3})
+	for walk := 0; walk < 5; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "")
+	}
+	c.put(keys)
+
+	c.leave("n2")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+
+	c.fail("n3")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+}
+
+// A single member in a zone of its own replicates every other
+// member, ranges still move along the plain ring
+func TestLabelledJoinLeave(t *testing.T) {
+	const keys = 200
+	c := newCluster(t, Config{ReplicationFactor: 2})
+	for walk := 0; walk < 5; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "z1")
+	}
+	c.put(keys)
+	c.checkPlacement(keys)
+
+	c.join("n5", 4, "z2")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+
+	c.leave("n1")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+
+	c.leave("n5")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+}
+
+func TestLabelledFail(t *testing.T) {
+	const keys = 200
+	c := newCluster(t, Config{ReplicationFactor: 2})
+	for walk := 0; walk < 5; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "z1")
+	}
+	c.join("n5", 4, "z2")
+	c.put(keys)
+
+	c.fail("n2")
+	c.checkPlacement(keys)
+	c.checkReads(keys)
+}
+
+func TestReweight(t *testing.T) {
+	const keys = 200
+	c := newCluster(t, Config{ReplicationFactor: 3})
+	for walk := 0; walk < 4; walk++ {
+		c.join("n"+strconv.Itoa(walk), 4, "")
+	}
+	c.put(keys)
+
+	for _, weight := range []int{8, 2} {
+		args := rpcs.ReweightArgs{ID: "n1", Weight: weight}
+		if err := c.lb.Reweight(&args, &rpcs.Ack{}); err != nil {
+			t.Fatalf("reweight of n1 to %d failed: %v", weight, err)
+		}
+		c.checkPlacement(keys)
+		c.checkReads(keys)
+	}
+}
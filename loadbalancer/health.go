@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"conhash/transport"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Default thresholds of the failure detector
+const (
+	defaultSuspectAfter = 1
+	defaultDeadAfter    = 3
+	defaultRecoverAfter = 2
+	maxFlaps            = 4 // flaps counted towards the damping
+)
+
+// Liveness of a member as seen by the failure detector
+const (
+	stateAlive = iota
+	stateSuspect
+	stateDead
+)
+
+// health tracks the liveness of the members of the ring. A member
+// is suspected after SuspectAfter probes in a row failed and declared
+// dead after DeadAfter. A suspect only becomes alive again after
+// RecoverAfter probes in a row succeed, a number that doubles with
+// every recent flap, so a flapping member stays suspected longer
+type health struct {
+	mu           sync.Mutex
+	interval     time.Duration
+	timeout      time.Duration
+	suspectAfter int
+	deadAfter    int
+	recoverAfter int
+	members      map[string]*liveness
+	probing      map[string]bool // members probed after a failed request
+	logger       *slog.Logger
+}
+
+type liveness struct {
+	state     int
+	failures  int // failed probes in a row
+	successes int // successful probes in a row
+	flaps     int // recent recoveries from suspicion
+}
+
+// newHealth returns the failure detector configured by
+// config, or nil if it is disabled
+func newHealth(config Config) *health {
+	if config.HealthInterval <= 0 {
+		return nil
+	}
+	h := &health{
+		interval:     config.HealthInterval,
+		timeout:      config.HealthTimeout,
+		suspectAfter: config.SuspectAfter,
+		deadAfter:    config.DeadAfter,
+		recoverAfter: config.RecoverAfter,
+		members:      make(map[string]*liveness),
+		probing:      make(map[string]bool),
+		logger:       config.Logger,
+	}
+	if h.timeout <= 0 {
+		h.timeout = h.interval
+	}
+	if h.suspectAfter <= 0 {
+		h.suspectAfter = defaultSuspectAfter
+	}
+	if h.deadAfter <= 0 {
+		h.deadAfter = defaultDeadAfter
+	}
+	if h.deadAfter < h.suspectAfter {
+		h.deadAfter = h.suspectAfter
+	}
+	if h.recoverAfter <= 0 {
+		h.recoverAfter = defaultRecoverAfter
+	}
+	return h
+}
+
+// observe records the outcome of a probe of key and
+// returns the resulting state of the member
+func (h *health) observe(key string, ok bool) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	member, exist := h.members[key]
+	if !exist {
+		member = &liveness{}
+		h.members[key] = member
+	}
+
+	if ok {
+		member.failures = 0
+		member.successes++
+		// Staying alive as long as recovering took forgets a flap
+		needed := h.recoverAfter << member.flaps
+		switch {
+		case member.state == stateSuspect && member.successes >= needed:
+			h.logger.Info("node alive again", "node", key, "successes", member.successes)
+			member.state = stateAlive
+			member.successes = 0
+			if member.flaps < maxFlaps {
+				member.flaps++
+			}
+		case member.state == stateAlive && member.flaps > 0 && member.successes >= needed:
+			member.successes = 0
+			member.flaps--
+		}
+		return member.state
+	}
+
+	member.successes = 0
+	member.failures++
+	if member.state == stateAlive && member.failures >= h.suspectAfter {
+		h.logger.Warn("node suspected", "node", key, "failures", member.failures)
+		member.state = stateSuspect
+	}
+	if member.state == stateSuspect && member.failures >= h.deadAfter {
+		h.logger.Warn("node dead", "node", key, "failures", member.failures)
+		member.state = stateDead
+	}
+	return member.state
+}
+
+// reset drops the record of key, a member that rejoined
+// starts afresh
+func (h *health) reset(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.members, key)
+}
+
+// forget drops the records of the members not in keys
+func (h *health) forget(keys map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key := range h.members {
+		if !keys[key] {
+			delete(h.members, key)
+		}
+	}
+}
+
+// monitor probes every member of the ring until the
+// loadbalancer is closed
+func (lb *loadBalancer) monitor() {
+	ticker := time.NewTicker(lb.health.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.done:
+			return
+		case <-ticker.C:
+			lb.probeAll()
+		}
+	}
+}
+
+// probeAll probes the members concurrently and fails
+// those found dead
+func (lb *loadBalancer) probeAll() {
+	var wg sync.WaitGroup
+	for _, member := range lb.ring.Members() {
+		wg.Add(1)
+		go func(member *consistent.CNode) {
+			defer wg.Done()
+			err := lb.probe(member)
+			if lb.health.observe(member.Key, err == nil) == stateDead {
+				lb.fail(member.Key)
+			}
+		}(member)
+	}
+	wg.Wait()
+
+	// Failed and departed members start afresh if they join again
+	keys := make(map[string]bool)
+	for _, member := range lb.ring.Members() {
+		keys[member.Key] = true
+	}
+	lb.health.forget(keys)
+}
+
+// probe calls GetStatus on the member and gives up after
+// the probe timeout
+func (lb *loadBalancer) probe(member *consistent.CNode) error {
+	args := rpcs.Ack{}
+	reply := rpcs.Ack{}
+	return lb.pool.CallTimeout(transport.Addrs(member.Meta), lb.health.timeout, "Node.GetStatus", &args, &reply)
+}
+
+// fail hands a dead member over to handleRequests
+// and waits until it is removed. Only the leader
+// fails members over, and only until it is closed
+func (lb *loadBalancer) fail(key string) {
+	if !lb.raft.IsLeader() {
+		return
+	}
+	ex := leaveEx{
+		args: &rpcs.LeaveArgs{ID: key},
+		rep:  make(chan rpcs.Ack),
+	}
+	select {
+	case lb.failCh <- ex:
+		<-ex.rep
+	case <-lb.done:
+	}
+}
+
+// startProbe reports whether key may be probed out of turn,
+// which it may unless such a probe is already running
+func (h *health) startProbe(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.probing[key] {
+		return false
+	}
+	h.probing[key] = true
+	return true
+}
+
+func (h *health) endProbe(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.probing, key)
+}
+
+// suspect probes the member of node at once after a call to
+// it failed. Only the probe counts towards its failures: slow
+// requests alone never get a member removed
+func (lb *loadBalancer) suspect(node *consistent.CNode) {
+	if lb.health == nil || !lb.health.startProbe(node.ParentKey) {
+		return
+	}
+	go func() {
+		err := lb.probe(node)
+		state := lb.health.observe(node.ParentKey, err == nil)
+		lb.health.endProbe(node.ParentKey)
+		if state == stateDead {
+			lb.fail(node.ParentKey)
+		}
+	}()
+}
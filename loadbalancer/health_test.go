@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"conhash/gossip"
+	"conhash/rpcs"
+	"conhash/transport"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestHealthObserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes string // outcome of every probe, x failed
+		want   int
+	}{
+		{"alive", "....", stateAlive},
+		{"single failure", "x", stateAlive},
+		{"suspected", "xx", stateSuspect},
+		{"dead", "xxxx", stateDead},
+		{"scattered failures", "x.x.x.x.x.x.x.x.", stateAlive},
+		{"failures in a row after success", "x.xxxx", stateDead},
+		{"suspect recovers", "xx..", stateAlive},
+		{"suspect not recovered yet", "xx.", stateSuspect},
+		{"suspect failures reset", "xx.xxx", stateSuspect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealth(Config{
+				HealthInterval: time.Second,
+				SuspectAfter:   2,
+				DeadAfter:      4,
+				RecoverAfter:   2,
+				Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			state := stateAlive
+			for _, probe := range tt.probes {
+				state = h.observe("n", probe == '.')
+			}
+			if state != tt.want {
+				t.Errorf("state after %q is %d, want %d", tt.probes, state, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloseReleasesSenders(t *testing.T) {
+	lb, err := New(Config{Logger: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartLB(freePort(t)); err != nil {
+		t.Fatal(err)
+	}
+	l := lb.(*loadBalancer)
+	for start := time.Now(); !l.raft.IsLeader(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("loadbalancer did not become leader")
+		}
+	}
+	l.ring.AddNode("n0", 1, transport.Meta(":1", nil))
+	lb.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	ex := leaveEx{args: &rpcs.LeaveArgs{ID: "n0"}, rep: make(chan rpcs.Ack, 1)}
+	select {
+	case l.failCh <- ex:
+		t.Error("changes are still handled after close")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Nothing receives the changes anymore
+	senders := map[string]func(){
+		"fail": func() { l.fail("n0") },
+		"gossip leave": func() {
+			l.observe(gossip.Member{Name: "n0", Meta: map[string]string{gossip.MetaRole: gossip.RoleNode}, State: gossip.Left})
+		},
+		"leave": func() {
+			if err := l.Leave(&rpcs.LeaveArgs{ID: "n0"}, &rpcs.Ack{}); err == nil {
+				t.Error("leave succeeded after close")
+			}
+		},
+		"reweight": func() { l.Reweight(&rpcs.ReweightArgs{ID: "n0", Weight: 2}, &rpcs.Ack{}) },
+	}
+	for name, send := range senders {
+		returned := make(chan bool)
+		go func() {
+			send()
+			close(returned)
+		}()
+		select {
+		case <-returned:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s blocked after close", name)
+		}
+	}
+}
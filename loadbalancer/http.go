@@ -0,0 +1,412 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"conhash/transport"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxBody bounds the size of a request body, values included
+const maxBody = 4 << 20
+
+// HTTP API of the loadbalancer, for tools outside Go. Every
+// response is JSON except the values of keys and the binary ring.
+// Errors carry their status and a body {"error": message}, with
+// the rpcs.Code of the failure as "code" when there is one
+//
+//	POST   /v1/forward             forward a user request {"id"}
+//	GET    /v1/members             list the members and their weights
+//	POST   /v1/members             join a started node {"id", "addr", "weight", ...}
+//	GET    /v1/members/{id}        show a member
+//	DELETE /v1/members/{id}        make a member leave
+//	PUT    /v1/members/{id}/weight reweight a member {"weight"}
+//	GET    /v1/ring?format=        dump the ring, json or binary
+//	GET    /v1/leader              show the loadbalancer leading
+//	GET    /v1/loads               show the bounded loads of the members
+//	GET    /v1/keys/{key}          read the value of a key
+//	PUT    /v1/keys/{key}          store the body as value of a key
+//	DELETE /v1/keys/{key}          delete a key
+//
+// Membership changes are handed to the leader like their RPCs
+
+// httpMember is a member of the ring as shown by the API
+type httpMember struct {
+	ID     string            `json:"id"`
+	Weight int               `json:"weight"`
+	Addr   string            `json:"addr"`
+	Addrs  []string          `json:"addrs,omitempty"`
+	Zone   string            `json:"zone,omitempty"`
+	Rack   string            `json:"rack,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// httpMembers is the list of members with the epoch of the ring
+type httpMembers struct {
+	Epoch   uint64       `json:"epoch"`
+	Members []httpMember `json:"members"`
+}
+
+// httpJoin is the body of a join
+type httpJoin struct {
+	ID     string   `json:"id"`
+	Addr   string   `json:"addr"`
+	Addrs  []string `json:"addrs,omitempty"`
+	Weight int      `json:"weight"`
+	Zone   string   `json:"zone,omitempty"`
+	Rack   string   `json:"rack,omitempty"`
+}
+
+// httpWeight is the body of a reweight
+type httpWeight struct {
+	Weight int `json:"weight"`
+}
+
+// httpForward is the body of a forward and its reply
+type httpForward struct {
+	ID     string `json:"id"`
+	Server string `json:"server,omitempty"`
+}
+
+// httpLeader is the reply of leader
+type httpLeader struct {
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+}
+
+// httpLoads is the activity of the bounded-load mode,
+// see consistent.LoadStats
+type httpLoads struct {
+	Enabled bool           `json:"enabled"`
+	Lookups uint64         `json:"lookups"`
+	Moved   uint64         `json:"moved"`
+	Loads   map[string]int `json:"loads"`
+}
+
+// httpError is the body of every error
+type httpError struct {
+	Error string    `json:"error"`
+	Code  rpcs.Code `json:"code,omitempty"`
+}
+
+// httpStatus holds the status of the errors of every code,
+// others are internal errors
+var httpStatus = map[rpcs.Code]int{
+	rpcs.CodeInvalid:     http.StatusBadRequest,
+	rpcs.CodeDuplicateID: http.StatusConflict,
+	rpcs.CodeNotMember:   http.StatusNotFound,
+	rpcs.CodeUnreachable: http.StatusBadGateway,
+	rpcs.CodeNoNodes:     http.StatusServiceUnavailable,
+	rpcs.CodeWrongOwner:  http.StatusServiceUnavailable,
+	rpcs.CodeNoLeader:    http.StatusServiceUnavailable,
+	rpcs.CodeRefused:     http.StatusConflict,
+}
+
+// handler returns the handler of the HTTP API
+func (lb *loadBalancer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/forward", lb.httpForward)
+	mux.HandleFunc("/v1/members", lb.httpMembers)
+	mux.HandleFunc("/v1/members/", lb.httpMember)
+	mux.HandleFunc("/v1/ring", lb.httpRing)
+	mux.HandleFunc("/v1/leader", lb.httpLeader)
+	mux.HandleFunc("/v1/loads", lb.httpLoads)
+	mux.HandleFunc("/v1/keys/", lb.httpKey)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no such endpoint "+r.URL.Path)
+	})
+	return mux
+}
+
+func (lb *loadBalancer) httpForward(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	body := httpForward{}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if body.ID == "" {
+		writeError(w, http.StatusBadRequest, "missing id")
+		return
+	}
+	reply := rpcs.ReqReply{}
+	if err := lb.Forward(&rpcs.ReqArgs{ID: body.ID}, &reply); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, httpForward{ID: body.ID, Server: reply.Server})
+}
+
+func (lb *loadBalancer) httpMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Read before the members like GetRing
+		list := httpMembers{Epoch: lb.ring.Epoch(), Members: []httpMember{}}
+		for _, member := range lb.ring.Members() {
+			list.Members = append(list.Members, newHTTPMember(member))
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		lb.httpJoin(w, r)
+	default:
+		allow(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (lb *loadBalancer) httpJoin(w http.ResponseWriter, r *http.Request) {
+	body := httpJoin{}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if body.ID == "" || body.Addr == "" {
+		writeError(w, http.StatusBadRequest, "missing id or addr")
+		return
+	}
+	if body.Weight < 1 {
+		writeError(w, http.StatusBadRequest, "weight must be at least 1")
+		return
+	}
+	args := rpcs.JoinArgs{
+		Addr:   body.Addr,
+		Addrs:  body.Addrs,
+		ID:     body.ID,
+		Weight: body.Weight,
+		Hasher: lb.ring.HasherName(),
+		Zone:   body.Zone,
+		Rack:   body.Rack,
+	}
+	reply := rpcs.Ack{}
+	if err := lb.Join(&args, &reply); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	// A follower may not have applied the change of the leader yet
+	member := httpMember{
+		ID:     body.ID,
+		Weight: body.Weight,
+		Addr:   body.Addr,
+		Addrs:  body.Addrs,
+		Zone:   body.Zone,
+		Rack:   body.Rack,
+	}
+	if curr := lb.ring.Member(body.ID); curr != nil {
+		member = newHTTPMember(curr)
+	}
+	writeJSON(w, http.StatusCreated, member)
+}
+
+// httpMember serves /v1/members/{id} and /v1/members/{id}/weight
+func (lb *loadBalancer) httpMember(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/members/")
+	id, sub := path, ""
+	if slash := strings.Index(path, "/"); slash >= 0 {
+		id, sub = path[:slash], path[slash+1:]
+	}
+	if id == "" || (sub != "" && sub != "weight") {
+		writeError(w, http.StatusNotFound, "no such endpoint "+r.URL.Path)
+		return
+	}
+	if sub == "weight" {
+		lb.httpReweight(w, r, id)
+		return
+	}
+	member := lb.ring.Member(id)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if member == nil {
+			writeRPCError(w, rpcs.Errorf(rpcs.CodeNotMember, "%s is not a member", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, newHTTPMember(member))
+	case http.MethodDelete:
+		if member == nil {
+			writeRPCError(w, rpcs.Errorf(rpcs.CodeNotMember, "%s is not a member", id))
+			return
+		}
+		reply := rpcs.Ack{}
+		if err := lb.Leave(&rpcs.LeaveArgs{ID: id}, &reply); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newHTTPMember(member))
+	default:
+		allow(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (lb *loadBalancer) httpReweight(w http.ResponseWriter, r *http.Request, id string) {
+	if !allow(w, r, http.MethodPut) {
+		return
+	}
+	body := httpWeight{}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	member := lb.ring.Member(id)
+	if member == nil {
+		writeRPCError(w, rpcs.Errorf(rpcs.CodeNotMember, "%s is not a member", id))
+		return
+	}
+	reply := rpcs.Ack{}
+	if err := lb.Reweight(&rpcs.ReweightArgs{ID: id, Weight: body.Weight}, &reply); err != nil {
+		writeRPCError(w, err)
+		return
+	}
+	updated := newHTTPMember(member)
+	updated.Weight = body.Weight
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func (lb *loadBalancer) httpRing(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	reply := rpcs.ExportReply{}
+	if err := lb.ExportRing(&rpcs.ExportArgs{Format: format}, &reply); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format == consistent.FormatBinary {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(reply.Data)
+}
+
+func (lb *loadBalancer) httpLeader(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	reply := rpcs.LeaderReply{}
+	lb.Leader(&rpcs.Ack{}, &reply)
+	writeJSON(w, http.StatusOK, httpLeader{Leader: reply.Leader, Term: reply.Term})
+}
+
+func (lb *loadBalancer) httpLoads(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	stats := lb.ring.LoadStats()
+	loads := httpLoads{
+		Enabled: lb.ring.BoundedLoad(),
+		Lookups: stats.Lookups,
+		Moved:   stats.Moved,
+		Loads:   stats.Loads,
+	}
+	if loads.Loads == nil {
+		loads.Loads = map[string]int{}
+	}
+	writeJSON(w, http.StatusOK, loads)
+}
+
+// httpKey serves the value of a key as raw bytes
+func (lb *loadBalancer) httpKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	if key == "" {
+		writeError(w, http.StatusNotFound, "missing key")
+		return
+	}
+	if !allow(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		reply := rpcs.KVReply{}
+		if err := lb.Get(&rpcs.KVArgs{Key: key}, &reply); err != nil {
+			writeRPCError(w, err)
+			return
+		} else if !reply.Found {
+			writeError(w, http.StatusNotFound, key+" not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(reply.Value)
+	case http.MethodPut:
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		reply := rpcs.Ack{}
+		if err := lb.Put(&rpcs.KVArgs{Key: key, Value: value}, &reply); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		reply := rpcs.Ack{}
+		if err := lb.Delete(&rpcs.KVArgs{Key: key}, &reply); err != nil {
+			writeRPCError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newHTTPMember returns the member as shown by the API
+func newHTTPMember(member *consistent.CNode) httpMember {
+	return httpMember{
+		ID:     member.Key,
+		Weight: member.Weight,
+		Addr:   member.Meta[transport.MetaAddr],
+		Addrs:  transport.Addrs(member.Meta),
+		Zone:   member.Meta[consistent.MetaZone],
+		Rack:   member.Meta[consistent.MetaRack],
+		Meta:   member.Meta,
+	}
+}
+
+// allow tells whether the method of r is one of methods,
+// it answers 405 otherwise. GET allows HEAD as well
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method || (r.Method == http.MethodHead && method == http.MethodGet) {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+	return false
+}
+
+// readJSON decodes the body of r into v, it answers 400 if
+// the body is not a single JSON object of the expected fields
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprint("invalid body: ", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// Fails only once the client went away
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, httpError{Error: msg})
+}
+
+// writeRPCError answers with the status of the code of err
+func writeRPCError(w http.ResponseWriter, err error) {
+	e := rpcs.FromError(err)
+	status, exist := httpStatus[e.Code]
+	if !exist {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, httpError{Error: e.Message, Code: e.Code})
+}
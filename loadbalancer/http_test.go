@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"conhash/transport"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serve sends a request to the HTTP API of the loadbalancer
+func (c *cluster) serve(method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.lb.handler().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// decode decodes the JSON body of w into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q", ct)
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	c := newCluster(t, Config{})
+	for walk := 0; walk < 3; walk++ {
+		c.join("n"+strconv.Itoa(walk), 2, "")
+	}
+	// n0 at the address of n1
+	duplicate := `{"id": "n0", "addr": "` + c.lb.ring.Member("n1").Meta[transport.MetaAddr] + `", "weight": 1}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   rpcs.Code
+	}{
+		{"unknown endpoint", http.MethodGet, "/v2/members", "", http.StatusNotFound, ""},
+		{"forward", http.MethodPost, "/v1/forward", `{"id": "user-1"}`, http.StatusOK, ""},
+		{"forward method", http.MethodGet, "/v1/forward", "", http.StatusMethodNotAllowed, ""},
+		{"forward without id", http.MethodPost, "/v1/forward", `{}`, http.StatusBadRequest, ""},
+		{"forward unknown field", http.MethodPost, "/v1/forward", `{"id": "u", "user": "u"}`, http.StatusBadRequest, ""},
+		{"forward malformed", http.MethodPost, "/v1/forward", `{"id":`, http.StatusBadRequest, ""},
+		{"members", http.MethodGet, "/v1/members", "", http.StatusOK, ""},
+		{"members method", http.MethodPut, "/v1/members", "", http.StatusMethodNotAllowed, ""},
+		{"join without addr", http.MethodPost, "/v1/members", `{"id": "n9", "weight": 1}`, http.StatusBadRequest, ""},
+		{"join without weight", http.MethodPost, "/v1/members", `{"id": "n9", "addr": "127.0.0.1:1"}`, http.StatusBadRequest, ""},
+		{"join duplicate", http.MethodPost, "/v1/members", duplicate, http.StatusConflict, rpcs.CodeDuplicateID},
+		{"join unreachable", http.MethodPost, "/v1/members", `{"id": "n9", "addr": "127.0.0.1:1", "weight": 1}`, http.StatusBadGateway, rpcs.CodeUnreachable},
+		{"member", http.MethodGet, "/v1/members/n0", "", http.StatusOK, ""},
+		{"member missing", http.MethodGet, "/v1/members/n9", "", http.StatusNotFound, rpcs.CodeNotMember},
+		{"member method", http.MethodPost, "/v1/members/n0", "", http.StatusMethodNotAllowed, ""},
+		{"member subpath", http.MethodGet, "/v1/members/n0/zone", "", http.StatusNotFound, ""},
+		{"leave missing", http.MethodDelete, "/v1/members/n9", "", http.StatusNotFound, rpcs.CodeNotMember},
+		{"reweight", http.MethodPut, "/v1/members/n0/weight", `{"weight": 3}`, http.StatusOK, ""},
+		{"reweight method", http.MethodGet, "/v1/members/n0/weight", "", http.StatusMethodNotAllowed, ""},
+		{"reweight to zero", http.MethodPut, "/v1/members/n0/weight", `{"weight": 0}`, http.StatusBadRequest, rpcs.CodeInvalid},
+		{"reweight missing", http.MethodPut, "/v1/members/n9/weight", `{"weight": 3}`, http.StatusNotFound, rpcs.CodeNotMember},
+		{"ring", http.MethodGet, "/v1/ring", "", http.StatusOK, ""},
+		{"ring binary", http.MethodGet, "/v1/ring?format=binary", "", http.StatusOK, ""},
+		{"ring format", http.MethodGet, "/v1/ring?format=yaml", "", http.StatusBadRequest, ""},
+		{"ring method", http.MethodPost, "/v1/ring", "", http.StatusMethodNotAllowed, ""},
+		{"leader", http.MethodGet, "/v1/leader", "", http.StatusOK, ""},
+		{"loads", http.MethodGet, "/v1/loads", "", http.StatusOK, ""},
+		{"loads method", http.MethodDelete, "/v1/loads", "", http.StatusMethodNotAllowed, ""},
+		{"put key", http.MethodPut, "/v1/keys/k", "v", http.StatusNoContent, ""},
+		{"get key", http.MethodGet, "/v1/keys/k", "", http.StatusOK, ""},
+		{"delete key", http.MethodDelete, "/v1/keys/k", "", http.StatusNoContent, ""},
+		{"get deleted key", http.MethodGet, "/v1/keys/k", "", http.StatusNotFound, ""},
+		{"key method", http.MethodPost, "/v1/keys/k", "v", http.StatusMethodNotAllowed, ""},
+		{"key missing", http.MethodGet, "/v1/keys/", "", http.StatusNotFound, ""},
+		{"leave", http.MethodDelete, "/v1/members/n2", "", http.StatusOK, ""},
+		{"leave of the last two", http.MethodDelete, "/v1/members/n1", "", http.StatusConflict, rpcs.CodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := c.serve(tt.method, tt.path, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("%s %s answered %d, want %d: %s", tt.method, tt.path, w.Code, tt.status, w.Body)
+			}
+			if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+				t.Fatal("405 without Allow")
+			}
+			if w.Code < 400 {
+				return
+			}
+			body := httpError{}
+			decode(t, w, &body)
+			if body.Error == "" || body.Code != tt.code {
+				t.Fatalf("error body %+v, want code %q", body, tt.code)
+			}
+		})
+	}
+}
+
+func TestHTTPBodies(t *testing.T) {
+	c := newCluster(t, Config{})
+	for walk := 0; walk < 3; walk++ {
+		c.join("n"+strconv.Itoa(walk), 2, "z"+strconv.Itoa(walk))
+	}
+
+	members := httpMembers{}
+	decode(t, c.serve(http.MethodGet, "/v1/members", ""), &members)
+	if members.Epoch != c.lb.ring.Epoch() || len(members.Members) != 3 {
+		t.Fatalf("members %+v", members)
+	}
+	for _, member := range members.Members {
+		if member.Weight != 2 || member.Addr == "" || member.Zone != "z"+member.ID[1:] {
+			t.Fatalf("member %+v", member)
+		}
+	}
+
+	member := httpMember{}
+	decode(t, c.serve(http.MethodPut, "/v1/members/n1/weight", `{"weight": 4}`), &member)
+	if member.ID != "n1" || member.Weight != 4 || c.lb.ring.Member("n1").Weight != 4 {
+		t.Fatalf("reweighted member %+v", member)
+	}
+
+	forward := httpForward{}
+	decode(t, c.serve(http.MethodPost, "/v1/forward", `{"id": "user-7"}`), &forward)
+	if want := c.lb.ring.GetNext("user-7").ParentKey; forward.ID != "user-7" || forward.Server != want {
+		t.Fatalf("forward %+v, want server %s", forward, want)
+	}
+
+	leader := httpLeader{}
+	decode(t, c.serve(http.MethodGet, "/v1/leader", ""), &leader)
+	if leader.Leader != c.lb.addr || leader.Term == 0 {
+		t.Fatalf("leader %+v", leader)
+	}
+
+	loads := httpLoads{}
+	decode(t, c.serve(http.MethodGet, "/v1/loads", ""), &loads)
+	if loads.Enabled || loads.Loads == nil {
+		t.Fatalf("loads %+v without bounded loads", loads)
+	}
+
+	w := c.serve(http.MethodPut, "/v1/keys/user-7", "value")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("put answered %d", w.Code)
+	}
+	w = c.serve(http.MethodGet, "/v1/keys/user-7", "")
+	if w.Body.String() != "value" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("get answered %q as %s", w.Body, w.Header().Get("Content-Type"))
+	}
+
+	for _, format := range []string{consistent.FormatJSON, consistent.FormatBinary} {
+		w := c.serve(http.MethodGet, "/v1/ring?format="+format, "")
+		snap, err := consistent.DecodeSnapshot(format, w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s ring: %v", format, err)
+		}
+		if snap.Epoch != c.lb.ring.Epoch() || len(snap.Members) != 3 {
+			t.Fatalf("%s ring of epoch %d with %d members", format, snap.Epoch, len(snap.Members))
+		}
+	}
+
+	member = httpMember{}
+	decode(t, c.serve(http.MethodDelete, "/v1/members/n2", ""), &member)
+	if member.ID != "n2" || c.lb.ring.Member("n2") != nil {
+		t.Fatalf("left member %+v", member)
+	}
+}
+
+func TestHTTPNoNodes(t *testing.T) {
+	c := newCluster(t, Config{})
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		w := c.serve(method, "/v1/keys/k", "v")
+		body := httpError{}
+		decode(t, w, &body)
+		if w.Code != http.StatusServiceUnavailable || body.Code != rpcs.CodeNoNodes {
+			t.Fatalf("%s /v1/keys/k on an empty ring answered %d %+v", method, w.Code, body)
+		}
+	}
+	members := httpMembers{}
+	decode(t, c.serve(http.MethodGet, "/v1/members", ""), &members)
+	if members.Members == nil || len(members.Members) != 0 {
+		t.Fatalf("members of an empty ring %+v", members)
+	}
+}
+
+func TestWriteRPCError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{rpcs.Errorf(rpcs.CodeInvalid, "bad"), http.StatusBadRequest},
+		{rpcs.Errorf(rpcs.CodeDuplicateID, "taken"), http.StatusConflict},
+		{rpcs.Errorf(rpcs.CodeNotMember, "gone"), http.StatusNotFound},
+		{rpcs.Errorf(rpcs.CodeUnreachable, "down"), http.StatusBadGateway},
+		{rpcs.Errorf(rpcs.CodeNoNodes, "empty"), http.StatusServiceUnavailable},
+		{rpcs.Errorf(rpcs.CodeWrongOwner, "moved"), http.StatusServiceUnavailable},
+		{rpcs.Errorf(rpcs.CodeNoLeader, "election"), http.StatusServiceUnavailable},
+		{rpcs.Errorf(rpcs.CodeRefused, "last two"), http.StatusConflict},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeRPCError(w, tt.err)
+		body := httpError{}
+		decode(t, w, &body)
+		if w.Code != tt.status || body.Code != rpcs.FromError(tt.err).Code || body.Error == "" {
+			t.Errorf("%v answered %d %+v, want %d", tt.err, w.Code, body, tt.status)
+		}
+	}
+}
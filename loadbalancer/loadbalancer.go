@@ -2,266 +2,1009 @@ package loadbalancer
 
 import (
 	"conhash/consistent"
+	"conhash/gossip"
+	"conhash/raft"
 	"conhash/rpcs"
+	"conhash/transport"
+	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/rpc"
-	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // loadBalancer struct maintains the variables
 // required for consistent hashing
 type loadBalancer struct {
-	listener net.Listener // RPC listener of load balancer ...
-	ring     consistent.CRing
-	joinCh   chan joinEx
-	reqCh    chan requestEx
-	leaveCh  chan leaveEx
+	listener   net.Listener // RPC listener of load balancer ...
+	ring       *consistent.CRing
+	hasher     consistent.Hasher
+	algorithm  string          // name of the placement algorithm of keys
+	place      atomic.Value    // consistent.Ring placing keys, unset for the ring algorithm
+	factor     int             // replication factor, primary included
+	pool       *transport.Pool // connections to the nodes of the ring
+	transport  transport.Transport
+	timeout    time.Duration   // time a request may take on one node
+	callWait   time.Duration   // time any other call to a node may take
+	ctx        context.Context // cancelled when the loadbalancer is closed
+	cancel     context.CancelFunc
+	health     *health       // failure detector, nil if disabled
+	done       chan struct{} // closed when the loadbalancer is closed
+	joinCh     chan joinChange
+	leaveCh    chan leaveChange
+	reweightCh chan reweightChange
+	failCh     chan leaveEx
+
+	gossip   *gossip.Memberlist
+	deadMu   sync.Mutex      // guards dead
+	dead     map[string]bool // nodes found dead, they may join again
+	addr     string          // address advertised in the gossip
+	interval time.Duration   // gossip protocol period
+	raft     *raft.Raft      // replicates the membership log
+	peers    []string
+	election time.Duration // election timeout of the raft
+	raftDir  string
+	snapshot int // changes kept in the log before a snapshot
+
+	ringFile   string // file the ring is written to on change
+	ringFormat string
+
+	httpAddr string       // address of the HTTP API, disabled if empty
+	http     *http.Server // serves the HTTP API, nil if disabled
+	logger   *slog.Logger
+}
+
+// Config contains the settings of a loadbalancer
+type Config struct {
+	Hasher     consistent.Hasher // hash function of the ring, Sha256 if nil
+	LoadFactor float64           // capacity factor of bounded loads of reads, 0 disables them
+	// Algorithm places keys on the members of the ring, see
+	// consistent.NewAlgorithm, consistent.AlgoRing if empty. The
+	// ring hands hash ranges over when members change, the others
+	// make every node move the states it holds instead
+	Algorithm string
+	// ReplicationFactor is the number of distinct members holding
+	// every state, primary included. It defaults to 2
+	ReplicationFactor int
+	// HealthInterval is the time between two probes of every
+	// node, 0 disables failure detection
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration // time a probe may take, HealthInterval if 0
+	SuspectAfter   int           // failed probes before a node is suspected, 1 if 0
+	DeadAfter      int           // failed probes before a node is removed, 3 if 0
+	RecoverAfter   int           // probes in a row a suspect must pass, 2 if 0
+	// RequestTimeout is the time a request may take on one node
+	// before reads fail over to a replica, 0 waits for the node
+	RequestTimeout time.Duration
+	// CallTimeout is the time any other call to a node may take,
+	// such as handing over ranges while the ring changes. It
+	// defaults to 10 seconds
+	CallTimeout time.Duration
+	// Addr is the host:port advertised to the nodes in the
+	// gossip, ":port" if empty
+	Addr           string
+	GossipInterval time.Duration // gossip protocol period, a second if 0
+	// Peers are the addresses of the other loadbalancers sharing
+	// the ring. Membership changes are entries of a log replicated
+	// by their raft leader while any of them serves requests
+	Peers           []string
+	ElectionTimeout time.Duration // raft election timeout, a second if 0
+	RaftDir         string        // directory of the raft state, memory only if empty
+	// SnapshotThreshold is the number of changes kept in the
+	// membership log before it is compacted, 256 if 0
+	SnapshotThreshold int
+	// RingFile is written with a snapshot of the ring on every
+	// change. A loadbalancer without peers nor RaftDir loads the
+	// ring from it on start, others get the ring from the raft
+	// log. Empty disables it
+	RingFile   string
+	RingFormat string // format of RingFile, consistent.FormatJSON if empty
+	// Transport carries the RPCs of the loadbalancer, its peers
+	// and the nodes. It defaults to net/rpc
+	Transport transport.Transport
+	// HTTPAddr is the address the HTTP/JSON API listens on, see
+	// http.go. Empty disables it
+	HTTPAddr string
+	// Logger receives the diagnostics of the loadbalancer and of
+	// its ring, slog.Default() if nil
+	Logger *slog.Logger
 }
 
 // New returns a new instance of loadbalancer but does
 // not start it
-func New() LoadBalancer {
-	return &loadBalancer{
-		joinCh:  make(chan joinEx),
-		reqCh:   make(chan requestEx),
-		leaveCh: make(chan leaveEx),
-		ring:    *consistent.NewRing(),
+func New(config Config) (LoadBalancer, error) {
+	if config.Transport == nil {
+		config.Transport = transport.NetRPC()
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	config.Logger = config.Logger.With("component", "loadbalancer")
+	if config.Hasher == nil {
+		config.Hasher = consistent.DefaultHasher()
+	}
+	if config.Algorithm == "" {
+		config.Algorithm = consistent.AlgoRing
 	}
+	if _, err := consistent.NewAlgorithm(config.Algorithm, config.Hasher); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ring := consistent.NewRing(config.Hasher)
+	if config.LoadFactor > 0 {
+		ring.EnableBoundedLoad(config.LoadFactor)
+	}
+	ring.SetLogger(config.Logger)
+	lb := &loadBalancer{
+		joinCh:     make(chan joinChange),
+		leaveCh:    make(chan leaveChange),
+		reweightCh: make(chan reweightChange),
+		failCh:     make(chan leaveEx),
+		done:       make(chan struct{}),
+		dead:       make(map[string]bool),
+		ring:       ring,
+		hasher:     config.Hasher,
+		algorithm:  config.Algorithm,
+		pool:       transport.NewPoolWith(config.Transport),
+		transport:  config.Transport,
+		health:     newHealth(config),
+		timeout:    config.RequestTimeout,
+		callWait:   config.CallTimeout,
+		ctx:        ctx,
+		cancel:     cancel,
+		factor:     config.ReplicationFactor,
+		addr:       config.Addr,
+		interval:   config.GossipInterval,
+		peers:      config.Peers,
+		election:   config.ElectionTimeout,
+		raftDir:    config.RaftDir,
+		snapshot:   config.SnapshotThreshold,
+		ringFile:   config.RingFile,
+		ringFormat: config.RingFormat,
+		httpAddr:   config.HTTPAddr,
+		logger:     config.Logger,
+	}
+	if lb.ringFormat == "" {
+		lb.ringFormat = consistent.FormatJSON
+	} else if lb.ringFormat != consistent.FormatJSON && lb.ringFormat != consistent.FormatBinary {
+		return nil, fmt.Errorf("unknown ring format %q", lb.ringFormat)
+	}
+	if lb.factor <= 0 {
+		lb.factor = 2
+	}
+	if lb.callWait <= 0 {
+		lb.callWait = defaultCallTimeout
+	}
+	lb.updatePlacement()
+	return lb, nil
 }
 
 // StartLB starts the RPC server for Loadbalancer and
 // launches appropriate go routines to serve nodes and UE
 func (lb *loadBalancer) StartLB(port int) error {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	listener, err := transport.Listen(transport.PortAddr(port))
 	if err != nil {
 		return err
 	}
 	lb.listener = listener
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(rpcs.WrapLoadBalancer(lb))
-	rpcServer.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	go http.Serve(listener, nil)
+	if lb.addr == "" {
+		lb.addr = transport.PortAddr(port)
+	}
+	if err := lb.loadRing(); err != nil {
+		listener.Close()
+		return err
+	}
+	lb.raft, err = raft.New(raft.Config{
+		ID:                lb.addr,
+		Peers:             lb.peers,
+		ElectionTimeout:   lb.election,
+		Dir:               lb.raftDir,
+		SnapshotThreshold: lb.snapshot,
+		Apply:             lb.apply,
+		Snapshot:          lb.snapshotRing,
+		Restore:           lb.restoreRing,
+		Transport:         lb.transport,
+		Logger:            lb.logger.With("subsystem", "raft"),
+	})
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	lb.gossip = gossip.New(gossip.Config{
+		Name:     "lb@" + lb.addr,
+		Addrs:    []string{lb.addr},
+		Meta:     map[string]string{gossip.MetaRole: gossip.RoleLB},
+		Interval: lb.interval,
+		Notify:   lb.observe,
+
+		Transport: lb.transport,
+		Logger:    lb.logger.With("subsystem", "gossip"),
+	})
+	server := lb.transport.NewServer()
+	server.RegisterName("LoadBalancer", rpcs.WrapLoadBalancer(lb))
+	lb.gossip.Register(server)
+	lb.raft.Register(server)
+	if lb.httpAddr != "" {
+		httpListener, err := transport.Listen(lb.httpAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		lb.http = &http.Server{Handler: lb.handler()}
+		go lb.http.Serve(httpListener)
+	}
+	go server.Serve(listener)
 	go lb.handleRequests()
+	lb.raft.Start()
+	lb.gossip.Start()
+	if len(lb.peers) > 0 {
+		if err := lb.gossip.Join(lb.peers); err != nil {
+			lb.logger.Warn("unable to join gossip", "err", err)
+		}
+	}
+	if lb.health != nil {
+		go lb.monitor()
+	}
 	return nil
 }
 
 // Close closes all go routines and connections
 func (lb *loadBalancer) Close() {
+	close(lb.done)
+	lb.cancel()
+	lb.raft.Stop()
+	lb.gossip.Leave()
 	lb.listener.Close()
+	if lb.http != nil {
+		lb.http.Close()
+	}
+	lb.pool.Close()
 }
 
+// errClosed fails the changes requested once the
+// loadbalancer is closed
+var errClosed = rpcs.Errorf(rpcs.CodeNoLeader, "loadbalancer is closed")
+
+// defaultCallTimeout is the time a call to a node may take
+// unless configured otherwise
+const defaultCallTimeout = 10 * time.Second
+
+// call invokes method on the node owning the ring entry, it
+// gives up after the call timeout
+func (lb *loadBalancer) call(node *consistent.CNode, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := lb.context(lb.callWait)
+	defer cancel()
+	return lb.pool.CallContext(ctx, transport.Addrs(node.Meta), method, args, reply)
+}
+
+// context returns the context of a call, done after timeout
+// or once the loadbalancer is closed. 0 sets no deadline
+func (lb *loadBalancer) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(lb.ctx)
+	}
+	return context.WithTimeout(lb.ctx, timeout)
+}
+
+// repNode returns the replication info of the ring entry
+func repNode(node *consistent.CNode) rpcs.RepNode {
+	return rpcs.RepNode{
+		ParentKey: node.ParentKey,
+		Key:       node.Key,
+		Addr:      node.Meta[transport.MetaAddr],
+		Addrs:     transport.Addrs(node.Meta),
+		Zone:      node.Meta[consistent.MetaZone],
+		Rack:      node.Meta[consistent.MetaRack],
+	}
+}
+
+// Join adds a node to the ring. Errors are rpcs.Error, such
+// as CodeDuplicateID or CodeUnreachable
 func (lb *loadBalancer) Join(args *rpcs.JoinArgs, reply *rpcs.Ack) error {
-	ex := joinEx{args: args, rep: make(chan rpcs.Ack)}
-	lb.joinCh <- ex
-	*reply = <-ex.rep
-	return nil
+	if handled, err := lb.redirect("LoadBalancer.Join", args, reply); handled {
+		return err
+	}
+	ex := joinChange{args: args, rep: make(chan error)}
+	select {
+	case lb.joinCh <- ex:
+	case <-lb.done:
+		return ack(reply, errClosed)
+	}
+	return ack(reply, <-ex.rep)
 }
 
-func (lb *loadBalancer) Forward(args *rpcs.ReqArgs, reply *rpcs.Ack) error {
-	ex := requestEx{args: args, rep: make(chan rpcs.Ack)}
-	lb.reqCh <- ex
-	*reply = <-ex.rep
-	return nil
+// Forward is served concurrently with the other RPCs, the
+// ring never blocks readers while nodes join or leave
+func (lb *loadBalancer) Forward(args *rpcs.ReqArgs, reply *rpcs.ReqReply) error {
+	rep, err := lb.forward(args)
+	*reply = rep
+	return err
 }
 
+// Put stores the value of a key on its owner
+func (lb *loadBalancer) Put(args *rpcs.KVArgs, reply *rpcs.Ack) error {
+	_, err := lb.send(args.Key, false, &args.NodeID, &args.Epoch, "Node.Put", args, reply)
+	return err
+}
+
+// Get reads the value of a key from its owner
+func (lb *loadBalancer) Get(args *rpcs.KVArgs, reply *rpcs.KVReply) error {
+	server, err := lb.send(args.Key, true, &args.NodeID, &args.Epoch, "Node.Get", args, reply)
+	reply.Server = server
+	return err
+}
+
+// Delete removes a key from its owner and replicas
+func (lb *loadBalancer) Delete(args *rpcs.KVArgs, reply *rpcs.Ack) error {
+	_, err := lb.send(args.Key, false, &args.NodeID, &args.Epoch, "Node.Delete", args, reply)
+	return err
+}
+
+// Leave removes a member from the ring once its ranges are
+// handed over. Errors are rpcs.Error, such as CodeNotMember
 func (lb *loadBalancer) Leave(args *rpcs.LeaveArgs, reply *rpcs.Ack) error {
-	ex := leaveEx{args: args, rep: make(chan rpcs.Ack)}
-	lb.leaveCh <- ex
-	*reply = <-ex.rep
-	return nil
+	if handled, err := lb.redirect("LoadBalancer.Leave", args, reply); handled {
+		return err
+	}
+	ex := leaveChange{args: args, rep: make(chan error)}
+	select {
+	case lb.leaveCh <- ex:
+	case <-lb.done:
+		return ack(reply, errClosed)
+	}
+	return ack(reply, <-ex.rep)
 }
 
+func (lb *loadBalancer) Reweight(args *rpcs.ReweightArgs, reply *rpcs.Ack) error {
+	if handled, err := lb.redirect("LoadBalancer.Reweight", args, reply); handled {
+		return err
+	}
+	ex := reweightChange{args: args, rep: make(chan error)}
+	select {
+	case lb.reweightCh <- ex:
+	case <-lb.done:
+		return ack(reply, errClosed)
+	}
+	return ack(reply, <-ex.rep)
+}
+
+// ack sets reply after the outcome of a change and returns err
+func ack(reply *rpcs.Ack, err error) error {
+	*reply = rpcs.Ack{Success: err == nil}
+	return err
+}
+
+// handleRequests applies the membership changes one at a
+// time until the loadbalancer is closed
 func (lb *loadBalancer) handleRequests() {
-	fmt.Println("LB ready to serve...")
+	lb.logger.Info("ready to serve", "addr", lb.addr)
 	for {
 		select {
+		case <-lb.done:
+			return
+
 		case ex := <-lb.joinCh:
 			// Joining Node
-			rep := lb.joinNode(ex.args)
-			lb.assignReplicas(ex.args.ID)
-			lb.lookupKeys(ex.args.ID)
-
-			// Previous Node
-			lb.assignPrev(ex.args.ID)
+			before := lb.replication()
+			rejoin, err := lb.joinNode(ex.args)
+			if err != nil {
+				lb.logger.Warn("join failed", "node", ex.args.ID, "err", err)
+				ex.rep <- err
+				continue
+			}
+			if stale := lb.wasDead(ex.args.ID, true); stale && !rejoin {
+				// Its states are stale, it fetches them afresh
+				lb.removeStates(lb.ring.Member(ex.args.ID), rpcs.RemoveAll{All: true})
+			}
+			if lb.placed() {
+				lb.rebalance(ex.args.ID, nil)
+				ex.rep <- nil
+				continue
+			}
+			if rejoin {
+				// The ring did not change, only the node has to catch
+				// up on its ranges and learn its replicas
+				lb.resync(ex.args.ID)
+				lb.assignReplicas(ex.args.ID)
+				ex.rep <- nil
+				continue
+			}
 
-			// Next Node
-			// Delete Keys
-			lb.removeKeys(ex.args.ID)
+			// The node replicates the states it fetched, members now
+			// replicating to it copy theirs and others drop them
+			moves := lb.lookupKeys(ex.args.ID)
+			lb.dropRanges(before, moves)
+			lb.handOver(before, ex.args.ID)
 			lb.ring.Display()
-			ex.rep <- rep
-
-		case ex := <-lb.reqCh:
-			ex.rep <- lb.forward(ex.args)
+			ex.rep <- nil
 
 		case ex := <-lb.leaveCh:
-			fmt.Println("Leave request received for", ex.args.ID)
-			lb.leaveNode(ex.args.ID)
+			lb.logger.Info("leave requested", "node", ex.args.ID)
+			err := lb.leaveNode(ex.args.ID)
+			if err != nil {
+				lb.logger.Warn("leave failed", "node", ex.args.ID, "err", err)
+			}
+			ex.rep <- err
+			lb.ring.Display()
+
+		case ex := <-lb.failCh:
+			lb.logger.Warn("failing over node", "node", ex.args.ID)
+			lb.failNode(ex.args.ID)
 			ex.rep <- rpcs.Ack{Success: true}
 			lb.ring.Display()
+
+		case ex := <-lb.reweightCh:
+			lb.logger.Info("reweight requested", "node", ex.args.ID, "weight", ex.args.Weight)
+			err := lb.reweightNode(ex.args)
+			if err != nil {
+				lb.logger.Warn("reweight failed", "node", ex.args.ID, "err", err)
+			}
+			ex.rep <- err
+			lb.ring.Display()
+
 		}
 	}
 }
 
-func (lb *loadBalancer) replaceReplica(key string) {
+// virtuals returns the virtual nodes of the member key
+func (lb *loadBalancer) virtuals(key string) []*consistent.CNode {
+	var virtuals []*consistent.CNode
+
 	node := lb.ring.GetNext(key)
 	walk := 0
-
-	for walk != node.Weight {
+	for node != nil && walk != node.Weight {
 		node = lb.ring.GetNext(lb.ring.GetVirKey(key, walk))
-		prev := lb.ring.GetPrevParent(node)
-		next := lb.ring.GetNextExcept(node, prev.ParentKey)
+		virtuals = append(virtuals, node)
+		walk++
+	}
+	return virtuals
+}
 
-		args := rpcs.ReplaceArgs{
-			Old: node.Key,
-			New: rpcs.RepNode{
-				Key:       next.Key,
-				ParentKey: next.ParentKey,
-				Port:      next.Port,
-			},
+func (lb *loadBalancer) leaveNode(key string) error {
+	// virtuals of a key outside the ring are those of others
+	if lb.ring.Member(key) == nil {
+		return rpcs.Errorf(rpcs.CodeNotMember, "%s is not a member", key)
+	}
+	virtuals := lb.virtuals(key)
+	if lb.ring.Size() <= 2 {
+		return rpcs.Errorf(rpcs.CodeRefused, "%s is one of the last 2 members", key)
+	}
+	if lb.placed() {
+		member := lb.ring.Member(key)
+		if err := lb.commitChange(opRemove, rpcs.RingMember{Key: key}); err != nil {
+			return err
 		}
-		reply := rpcs.Ack{}
-
-		// Send via RPC
-		err := prev.Conn.Call("Node.Replace", &args, &reply)
-		if err != nil {
-			fmt.Println("Cannot Call RPC")
-			return
+		lb.rebalance("", member)
+		for _, addr := range transport.Addrs(member.Meta) {
+			lb.pool.Drop(addr)
 		}
+		return nil
+	}
 
-		fmt.Println("For node", prev.Key, "replace", node.Key, "with", next.Key)
-		walk++
+	before := lb.replication()
+	if err := lb.commitChange(opRemove, rpcs.RingMember{Key: key}); err != nil {
+		return err
+	}
+	// The member hands its ranges over itself, its replicas
+	// only cover for it once it is gone already
+	lb.takeOver(before, virtuals, true)
+	for _, addr := range transport.Addrs(virtuals[0].Meta) {
+		lb.pool.Drop(addr)
 	}
+	return nil
 }
 
-func (lb *loadBalancer) leaveNode(key string) {
-	if lb.ring.Size() <= 2 {
+// failNode removes a member that stopped answering. The members
+// holding replicas of its ranges promote them to the members now
+// owning the ranges, just like on leave
+func (lb *loadBalancer) failNode(key string) {
+	// It may have left in the meantime
+	if lb.ring.Member(key) == nil {
+		return
+	}
+	virtuals := lb.virtuals(key)
+	before := lb.replication()
+	for _, addr := range transport.Addrs(virtuals[0].Meta) {
+		lb.pool.Drop(addr)
+	}
+	if err := lb.commitChange(opRemove, rpcs.RingMember{Key: key}); err != nil {
+		lb.logger.Error("unable to remove node", "node", key, "err", err)
 		return
 	}
+	lb.markDead(key)
+	if lb.placed() {
+		lb.rebalance("", nil)
+		return
+	}
+	lb.takeOver(before, virtuals, false)
+}
 
-	lb.replaceReplica(key)
+// reweightNode adds or removes only the virtual nodes making up
+// the difference of weight and moves the affected hash ranges
+func (lb *loadBalancer) reweightNode(args *rpcs.ReweightArgs) error {
+	member := lb.ring.Member(args.ID)
+	if member == nil {
+		return rpcs.Errorf(rpcs.CodeNotMember, "%s is not a member", args.ID)
+	} else if args.Weight < 1 {
+		return rpcs.Errorf(rpcs.CodeInvalid, "weight %d is below 1", args.Weight)
+	} else if member.Weight == args.Weight {
+		return nil
+	}
 
-	node := lb.ring.GetNext(key)
-	walk := 0
+	// The ranges of new virtual nodes are taken over from
+	// the virtual nodes owning their hashes so far
+	before := lb.replication()
+	var removed, sources []*consistent.CNode
+	for walk := args.Weight; walk < member.Weight; walk++ {
+		removed = append(removed, lb.ring.GetNext(lb.ring.GetVirKey(args.ID, walk)))
+	}
+	for walk := member.Weight; walk < args.Weight; walk++ {
+		sources = append(sources, lb.ring.GetNext(lb.ring.GetVirKey(args.ID, walk)))
+	}
 
-	for walk != node.Weight {
-		node = lb.ring.GetNext(lb.ring.GetVirKey(key, walk))
-		prev := lb.ring.GetPrevParent(node)
+	change := rpcs.RingMember{
+		Key:    args.ID,
+		Weight: args.Weight,
+		Meta:   member.Meta,
+	}
+	if err := lb.commitChange(opReweight, change); err != nil {
+		return err
+	}
+	// The node gossips its new weight to the others
+	reply := rpcs.Ack{}
+	if err := lb.call(member, "Node.Reweight", args, &reply); err != nil {
+		lb.logger.Error("cannot call Node.Reweight", "node", args.ID, "err", err)
+	}
+	if lb.placed() {
+		lb.rebalance("", nil)
+		return nil
+	}
 
-		args := rpcs.CopyArgs{
-			Target: node.Key,
+	var moves []rangeMove
+	for walk, src := range sources {
+		node := lb.ring.GetNext(lb.ring.GetVirKey(args.ID, member.Weight+walk))
+		move, ok := lb.lookupVirtual(node, src)
+		if !ok {
+			break
 		}
-		reply := rpcs.Ack{}
+		moves = append(moves, move)
+	}
+	lb.dropRanges(before, moves)
+	lb.takeOver(before, removed, true, args.ID)
+	return nil
+}
 
-		// Send via RPC
-		err := prev.Conn.Call("Node.Copy", &args, &reply)
-		if err != nil {
-			fmt.Println("Cannot Call RPC Node.Copy")
-			return
+// replication returns the replicas of every virtual node
+// of the ring, keyed by virtual node
+func (lb *loadBalancer) replication() map[string][]*consistent.CNode {
+	return lb.ring.Replicas(lb.factor - 1)
+}
+
+// handOver moves the copies of the states after a change of the
+// ring, before holds the replicas of the ring before it. Members
+// whose virtual nodes got other replicas are sent them again, which
+// makes them copy their states to the new replicas, and the members
+// no longer replicating a virtual node delete its states. The
+// members first are sent their replicas ahead of the others and
+// whether their replicas changed or not
+func (lb *loadBalancer) handOver(before map[string][]*consistent.CNode, first ...string) {
+	after := lb.replication()
+	changed := make(map[string]bool)
+	for _, key := range first {
+		changed[key] = true
+	}
+	for virtual, replicas := range after {
+		if !sameNodes(before[virtual], replicas) {
+			changed[lb.ring.GetNext(virtual).ParentKey] = true
 		}
+	}
+	members := append([]string(nil), first...)
+	for _, member := range lb.ring.Members() {
+		members = append(members, member.Key)
+	}
+	for _, key := range members {
+		if changed[key] {
+			changed[key] = false
+			lb.assignReplicas(key)
+		}
+	}
 
-		fmt.Println("For node", prev.Key, "transfer all keys with parent key =", node.Key)
-		walk++
+	for virtual, replicas := range before {
+		// The states of a virtual node gone from the ring are
+		// dropped by takeOver
+		current, exist := after[virtual]
+		if !exist {
+			continue
+		}
+		for _, replica := range replicas {
+			if member := lb.ring.Member(replica.ParentKey); member != nil && !containsMember(current, member.Key) {
+				lb.removeStates(member, rpcs.RemoveAll{ID: virtual})
+			}
+		}
 	}
-	// Replace Replica
-	lb.ring.RemoveNode(key)
 }
 
-func (lb *loadBalancer) removeKeys(key string) {
-	if lb.ring.Size() <= 2 {
-		return
+// takeOver hands the states of virtuals, gone from the ring, over
+// to the members now owning their ranges, moves the copies like
+// handOver and makes the former holders delete theirs. The member
+// of a virtual node is asked first if self is set, its replicas
+// are asked otherwise
+func (lb *loadBalancer) takeOver(before map[string][]*consistent.CNode, virtuals []*consistent.CNode, self bool, first ...string) {
+	owners := make([]*consistent.CNode, len(virtuals))
+	for walk, node := range virtuals {
+		owners[walk] = lb.promoteVirtual(before, node, self)
+		if owners[walk] != nil {
+			first = append(first, owners[walk].ParentKey)
+		}
 	}
+	lb.handOver(before, first...)
 
-	node := lb.ring.GetNext(key)
-
-	walk := 0
-	for walk != node.Weight {
-		node = lb.ring.GetNext(lb.ring.GetVirKey(key, walk))
-		prev := lb.ring.GetPrevParent(node)
-		next := lb.ring.GetNextExcept(node, prev.ParentKey)
-
-		if next != nil {
-			fmt.Println("For", node.Key, "Delete Keys from", next.Key, "of node", prev.Key)
-			// Send via RPC
-			args := rpcs.RemoveAll{
-				ID: prev.Key,
+	for walk, node := range virtuals {
+		if owners[walk] == nil {
+			continue
+		}
+		holders := append([]*consistent.CNode{node}, before[node.Key]...)
+		for _, holder := range holders {
+			member := lb.ring.Member(holder.ParentKey)
+			if member != nil && member.Key != owners[walk].ParentKey {
+				lb.removeStates(member, rpcs.RemoveAll{ID: node.Key})
 			}
-			reply := rpcs.Ack{}
+		}
+	}
+}
 
-			if err := next.Conn.Call("Node.RemoveAll", &args, &reply); err != nil {
-				fmt.Println("Cannot call RPC")
-			}
+// promoteVirtual makes the holders of the states of the virtual node
+// gone from the ring hand them over to the node now owning its range,
+// which it returns. The replicas of the virtual node are asked unless
+// self is set and its member answered
+func (lb *loadBalancer) promoteVirtual(before map[string][]*consistent.CNode, node *consistent.CNode, self bool) *consistent.CNode {
+	owner := lb.ring.GetNext(node.Key)
+	if owner == nil {
+		return nil
+	}
+	args := rpcs.PromoteArgs{
+		Old:   node.Key,
+		New:   repNode(owner),
+		Epoch: lb.ring.Epoch(),
+	}
+	if self && lb.promote(node, &args) {
+		return owner
+	}
+	for _, replica := range before[node.Key] {
+		if lb.ring.Member(replica.ParentKey) != nil {
+			lb.promote(replica, &args)
 		}
-		walk++
 	}
+	return owner
 }
 
-func (lb *loadBalancer) lookupKeys(key string) {
-	// args := rpcs.Lookup{}
+// promote sends args to the member of holder and reports
+// whether it handed all its states over
+func (lb *loadBalancer) promote(holder *consistent.CNode, args *rpcs.PromoteArgs) bool {
+	reply := rpcs.Ack{}
+	if err := lb.call(holder, "Node.Promote", args, &reply); err != nil {
+		lb.logger.Error("cannot call Node.Promote", "node", holder.ParentKey, "err", err)
+		return false
+	} else if !reply.Success {
+		lb.logger.Warn("states not all promoted", "node", holder.ParentKey, "old", args.Old, "new", args.New.Key)
+		return false
+	}
+	lb.logger.Info("states promoted", "node", holder.ParentKey, "old", args.Old, "new", args.New.Key)
+	return true
+}
 
-	node := lb.ring.GetNext(key)
+// removeStates makes the member delete the states of a virtual
+// node it no longer holds, those of args
+func (lb *loadBalancer) removeStates(member *consistent.CNode, args rpcs.RemoveAll) {
+	args.Epoch = lb.ring.Epoch()
+	reply := rpcs.Ack{}
+	if err := lb.call(member, "Node.RemoveAll", &args, &reply); err != nil {
+		lb.logger.Error("cannot call Node.RemoveAll", "node", member.Key, "err", err)
+		return
+	}
+	lb.logger.Debug("removed states", "node", member.Key, "virtual", args.ID, "start", args.Start, "end", args.End)
+}
 
-	walk := 0
-	for walk != node.Weight {
-		node = lb.ring.GetNext(lb.ring.GetVirKey(key, walk))
-		prev := lb.ring.GetPrevParent(node)
-		next := lb.ring.GetNextParent(node)
+// sameNodes reports whether both lists hold the same
+// ring entries in the same order
+func sameNodes(a []*consistent.CNode, b []*consistent.CNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for walk := range a {
+		if a[walk].Key != b[walk].Key {
+			return false
+		}
+	}
+	return true
+}
 
-		if prev == nil || next == nil {
-			return
+// containsMember reports whether nodes holds a node of member
+func containsMember(nodes []*consistent.CNode, member string) bool {
+	for _, node := range nodes {
+		if node.ParentKey == member {
+			return true
 		}
-		args := rpcs.LookupInfo{
-			Start: prev.Hash + 1,
-			End:   node.Hash,
-			Key:   node.Key,
+	}
+	return false
+}
+
+// rangeMove is a hash range taken over by the virtual
+// node to from the virtual node from
+type rangeMove struct {
+	start, end uint64
+	from, to   *consistent.CNode
+}
+
+// lookupKeys makes the virtual nodes of a joining member fetch
+// their ranges from the members owning them so far
+func (lb *loadBalancer) lookupKeys(key string) []rangeMove {
+	var moves []rangeMove
+	for _, node := range lb.virtuals(key) {
+		move, ok := lb.lookupVirtual(node, lb.ring.GetNextParent(node))
+		if !ok {
+			break
 		}
+		moves = append(moves, move)
+	}
+	return moves
+}
 
-		// Send via RPC
-		reply := rpcs.Ack{}
-		err := node.Conn.Call("Node.Lookup", &args, &reply)
-		if err != nil {
+// resync makes the virtual nodes of a rejoining member fetch the
+// states of their ranges changed while it was away from their
+// first replicas
+func (lb *loadBalancer) resync(key string) {
+	if lb.factor <= 1 {
+		return
+	}
+	for _, node := range lb.virtuals(key) {
+		replicas := lb.ring.GetNextParents(node, 1)
+		if len(replicas) == 0 {
+			return
+		}
+		if _, ok := lb.lookupVirtual(node, replicas[0]); !ok {
 			return
 		}
+	}
+}
 
-		fmt.Println("Node", key, "looking up between", prev.Hash+1, "<->", node.Hash, "from", next.Key)
-		walk++
+// lookupVirtual makes the virtual node fetch the states of its
+// hash range from the virtual node src
+func (lb *loadBalancer) lookupVirtual(node *consistent.CNode, src *consistent.CNode) (rangeMove, bool) {
+	prev := lb.ring.GetPrev(node)
+	if prev == nil || src == nil {
+		return rangeMove{}, false
+	}
+	args := rpcs.LookupInfo{
+		Start: prev.Hash + 1,
+		End:   node.Hash,
+		Key:   node.Key,
+		Src:   repNode(src),
+		Epoch: lb.ring.Epoch(),
+	}
+
+	// Send via RPC
+	reply := rpcs.Ack{}
+	err := lb.call(node, "Node.Lookup", &args, &reply)
+	if err != nil {
+		lb.logger.Error("cannot call Node.Lookup", "node", node.ParentKey, "err", err)
+		return rangeMove{}, false
+	} else if !reply.Success {
+		lb.logger.Warn("node did not fetch range", "node", node.ParentKey, "virtual", node.Key, "from", src.Key)
+		return rangeMove{}, false
 	}
 
+	lb.logger.Info("node fetching range", "node", node.ParentKey, "virtual", node.Key, "start", args.Start, "end", args.End, "from", src.Key)
+	return rangeMove{start: args.Start, end: args.End, from: src, to: node}, true
 }
 
-func (lb *loadBalancer) assignPrev(key string) {
-	node := lb.ring.GetNext(key)
-	prev := lb.ring.GetPrevParent(node)
-	if prev != nil {
-		// fmt.Println("Previous Node of", node.Key, "is", prev.ParentKey)
-		lb.assignReplicas(prev.ParentKey)
+// dropRanges makes the former holders of the ranges moved delete
+// their states, unless they replicate the range again. The member
+// the range moved from always deletes them, otherwise it would
+// replicate them under its virtual node again
+func (lb *loadBalancer) dropRanges(before map[string][]*consistent.CNode, moves []rangeMove) {
+	for _, move := range moves {
+		holders := map[string]bool{move.to.ParentKey: true}
+		for _, replica := range lb.ring.GetNextParents(move.to, lb.factor-1) {
+			holders[replica.ParentKey] = true
+		}
+		args := rpcs.RemoveAll{
+			ID:    move.from.Key,
+			Start: move.start,
+			End:   move.end,
+		}
+		if move.from.ParentKey != move.to.ParentKey {
+			holders[move.from.ParentKey] = false
+		}
+		for _, holder := range append([]*consistent.CNode{move.from}, before[move.from.Key]...) {
+			member := lb.ring.Member(holder.ParentKey)
+			if member != nil && !holders[member.Key] {
+				lb.removeStates(member, args)
+			}
+		}
 	}
 }
 
-func (lb *loadBalancer) joinNode(args *rpcs.JoinArgs) rpcs.Ack {
-	success := lb.ring.AddNode(args)
-	return rpcs.Ack{Success: success}
+// joinNode adds the node of args to the ring. A member restarting
+// at the address it had joined with rejoins: it keeps its position
+// in the ring and joinNode reports true
+func (lb *loadBalancer) joinNode(args *rpcs.JoinArgs) (bool, error) {
+	// Node and LB must place keys identically
+	if args.Hasher != lb.ring.HasherName() {
+		return false, rpcs.Errorf(rpcs.CodeInvalid, "node %s uses hasher %s instead of %s", args.ID, args.Hasher, lb.ring.HasherName())
+	}
+	// Try connecting the node at the address it advertised
+	addr := args.Addr
+	if addr == "" {
+		addr = transport.PortAddr(args.Port)
+	}
+	meta := transport.Meta(addr, args.Addrs)
+	meta[consistent.MetaZone] = args.Zone
+	meta[consistent.MetaRack] = args.Rack
+	curr := lb.ring.Member(args.ID)
+	if curr != nil && curr.Meta[transport.MetaAddr] == addr {
+		// Connections to the process that went away are broken
+		for _, addr := range transport.Addrs(curr.Meta) {
+			lb.pool.Drop(addr)
+		}
+	}
+	status := rpcs.Ack{}
+	ctx, cancel := lb.context(lb.callWait)
+	defer cancel()
+	if err := lb.pool.CallContext(ctx, transport.Addrs(meta), "Node.GetStatus", &status, &status); err != nil {
+		return false, rpcs.Errorf(rpcs.CodeUnreachable, "unable to connect to node %s: %v", args.ID, err)
+	}
+	if curr != nil {
+		if curr.Meta[transport.MetaAddr] != addr {
+			return false, rpcs.Errorf(rpcs.CodeDuplicateID, "node %s is already a member at %s", args.ID, curr.Meta[transport.MetaAddr])
+		}
+		lb.logger.Info("node rejoined", "node", args.ID, "addr", addr)
+		if lb.health != nil {
+			lb.health.reset(args.ID)
+		}
+		return true, nil
+	}
+	member := rpcs.RingMember{
+		Key:    args.ID,
+		Weight: args.Weight,
+		Meta:   meta,
+	}
+	return false, lb.commitChange(opAdd, member)
 }
 
 // forward is called when a request needs to be
 // sent to a node in a ring
-func (lb *loadBalancer) forward(args *rpcs.ReqArgs) rpcs.Ack {
-	node := lb.ring.GetNext(args.ID)
+func (lb *loadBalancer) forward(args *rpcs.ReqArgs) (rpcs.ReqReply, error) {
+	reply := rpcs.Ack{}
+	server, err := lb.send(args.ID, true, &args.NodeID, &args.Epoch, "Node.GetRequest", args, &reply)
+	if err != nil {
+		return rpcs.ReqReply{Success: false}, err
+	}
+	return rpcs.ReqReply{
+		Success: reply.Success,
+		Server:  server,
+	}, nil
+}
+
+// balance moves to the front of nodes, the owner of key followed
+// by its replicas, the first one with spare capacity under bounded
+// loads. It returns a function giving back the load assigned to
+// it. Only reads are moved, and only among the members holding
+// the state: a state stored off its owner would be missed by
+// replication and by the hand-over of its range
+func (lb *loadBalancer) balance(key string, nodes []*consistent.CNode) func() {
+	if !lb.ring.BoundedLoad() {
+		return func() {}
+	}
+	owner := nodes[0]
+	node := lb.ring.PickBounded(nodes)
+	for walk, curr := range nodes {
+		if curr == node {
+			copy(nodes[1:walk+1], nodes[:walk])
+			nodes[0] = node
+			break
+		}
+	}
+	if node.Parent != owner.Parent {
+		stats := lb.ring.LoadStats()
+		lb.logger.Debug("bounded load moved request", "request", key, "from", owner.ParentKey, "to", node.ParentKey,
+			"moved", stats.Moved, "lookups", stats.Lookups)
+	}
+	// The load is in flight until the node replies
+	return func() { lb.ring.Release(node.ParentKey) }
+}
+
+// send calls method on the owner of key and records the key of
+// that node in nodeID and the epoch of the ring in epoch. With
+// failover the members replicating the states of the owner are
+// tried in turn when it cannot be reached. They serve the request
+// on behalf of the owner, nodeID keeps its key so that a write
+// stays with the range it belongs to. A node that saw a newer
+// ring rejects the request, it is routed again once this
+// loadbalancer caught up. send returns the member that served
+// the request or an rpcs.Error
+func (lb *loadBalancer) send(key string, failover bool, nodeID *string, epoch *uint64, method string, args interface{}, reply interface{}) (string, error) {
+	server, stale, err := lb.attempt(key, failover, nodeID, epoch, method, args, reply)
+	if stale == 0 {
+		return server, err
+	}
+	if !lb.catchUp(stale) {
+		lb.logger.Warn("ring did not reach epoch in time", "request", key, "method", method, "epoch", stale)
+		return "", rpcs.WrongOwner{Epoch: stale}
+	}
+	server, _, err = lb.attempt(key, failover, nodeID, epoch, method, args, reply)
+	return server, err
+}
 
-	if node != nil {
-		args.NodeID = node.Key
-		hash := lb.ring.GenHash(args.ID)
-		fmt.Println("User hash is", hash, "<->", node.Hash)
+// attempt routes a request of send once. It returns the member
+// that served it, or the epoch a node expected instead. A node
+// answering with an error of its own is not failed over
+func (lb *loadBalancer) attempt(key string, failover bool, nodeID *string, epoch *uint64, method string, args interface{}, reply interface{}) (string, uint64, error) {
+	// Read before the lookup so the request never claims
+	// a newer ring than the one it was routed with
+	*epoch = lb.ring.Epoch()
+	nodes := lb.holders(key)
+	if len(nodes) == 0 {
+		return "", 0, rpcs.Errorf(rpcs.CodeNoNodes, "no node in the ring to serve %s", key)
+	}
+	node := nodes[0]
+	*nodeID = node.Key
+	if !failover {
+		nodes = nodes[:1]
+	}
+	if method == "Node.Get" {
+		defer lb.balance(key, nodes)()
+	} else {
+		// Writes, user requests included, update the state on its
+		// owner. Their load still counts so that reads move away
+		defer lb.balance(key, nodes[:1])()
+	}
+	lb.logger.Debug("routing request", "request", key, "hash", lb.ring.GenHash(key), "node", node.Key, "node_hash", node.Hash)
+	var err error
+	for _, node := range nodes {
+		ctx, cancel := lb.context(lb.timeout)
+		err = lb.pool.CallContext(ctx, transport.Addrs(node.Meta), method, args, reply)
+		cancel()
+		if err == nil {
+			return node.ParentKey, 0, nil
+		}
+		if newer, ok := rpcs.WrongOwnerEpoch(err); ok {
+			lb.logger.Info("node rejected epoch", "request", key, "node", node.ParentKey, "epoch", *epoch, "expected", newer)
+			return "", newer, nil
+		}
+		if e := rpcs.FromError(err); e.Code != rpcs.CodeUnknown {
+			return "", 0, e
+		}
+		lb.logger.Warn("cannot call node", "request", key, "node", node.ParentKey, "method", method, "err", err)
+		lb.suspect(node)
+	}
+	return "", 0, rpcs.Errorf(rpcs.CodeUnreachable, "no member serving %s answered: %v", key, err)
+}
 
-		reply := rpcs.Ack{}
-		if err := node.Conn.Call("Node.GetRequest", &args, &reply); err != nil {
-			fmt.Println("Cannot call RPC")
-			return rpcs.Ack{Success: false}
+// catchUp waits until the ring reached epoch and reports
+// whether it did in time
+func (lb *loadBalancer) catchUp(epoch uint64) bool {
+	wait := lb.timeout
+	if wait == 0 {
+		wait = time.Second
+	}
+	deadline := time.Now().Add(wait)
+	for lb.ring.Epoch() < epoch {
+		if time.Now().After(deadline) {
+			return false
 		}
-		return reply
+		time.Sleep(10 * time.Millisecond)
 	}
-	return rpcs.Ack{Success: false}
+	return true
+}
+
+// replicas returns the members holding replicas of the
+// states of key served by node
+func (lb *loadBalancer) replicas(key string, node *consistent.CNode) []*consistent.CNode {
+	return lb.ring.GetNextParents(node, lb.factor-1)
 }
 
 // assignReplicas returns a slice of node keys that are
@@ -278,16 +1021,12 @@ func (lb *loadBalancer) assignReplicas(key string) {
 
 	for walk != node.Weight {
 		node = lb.ring.GetNext(lb.ring.GetVirKey(key, walk))
-		replica := lb.ring.GetNextParent(node)
-
-		if replica != nil {
-			fmt.Println("Replica of", node.Key, "is", replica.Key)
-			repNode := rpcs.RepNode{
-				ParentKey: replica.ParentKey,
-				Key:       replica.Key,
-				Port:      replica.Port,
-			}
-			replicas = append(replicas, repNode)
+
+		for _, replica := range lb.ring.GetNextParents(node, lb.factor-1) {
+			lb.logger.Debug("replica assigned", "node", node.Key, "replica", replica.Key)
+			rep := repNode(replica)
+			rep.Virtual = node.Key
+			replicas = append(replicas, rep)
 		}
 		walk++
 	}
@@ -295,10 +1034,12 @@ func (lb *loadBalancer) assignReplicas(key string) {
 	// Send via RPC
 	args := rpcs.ReplicaArgs{
 		Replicas: replicas,
+		Factor:   lb.factor,
+		Epoch:    lb.ring.Epoch(),
 	}
 	reply := rpcs.Ack{}
-	if err := node.Conn.Call("Node.GetReplicas", &args, &reply); err != nil {
-		fmt.Println("Cannot call RPC")
+	if err := lb.call(node, "Node.GetReplicas", &args, &reply); err != nil {
+		lb.logger.Error("cannot call Node.GetReplicas", "node", key, "err", err)
 		return
 	} else if !reply.Success {
 		return
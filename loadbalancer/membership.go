@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"conhash/raft"
+	"conhash/rpcs"
+	"encoding/gob"
+)
+
+// Operations of the membership log
+const (
+	opAdd      = "add"
+	opRemove   = "remove"
+	opReweight = "reweight"
+)
+
+// change is an entry of the membership log. Every loadbalancer
+// applies the committed changes to its ring in log order, so the
+// rings stay identical and a new loadbalancer rebuilds the ring
+// by replaying the log
+type change struct {
+	Op     string
+	Member rpcs.RingMember
+}
+
+// commitChange replicates a change of the ring and waits
+// until it is applied
+func (lb *loadBalancer) commitChange(op string, member rpcs.RingMember) error {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(change{Op: op, Member: member}); err != nil {
+		return rpcs.Errorf(rpcs.CodeInvalid, "unable to encode %s of %s: %v", op, member.Key, err)
+	}
+	if err := lb.raft.Commit(buf.Bytes()); err != nil {
+		return rpcs.Errorf(rpcs.CodeNoLeader, "unable to commit %s of %s: %v", op, member.Key, err)
+	}
+	return nil
+}
+
+// apply applies a committed change to the ring
+func (lb *loadBalancer) apply(entry raft.Entry) {
+	c := change{}
+	if err := gob.NewDecoder(bytes.NewReader(entry.Command)).Decode(&c); err != nil {
+		lb.logger.Error("unable to decode entry", "index", entry.Index, "err", err)
+		return
+	}
+
+	member := c.Member
+	switch c.Op {
+	case opAdd:
+		if !lb.ring.AddNode(member.Key, member.Weight, member.Meta) {
+			return
+		}
+	case opRemove:
+		if !lb.ring.RemoveNode(member.Key) {
+			return
+		}
+	case opReweight:
+		lb.ring.Reweight(member.Key, member.Weight)
+	}
+	lb.updatePlacement()
+	lb.logger.Info("applied change", "op", c.Op, "node", member.Key, "index", entry.Index, "epoch", lb.ring.Epoch())
+	lb.saveRing()
+}
+
+// ringSnapshot is the state of the ring in a raft snapshot
+type ringSnapshot struct {
+	Epoch   uint64
+	Members []rpcs.RingMember
+}
+
+// snapshotRing returns the members and the epoch of the ring
+func (lb *loadBalancer) snapshotRing() []byte {
+	snapshot := ringSnapshot{
+		Epoch:   lb.ring.Epoch(),
+		Members: lb.members(),
+	}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+		lb.logger.Error("unable to encode ring", "err", err)
+	}
+	return buf.Bytes()
+}
+
+// restoreRing brings the ring in line with a snapshot. The ring
+// takes the epoch of the snapshot whatever changes it took, so
+// that it keeps the epoch of the rings of other loadbalancers
+func (lb *loadBalancer) restoreRing(data []byte) {
+	snapshot := ringSnapshot{}
+	if len(data) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+			lb.logger.Error("unable to decode ring", "err", err)
+			return
+		}
+	}
+	members := snapshot.Members
+
+	keep := make(map[string]bool)
+	for _, member := range members {
+		keep[member.Key] = true
+		curr := lb.ring.Member(member.Key)
+		if curr == nil {
+			lb.ring.AddNode(member.Key, member.Weight, member.Meta)
+		} else if curr.Weight != member.Weight {
+			lb.ring.Reweight(member.Key, member.Weight)
+		}
+	}
+	for _, curr := range lb.ring.Members() {
+		if !keep[curr.Key] {
+			lb.ring.RemoveNode(curr.Key)
+		}
+	}
+	lb.ring.SetEpoch(snapshot.Epoch)
+	lb.updatePlacement()
+	lb.logger.Info("restored ring", "members", len(members), "epoch", snapshot.Epoch)
+	lb.saveRing()
+}
+
+// redirect forwards a membership change to the leader and
+// reports whether it was handled elsewhere, with its error
+func (lb *loadBalancer) redirect(method string, args interface{}, reply *rpcs.Ack) (bool, error) {
+	if lb.raft.IsLeader() {
+		return false, nil
+	}
+	leader, _ := lb.raft.Leader()
+	if leader == "" {
+		return true, ack(reply, rpcs.Errorf(rpcs.CodeNoLeader, "no leader to handle %s", method))
+	}
+	ctx, cancel := lb.context(lb.callWait)
+	defer cancel()
+	err := lb.pool.CallContext(ctx, []string{leader}, method, args, reply)
+	if err == nil {
+		return true, nil
+	}
+	e := rpcs.FromError(err)
+	if e.Code == rpcs.CodeUnknown {
+		e = rpcs.Errorf(rpcs.CodeNoLeader, "unable to forward %s to leader %s: %v", method, leader, err)
+	}
+	return true, ack(reply, e)
+}
+
+// Leader tells which loadbalancer leads
+func (lb *loadBalancer) Leader(args *rpcs.Ack, reply *rpcs.LeaderReply) error {
+	leader, term := lb.raft.Leader()
+	*reply = rpcs.LeaderReply{
+		Leader: leader,
+		Term:   term,
+	}
+	return nil
+}
+
+// GetRing returns the ring so that clients can route
+// requests to the nodes themselves
+func (lb *loadBalancer) GetRing(args *rpcs.Ack, reply *rpcs.RingReply) error {
+	// Read before the members, a client then never claims
+	// a newer ring than the one it routes with
+	*reply = rpcs.RingReply{
+		Epoch:     lb.ring.Epoch(),
+		Hasher:    lb.ring.HasherName(),
+		Algorithm: lb.algorithm,
+	}
+	reply.Members = lb.members()
+	return nil
+}
@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+)
+
+// placed reports whether keys are placed by another
+// algorithm than the ring
+func (lb *loadBalancer) placed() bool {
+	return lb.algorithm != consistent.AlgoRing
+}
+
+// placement returns the current placement of keys, nil
+// for the ring algorithm
+func (lb *loadBalancer) placement() consistent.Ring {
+	place, _ := lb.place.Load().(consistent.Ring)
+	return place
+}
+
+// updatePlacement rebuilds the placement of keys from the members of
+// the ring after a change. It is built from the members in
+// order, just like nodes and routers build theirs, so that
+// they all place keys alike
+func (lb *loadBalancer) updatePlacement() {
+	if !lb.placed() {
+		return
+	}
+	place, err := consistent.Place(lb.algorithm, lb.hasher, lb.ring.Members())
+	if err != nil {
+		lb.logger.Error("unable to place keys", "algorithm", lb.algorithm, "err", err)
+		return
+	}
+	lb.place.Store(place)
+}
+
+// holders returns the members holding the states of key, its
+// owner first. The owner of the ring algorithm is a virtual node
+func (lb *loadBalancer) holders(key string) []*consistent.CNode {
+	if place := lb.placement(); place != nil {
+		return place.LookupN(key, lb.factor)
+	}
+	node := lb.ring.GetNext(key)
+	if node == nil {
+		return nil
+	}
+	return append([]*consistent.CNode{node}, lb.replicas(key, node)...)
+}
+
+// members returns the members of the ring
+func (lb *loadBalancer) members() []rpcs.RingMember {
+	var members []rpcs.RingMember
+	for _, member := range lb.ring.Members() {
+		members = append(members, rpcs.RingMember{
+			Key:    member.Key,
+			Weight: member.Weight,
+			Meta:   member.Meta,
+		})
+	}
+	return members
+}
+
+// rebalance sends the members of the ring to every node after a
+// change, which makes them move their states to the members now
+// placed to hold them. joined lost its states and gets them back
+// from their holders, gone is a member that left and hands its
+// states over. The nodes are called one at a time, as they send
+// states to each other while they rebalance
+func (lb *loadBalancer) rebalance(joined string, gone *consistent.CNode) {
+	args := rpcs.PlaceArgs{
+		Algorithm: lb.algorithm,
+		Factor:    lb.factor,
+		Members:   lb.members(),
+		Joined:    joined,
+		Epoch:     lb.ring.Epoch(),
+	}
+	var nodes []*consistent.CNode
+	if member := lb.ring.Member(joined); member != nil {
+		nodes = append(nodes, member)
+	}
+	for _, member := range lb.ring.Members() {
+		if member.Key != joined {
+			nodes = append(nodes, member)
+		}
+	}
+	if gone != nil {
+		nodes = append(nodes, gone)
+	}
+	for _, node := range nodes {
+		reply := rpcs.Ack{}
+		if err := lb.call(node, "Node.Place", &args, &reply); err != nil {
+			lb.logger.Error("cannot call Node.Place", "node", node.Key, "err", err)
+		} else if !reply.Success {
+			lb.logger.Warn("states not all handed over", "node", node.Key)
+		}
+	}
+	lb.logger.Info("rebalanced states", "algorithm", lb.algorithm, "members", len(args.Members), "epoch", args.Epoch)
+}
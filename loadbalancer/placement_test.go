@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"conhash/client"
+	"conhash/consistent"
+	"conhash/rpcs"
+	"strconv"
+	"testing"
+)
+
+// TestAlgorithms places keys with every algorithm other than the
+// ring and checks the states follow as members join, leave, fail
+// and change weight, and that a router places keys alike
+func TestAlgorithms(t *testing.T) {
+	const keys = 40
+	for _, algorithm := range []string{consistent.AlgoJump, consistent.AlgoMaglev, consistent.AlgoRendezvous} {
+		t.Run(algorithm, func(t *testing.T) {
+			c := newCluster(t, Config{Algorithm: algorithm})
+			for walk := 0; walk < 4; walk++ {
+				c.join("n"+strconv.Itoa(walk), 2, "")
+			}
+			c.put(keys)
+			c.checkPlacement(keys)
+			c.checkReads(keys)
+
+			c.join("n4", 2, "")
+			c.checkPlacement(keys)
+			c.leave("n1")
+			c.checkPlacement(keys)
+			c.fail("n2")
+			c.checkPlacement(keys)
+			if err := c.lb.Reweight(&rpcs.ReweightArgs{ID: "n0", Weight: 4}, &rpcs.Ack{}); err != nil {
+				t.Fatal(err)
+			}
+			c.checkPlacement(keys)
+			c.checkReads(keys)
+
+			router, err := client.NewRouter(c.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			for walk := 0; walk < keys; walk++ {
+				key := "key-" + strconv.Itoa(walk)
+				if value, found, err := router.Get(key); err != nil || !found || string(value) != "value-"+key {
+					t.Errorf("router read %s as %q, found %v: %v", key, value, found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	if _, err := New(Config{Algorithm: "modulo", Logger: quiet}); err == nil {
+		t.Fatal("loadbalancer accepted an unknown algorithm")
+	}
+}
@@ -0,0 +1,101 @@
+package loadbalancer
+
+import (
+	"conhash/client"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRouter returns a router of the cluster
+func (c *cluster) newRouter() *client.Router {
+	c.t.Helper()
+	router, err := client.NewRouter(c.addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { router.Close() })
+	return router
+}
+
+// checkRoutedReads reads every key written by put through router
+func (c *cluster) checkRoutedReads(router *client.Router, keys int) {
+	c.t.Helper()
+	for walk := 0; walk < keys; walk++ {
+		key := "key-" + strconv.Itoa(walk)
+		if value, found, err := router.Get(key); err != nil || !found || string(value) != "value-"+key {
+			c.t.Errorf("router read %s as %q, found %v: %v", key, value, found, err)
+		}
+	}
+}
+
+func TestRouterRefresh(t *testing.T) {
+	const keys = 60
+	tests := []struct {
+		name   string
+		change func(c *cluster)
+	}{
+		// The nodes reject the epoch of the router
+		{"stale epoch", func(c *cluster) { c.join("n4", 3, "") }},
+		// The router does not reach the node it routes to
+		{"node removed", func(c *cluster) { c.fail("n1") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCluster(t, Config{})
+			for walk := 0; walk < 4; walk++ {
+				c.join("n"+strconv.Itoa(walk), 3, "")
+			}
+			c.put(keys)
+			router := c.newRouter()
+			before := router.Epoch()
+
+			tt.change(c)
+			c.checkRoutedReads(router, keys)
+			if epoch := router.Epoch(); epoch == before || epoch != c.lb.ring.Epoch() {
+				t.Errorf("router at epoch %d, was %d, ring at %d", epoch, before, c.lb.ring.Epoch())
+			}
+		})
+	}
+}
+
+func TestRouterLoadBalancerRestart(t *testing.T) {
+	const keys = 60
+	config := Config{
+		RingFile:    filepath.Join(t.TempDir(), "ring.json"),
+		CallTimeout: 2 * time.Second,
+		Logger:      quiet,
+	}
+	c := newCluster(t, config)
+	for walk := 0; walk < 4; walk++ {
+		c.join("n"+strconv.Itoa(walk), 3, "")
+	}
+	c.put(keys)
+	router := c.newRouter()
+	epoch := router.Epoch()
+
+	// The loadbalancer comes back on its port with its ring
+	port, err := strconv.Atoi(strings.TrimPrefix(c.addr, ":"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.lb.Close()
+	lb, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartLB(port); err != nil {
+		t.Fatal(err)
+	}
+	c.lb = lb.(*loadBalancer)
+
+	if err := router.Refresh(); err != nil {
+		t.Fatalf("router did not reach the restarted loadbalancer: %v", err)
+	}
+	if router.Epoch() != epoch {
+		t.Errorf("router at epoch %d, want %d", router.Epoch(), epoch)
+	}
+	c.checkRoutedReads(router, keys)
+}
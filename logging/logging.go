@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Formats of the logs
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing to the console in format,
+// text or json, from level on
+func New(format, level string) (*slog.Logger, error) {
+	var min slog.Level
+	if err := min.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: min}
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(os.Stdout, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(os.Stdout, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
@@ -2,25 +2,53 @@ package node
 
 import (
 	"conhash/consistent"
+	"conhash/gossip"
 	"conhash/rpcs"
+	"conhash/store"
+	"conhash/transport"
+	"context"
 	"errors"
-	"fmt"
+	"log/slog"
 	"net"
-	"net/http"
-	"net/rpc"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // loadBalancer struct maintains the variables
 // required for consistent hashing
 type node struct {
-	unRepl    []string
-	stateMap  map[string]rpcs.State
-	weight    int
-	myPort    int
-	id        string
-	listener  net.Listener // RPC listener of node
-	ring      consistent.CRing
+	epoch    uint64 // newest epoch of the ring seen, accessed atomically
+	unRepl   []string
+	store    store.Store
+	clock    uint64 // version of the last write
+	weight   int
+	factor   int // replication factor assigned by the loadbalancer
+	myPort   int
+	listen   string   // address the RPC listener binds
+	addr     string   // address advertised to the loadbalancer
+	addrs    []string // alternative addresses advertised
+	lb       string   // address of the loadbalancer joined
+	id       string
+	zone     string
+	rack     string
+	listener net.Listener // RPC listener of node
+	hasher   consistent.Hasher
+	// replicas holds the replicas of every virtual node of the
+	// node as assigned by the loadbalancer, in ring order
+	replicas map[string][]*consistent.CNode
+	view     *consistent.CRing // every member of the ring, learnt through gossip
+	// place places keys when the loadbalancer uses another
+	// algorithm than the ring, nil otherwise
+	place     consistent.Ring
+	gossip    *gossip.Memberlist
+	seeds     []string        // gossip addresses tried besides the loadbalancer
+	pool      *transport.Pool // connections to the replicas
+	transport transport.Transport
+	callWait  time.Duration   // time a call to another node may take
+	ctx       context.Context // cancelled when the node is closed
+	cancel    context.CancelFunc
+	logger    *slog.Logger
 	repCh     chan replicaEx
 	reqCh     chan requestEx
 	rmvCh     chan removeEx
@@ -29,15 +57,79 @@ type node struct {
 	bulkCh    chan bulkEx
 	stateCh   chan stateEx
 	replaceCh chan replaceEx
+	kvCh      chan kvEx
+	promoteCh chan promoteEx
+	weightCh  chan weightEx
+	placeCh   chan placeEx
 }
 
-// New returns a new instance of loadbalancer but does
+// Config contains the settings of a node
+type Config struct {
+	Port   int
+	Listen string   // address to listen on, ":Port" if empty
+	Addr   string   // host:port advertised to peers, Listen if empty
+	Addrs  []string // alternative addresses advertised to peers
+	ID     string
+	Weight int
+	Hasher consistent.Hasher // hash function of the ring, Sha256 if nil
+	Zone   string            // failure domain advertised on join
+	Rack   string
+	Store  store.Store // storage of the states, in memory if nil
+	// Seeds are gossip addresses of other members tried when
+	// joining the gossip besides the loadbalancer
+	Seeds          []string
+	GossipInterval time.Duration // gossip protocol period, a second if 0
+	// CallTimeout is the time a call to another node may take,
+	// 10 seconds if 0. A stalled peer turns into a timeout
+	// instead of blocking the node
+	CallTimeout time.Duration
+	Transport   transport.Transport // carries the RPCs, net/rpc if nil
+	Logger      *slog.Logger        // receives the diagnostics, slog.Default() if nil
+}
+
+// New returns a new instance of node but does
 // not start it
-func New(port int, id string, weight int) Node {
-	return &node{
-		myPort:    port,
-		id:        id,
-		ring:      *consistent.NewRing(),
+func New(config Config) Node {
+	if config.Listen == "" {
+		config.Listen = transport.PortAddr(config.Port)
+	}
+	if config.Addr == "" {
+		config.Addr = config.Listen
+	}
+	if config.Store == nil {
+		config.Store = store.NewMemory()
+	}
+	if config.CallTimeout <= 0 {
+		config.CallTimeout = defaultCallTimeout
+	}
+	if config.Transport == nil {
+		config.Transport = transport.NetRPC()
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.Hasher == nil {
+		config.Hasher = consistent.DefaultHasher()
+	}
+	logger := config.Logger.With("component", "node", "id", config.ID)
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &node{
+		myPort:    config.Port,
+		listen:    config.Listen,
+		addr:      config.Addr,
+		addrs:     config.Addrs,
+		id:        config.ID,
+		zone:      config.Zone,
+		rack:      config.Rack,
+		hasher:    config.Hasher,
+		replicas:  make(map[string][]*consistent.CNode),
+		view:      consistent.NewRing(config.Hasher),
+		seeds:     config.Seeds,
+		pool:      transport.NewPoolWith(config.Transport),
+		transport: config.Transport,
+		callWait:  config.CallTimeout,
+		ctx:       ctx,
+		cancel:    cancel,
 		repCh:     make(chan replicaEx),
 		reqCh:     make(chan requestEx),
 		rmvCh:     make(chan removeEx),
@@ -46,25 +138,63 @@ func New(port int, id string, weight int) Node {
 		lookupCh:  make(chan lookupEx),
 		bulkCh:    make(chan bulkEx),
 		stateCh:   make(chan stateEx),
-		weight:    weight,
-		stateMap:  make(map[string]rpcs.State),
+		kvCh:      make(chan kvEx),
+		promoteCh: make(chan promoteEx),
+		weightCh:  make(chan weightEx),
+		placeCh:   make(chan placeEx),
+		weight:    config.Weight,
+		factor:    2,
+		store:     config.Store,
+		logger:    logger,
 	}
+	n.view.SetLogger(logger.With("ring", "view"))
+	n.view.AddNode(n.id, n.weight, n.meta())
+	n.gossip = gossip.New(gossip.Config{
+		Name:     n.id,
+		Addrs:    transport.Addrs(n.meta()),
+		Meta:     n.meta(),
+		Interval: config.GossipInterval,
+		Notify:   n.updateView,
+
+		Transport: config.Transport,
+		Logger:    logger.With("subsystem", "gossip"),
+	})
+	return n
 }
 
 func (n *node) StartNode(dst string) error {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(n.myPort))
+	// Versions keep growing even if the clock went
+	// back while the node was down
+	err := n.store.Range(func(key string, state rpcs.State) bool {
+		if state.Version > n.clock {
+			n.clock = state.Version
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := transport.Listen(n.listen)
 	if err != nil {
 		return err
 	}
 	n.listener = listener
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(rpcs.WrapNode(n))
-	rpcServer.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	go http.Serve(listener, nil)
+	server := n.transport.NewServer()
+	server.RegisterName("Node", rpcs.WrapNode(n))
+	n.gossip.Register(server)
+	go server.Serve(listener)
 	go n.handleRequests()
+	n.lb = dst
 	if err = n.joinLB(dst); err != nil {
 		return err
 	}
+
+	// The loadbalancer takes part in the gossip and seeds it
+	n.gossip.Start()
+	if err = n.gossip.Join(append([]string{dst}, n.seeds...)); err != nil {
+		n.logger.Warn("unable to join gossip", "err", err)
+	}
 	return nil
 }
 
@@ -79,105 +209,227 @@ func (n *node) handleRequests() {
 			repEx.rep <- rep
 
 		case reqEx := <-n.reqCh:
-			rep := n.updateState(reqEx.args)
-			succ := n.replState(reqEx.args.ID)
-			if !succ {
+			if err := n.updateState(reqEx.args); err != nil {
+				reqEx.rep <- err
+				continue
+			}
+			// A replica serving the request while the owner is down
+			// leaves the state to the owner, which fetches it back
+			// with its range
+			if n.owns(reqEx.args.NodeID) && !n.replState(reqEx.args.ID) {
 				n.unRepl = append(n.unRepl, reqEx.args.ID)
 			}
-			reqEx.rep <- rep
+			reqEx.rep <- nil
 
 		case ex := <-n.stateCh:
-			fmt.Println("State replicat at backup")
-			n.stateMap[ex.args.Key] = ex.args.UserState
-			ex.rep <- rpcs.Ack{Success: true}
+			n.logger.Debug("replicated state received", "key", ex.args.Key)
+			ex.rep <- n.merge(ex.args.Key, ex.args.UserState)
+
+		case ex := <-n.kvCh:
+			var rep kvReply
+			switch ex.op {
+			case opPut:
+				rep.reply, rep.err = n.putValue(ex.args)
+			case opGet:
+				rep.reply, rep.err = n.getValue(ex.args)
+			case opDelete:
+				rep.reply, rep.err = n.deleteValue(ex.args)
+			}
+			ex.rep <- rep
 
 		case rmvEx := <-n.rmvCh:
-			fmt.Println("Going to remove all keys with replica key =", rmvEx.args.ID)
-			n.removeAll(rmvEx.args.ID)
+			n.logger.Debug("removing states of virtual node", "virtual", rmvEx.args.ID)
+			n.removeAll(rmvEx.args)
 			rmvEx.rep <- rpcs.Ack{Success: true}
 
 		case cpyEx := <-n.cpyCh:
-			fmt.Println("Copy Called")
+			n.logger.Debug("copying states replicated on", "virtual", cpyEx.args.Target)
 			n.replicateKeys(cpyEx.args.Target)
 			cpyEx.rep <- rpcs.Ack{Success: true}
 
 		case repEx := <-n.replaceCh:
-			fmt.Println("Replace Called")
+			n.logger.Debug("replacing replica", "old", repEx.args.Old, "new", repEx.args.New.Key)
 			n.replaceNodes(repEx.args)
 			repEx.rep <- rpcs.Ack{Success: true}
 
 		case lukupEx := <-n.lookupCh:
-			n.lookupKeys(lukupEx.args)
-			lukupEx.rep <- rpcs.Ack{Success: true}
+			lukupEx.rep <- rpcs.Ack{Success: n.lookupKeys(lukupEx.args)}
 
 		case bulkEx := <-n.bulkCh:
-			bulkEx.rep <- n.cpyBulk(bulkEx.args)
+			states, err := n.cpyBulk(bulkEx.args)
+			bulkEx.rep <- bulkReply{states: states, err: err}
+
+		case ex := <-n.promoteCh:
+			n.logger.Info("promoting states", "old", ex.args.Old, "new", ex.args.New.Key)
+			ex.rep <- rpcs.Ack{Success: n.promote(ex.args)}
+
+		case ex := <-n.weightCh:
+			n.logger.Info("weight changed", "weight", ex.args.Weight)
+			n.weight = ex.args.Weight
+			n.view.Reweight(n.id, n.weight)
+			n.gossip.SetMeta(n.meta())
+			ex.rep <- rpcs.Ack{Success: true}
+
+		case ex := <-n.placeCh:
+			n.logger.Info("placement changed", "algorithm", ex.args.Algorithm, "members", len(ex.args.Members))
+			ex.rep <- rpcs.Ack{Success: n.rebalance(ex.args)}
+			if len(n.unRepl) > 0 {
+				n.tryReplicate()
+			}
 		}
 	}
 }
 
-func (n *node) cpyBulk(args *rpcs.LookupInfo) rpcs.BulkStates {
+func (n *node) cpyBulk(args *rpcs.LookupInfo) (rpcs.BulkStates, error) {
 	bulk := rpcs.BulkStates{
 		States: make(map[string]rpcs.State),
 	}
 
-	for key, state := range n.stateMap {
-		if args.Start < args.End && state.Hash >= args.Start && state.Hash <= args.End {
-			bulk.States[key] = state
-			state.Primary = args.Key
-			state.Replica = args.Dst
-		} else if args.Start > args.End && state.Hash >= args.Start || state.Hash <= args.End {
+	err := n.store.Range(func(key string, state rpcs.State) bool {
+		if args.Since > 0 && state.Version <= args.Since {
+			return true
+		}
+		if inRange(state.Hash, args.Start, args.End) {
 			bulk.States[key] = state
-			state.Primary = args.Key
-			state.Replica = args.Dst
+		}
+		return true
+	})
+	if err != nil {
+		return rpcs.BulkStates{}, rpcs.Errorf(rpcs.CodeStorage, "unable to read states: %v", err)
+	}
+	return bulk, nil
+}
+
+// lookupKeys fetches the states of the range of the virtual node
+// args.Key from args.Src, picked by the loadbalancer: the member
+// that served the range before the virtual node joined, or one
+// holding its states when the node rejoins. It reports whether
+// the states were fetched
+func (n *node) lookupKeys(args *rpcs.LookupInfo) bool {
+	src := repCNode(args.Src)
+	bulkStates := rpcs.BulkStates{}
+	args.Dst = src.Key
+	args.Since = n.since(args.Key)
+	if args.Since > 0 {
+		n.logger.Info("fetching states changed since", "virtual", args.Key, "since", args.Since)
+	}
+
+	var err error
+	if src.ParentKey == n.id {
+		// The range moves between virtual nodes of the node
+		bulkStates, err = n.cpyBulk(args)
+	} else {
+		err = n.call(src, "Node.CopyBulk", &args.Epoch, args, &bulkStates)
+	}
+	if err != nil {
+		n.logger.Error("cannot call Node.CopyBulk", "peer", src.Key, "virtual", args.Key, "start", args.Start, "end", args.End, "err", err)
+		return false
+	}
+	n.logger.Info("fetched range", "peer", src.Key, "virtual", args.Key, "start", args.Start, "end", args.End, "states", len(bulkStates.States))
+
+	// The states are replicated once the replicas of the
+	// virtual node are assigned
+	for key, state := range bulkStates.States {
+		state.Primary = args.Key
+		state.Replicas = nil
+		if n.merge(key, state) != nil {
+			return false
 		}
 	}
-	return bulk
+	return true
 }
 
-func (n *node) lookupKeys(args *rpcs.LookupInfo) {
-	next := n.ring.GetNextParentWithKey(args.Key)
-	if next != nil {
-		bulkStates := rpcs.BulkStates{}
-		args.Dst = next.Key
+// promote hands the states of the virtual node Old, gone from the
+// ring, over to the member now owning its range. The owner becomes
+// their primary and replicates them again, other members send it
+// their copy and keep it under Old until the loadbalancer removes it.
+// It reports whether the owner got all of them
+func (n *node) promote(args *rpcs.PromoteArgs) bool {
+	sent := true
+	var keys []string
+	n.store.Range(func(key string, state rpcs.State) bool {
+		if state.Primary == args.Old {
+			keys = append(keys, key)
+		}
+		return true
+	})
 
-		err := next.Conn.Call("Node.CopyBulk", args, &bulkStates)
-		if err != nil {
-			fmt.Println("Cannot call RPC")
-			return
+	for _, key := range keys {
+		userSt, exist, err := n.store.Get(key)
+		if err != nil || !exist {
+			continue
+		}
+		// The owner replicates them once it learns its replicas
+		userSt.Primary = args.New.Key
+		userSt.Replicas = nil
+		if args.New.ParentKey == n.id {
+			if n.merge(key, userSt) == nil && !n.replState(key) {
+				n.unRepl = append(n.unRepl, key)
+			}
+			continue
 		}
-		fmt.Println("States are", bulkStates)
 
-		for key, state := range bulkStates.States {
-			state.Primary = args.Key
-			state.Replica = next.Key
-			n.stateMap[key] = state
+		syncArgs := rpcs.SyncArgs{
+			Key:       key,
+			UserState: userSt,
+		}
+		reply := rpcs.Ack{}
+		if err := n.callPeer(args.New.Addrs, "Node.RecvState", &syncArgs.Epoch, &syncArgs, &reply); err != nil {
+			n.logger.Error("cannot call Node.RecvState", "peer", args.New.Key, "key", key, "err", err)
+			sent = false
 		}
 	}
-
+	return sent
 }
 
+// replaceNodes makes New replicate the virtual nodes Old replicated.
+// Old is only dropped where the member of New already replicates
 func (n *node) replaceNodes(args *rpcs.ReplaceArgs) {
-	n.ring.RemoveSolo(args.Old)
-	n.ring.AddSolo(args.New.Key, args.New.ParentKey, args.New.Port)
-
+	for virtual, replicas := range n.replicas {
+		var kept []*consistent.CNode
+		for _, replica := range replicas {
+			if replica.Key == args.Old {
+				replica = repCNode(args.New)
+			}
+			if !containsMember(kept, replica.ParentKey) {
+				kept = append(kept, replica)
+			}
+		}
+		n.replicas[virtual] = kept
+	}
 }
 
 func (n *node) replicateKeys(target string) {
-	for key, state := range n.stateMap {
-		if state.Replica == target {
-			ok := n.replState(key)
-			if !ok {
-				n.unRepl = append(n.unRepl, key)
-			}
+	var keys []string
+	n.store.Range(func(key string, state rpcs.State) bool {
+		if contains(state.Replicas, target) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		ok := n.replState(key)
+		if !ok {
+			n.unRepl = append(n.unRepl, key)
 		}
 	}
 }
 
-func (n *node) removeAll(key string) {
-	for _, state := range n.stateMap {
-		if state.Primary == key {
-			delete(n.stateMap, key)
+// removeAll deletes the states whose primary is the virtual
+// node args.ID, in the range of args if any, the node no longer
+// replicates them
+func (n *node) removeAll(args *rpcs.RemoveAll) {
+	ranged := args.Start != 0 || args.End != 0
+	var keys []string
+	n.store.Range(func(stateKey string, state rpcs.State) bool {
+		if args.All || state.Primary == args.ID && (!ranged || inRange(state.Hash, args.Start, args.End)) {
+			keys = append(keys, stateKey)
+		}
+		return true
+	})
+	for _, stateKey := range keys {
+		if err := n.store.Delete(stateKey); err != nil {
+			n.logger.Error("unable to delete", "key", stateKey, "err", err)
 		}
 	}
 }
@@ -194,65 +446,370 @@ func (n *node) tryReplicate() {
 	n.unRepl = failure
 }
 
-func (n *node) updateState(args *rpcs.ReqArgs) rpcs.Ack {
+func (n *node) updateState(args *rpcs.ReqArgs) error {
 	// Check if state already exist
-	userSt, exist := n.stateMap[args.ID]
+	userSt, exist, err := n.store.Get(args.ID)
+	if err != nil {
+		return rpcs.Errorf(rpcs.CodeStorage, "unable to read %s: %v", args.ID, err)
+	}
 	if !exist {
 		userSt = rpcs.State{
-			Hash: n.ring.GenHash(args.ID),
+			Hash: n.hasher.Hash(args.ID),
 		}
 	}
 	userSt.Primary = args.NodeID
-	n.stateMap[args.ID] = userSt
-	return rpcs.Ack{Success: true}
+	userSt.Deleted = false
+	userSt.Version = n.tick()
+	if err := n.store.Put(args.ID, userSt); err != nil {
+		return rpcs.Errorf(rpcs.CodeStorage, "unable to store %s: %v", args.ID, err)
+	}
+	return nil
 }
 
 func (n *node) replState(key string) bool {
 	// Check if state already exist
-	userSt, exist := n.stateMap[key]
-	if exist {
-		replica := n.ring.GetNext(key)
+	userSt, exist, err := n.store.Get(key)
+	if err != nil || !exist {
+		return false
+	} else if n.factor <= 1 {
+		return true
+	}
 
-		if replica != nil {
-			fmt.Println("Replica is", replica)
-			userSt.Replica = replica.Key
+	if !n.replicate(key, &userSt) {
+		return false
+	}
+	n.logger.Debug("state replicated", "key", key, "replicas", userSt.Replicas)
+	if err := n.store.Put(key, userSt); err != nil {
+		n.logger.Error("unable to store", "key", key, "err", err)
+		return false
+	}
+	// Retry later if the ring has fewer replicas than required
+	return len(userSt.Replicas) == n.factor-1
+}
 
-			syncArgs := rpcs.SyncArgs{
-				UserState: userSt,
-			}
-			reply := rpcs.Ack{}
+// replicate sends the state of key to the replicas of its primary
+// and records them in the state. It reports whether all replicas
+// accepted it
+func (n *node) replicate(key string, userSt *rpcs.State) bool {
+	replicas := n.replicas[userSt.Primary]
+	if n.place != nil {
+		replicas = n.placeReplicas(key)
+	}
+	if len(replicas) > n.factor-1 {
+		replicas = replicas[:n.factor-1]
+	}
+	if len(replicas) == 0 && n.place == nil {
+		// Replicas assigned by the loadbalancer take precedence,
+		// the gossip view covers the time before they arrive
+		replicas = n.viewReplicas(key)
+	}
+	if len(replicas) == 0 {
+		return false
+	}
+	userSt.Replicas = nil
+	for _, replica := range replicas {
+		userSt.Replicas = append(userSt.Replicas, replica.Key)
+	}
 
-			err := replica.Conn.Call("Node.RecvState", &syncArgs, &reply)
+	syncArgs := rpcs.SyncArgs{
+		Key:       key,
+		UserState: *userSt,
+	}
+	success := true
+	for _, replica := range replicas {
+		reply := rpcs.Ack{}
+		if err := n.call(replica, "Node.RecvState", &syncArgs.Epoch, &syncArgs, &reply); err != nil {
+			n.logger.Warn("cannot call Node.RecvState", "peer", replica.Key, "key", key, "err", err)
+			success = false
+		} else if !reply.Success {
+			success = false
+		}
+	}
+	return success
+}
 
-			if err != nil {
-				fmt.Println("Cannot call RPC")
-			} else if reply.Success {
-				fmt.Println("State Replicated")
-				n.stateMap[key] = userSt
-				return true
-			}
+// putValue stores the value of a key as its primary
+func (n *node) putValue(args *rpcs.KVArgs) (rpcs.KVReply, error) {
+	userSt, exist, err := n.store.Get(args.Key)
+	if err != nil {
+		return rpcs.KVReply{}, rpcs.Errorf(rpcs.CodeStorage, "unable to read %s: %v", args.Key, err)
+	}
+	if !exist {
+		userSt = rpcs.State{
+			Hash: n.hasher.Hash(args.Key),
 		}
 	}
-	return false
+	userSt.Primary = args.NodeID
+	userSt.Value = args.Value
+	userSt.Deleted = false
+	return n.commit(args.Key, userSt)
+}
+
+// getValue returns the value of a key
+func (n *node) getValue(args *rpcs.KVArgs) (rpcs.KVReply, error) {
+	userSt, exist, err := n.store.Get(args.Key)
+	if err != nil {
+		return rpcs.KVReply{}, rpcs.Errorf(rpcs.CodeStorage, "unable to read %s: %v", args.Key, err)
+	}
+	return rpcs.KVReply{
+		Success: true,
+		Found:   exist && !userSt.Deleted,
+		Value:   userSt.Value,
+	}, nil
+}
+
+// deleteValue removes a key. The deletion is kept as a state so
+// that replicas and restarted nodes learn about it
+func (n *node) deleteValue(args *rpcs.KVArgs) (rpcs.KVReply, error) {
+	userSt, exist, err := n.store.Get(args.Key)
+	if err != nil {
+		return rpcs.KVReply{}, rpcs.Errorf(rpcs.CodeStorage, "unable to read %s: %v", args.Key, err)
+	} else if !exist || userSt.Deleted {
+		return rpcs.KVReply{Success: true}, nil
+	}
+	userSt.Primary = args.NodeID
+	userSt.Value = nil
+	userSt.Deleted = true
+	return n.commit(args.Key, userSt)
+}
+
+// commit stores a new version of the state of key
+// and replicates it
+func (n *node) commit(key string, userSt rpcs.State) (rpcs.KVReply, error) {
+	userSt.Version = n.tick()
+	if err := n.store.Put(key, userSt); err != nil {
+		return rpcs.KVReply{}, rpcs.Errorf(rpcs.CodeStorage, "unable to store %s: %v", key, err)
+	}
+	if !n.replState(key) {
+		n.unRepl = append(n.unRepl, key)
+	}
+	return rpcs.KVReply{Success: true}, nil
+}
+
+// merge stores a state received from another node unless
+// a newer version of it is already stored
+func (n *node) merge(key string, userSt rpcs.State) error {
+	curr, exist, err := n.store.Get(key)
+	if err == nil && exist && curr.Version > userSt.Version {
+		return nil
+	}
+	if err == nil {
+		err = n.store.Put(key, userSt)
+	}
+	if err != nil {
+		n.logger.Error("unable to store", "key", key, "err", err)
+		return rpcs.Errorf(rpcs.CodeStorage, "unable to store %s: %v", key, err)
+	}
+	if userSt.Version > n.clock {
+		n.clock = userSt.Version
+	}
+	return nil
+}
+
+// tick returns the version of a new write. Versions follow the
+// wall clock so that writes of successive primaries of a key
+// are ordered as long as the clocks of the nodes agree
+func (n *node) tick() uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now <= n.clock {
+		now = n.clock + 1
+	}
+	n.clock = now
+	return now
+}
+
+// since returns the newest version of the states owned by the
+// virtual node key, so that a restarted node only fetches the
+// states of its ranges that changed while it was down
+func (n *node) since(key string) uint64 {
+	var version uint64
+	n.store.Range(func(_ string, state rpcs.State) bool {
+		if state.Primary == key && state.Version > version {
+			version = state.Version
+		}
+		return true
+	})
+	return version
 }
 
+// updateRing replaces the replicas of the virtual nodes
+// of the node with those assigned by the loadbalancer and
+// replicates the states whose replicas changed
 func (n *node) updateRing(args *rpcs.ReplicaArgs) rpcs.Ack {
-	for i := 0; i < len(args.Replicas); i++ {
-		replica := args.Replicas[i]
-		res := n.ring.AddSolo(replica.Key, replica.ParentKey, replica.Port)
-		if !res {
-			fmt.Println("Unable to add", replica)
+	if args.Factor > 0 {
+		n.factor = args.Factor
+	}
+	n.replicas = make(map[string][]*consistent.CNode)
+	for _, replica := range args.Replicas {
+		n.replicas[replica.Virtual] = append(n.replicas[replica.Virtual], repCNode(replica))
+		n.logger.Debug("replica assigned", "virtual", replica.Virtual, "replica", replica.Key)
+	}
+
+	var keys []string
+	n.store.Range(func(key string, state rpcs.State) bool {
+		replicas, own := n.replicas[state.Primary]
+		if own && !sameReplicas(state.Replicas, replicas[:min(len(replicas), n.factor-1)]) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if len(keys) > 0 {
+		n.logger.Info("replicating states to new replicas", "states", len(keys))
+	}
+	for _, key := range keys {
+		if !n.replState(key) {
+			n.unRepl = append(n.unRepl, key)
 		}
-		fmt.Println("Replica Key", args.Replicas[i].Key)
 	}
 	return rpcs.Ack{Success: true}
 }
 
+// placeReplicas returns the members other than the node
+// placed to hold key
+func (n *node) placeReplicas(key string) []*consistent.CNode {
+	var replicas []*consistent.CNode
+	for _, holder := range n.place.LookupN(key, n.factor) {
+		if holder.Key != n.id {
+			replicas = append(replicas, holder)
+		}
+	}
+	return replicas
+}
+
+// rebalance places keys on the members of args from now on and
+// moves the states stored by the node along: every state is sent
+// to the members placed to hold it that did not hold it before
+// and dropped once the node no longer holds it itself. Holders
+// keep the state with its new primary and replicas. It reports
+// whether the node handed over all the states it dropped
+func (n *node) rebalance(args *rpcs.PlaceArgs) bool {
+	members := make([]*consistent.CNode, 0, len(args.Members))
+	for _, member := range args.Members {
+		members = append(members, &consistent.CNode{
+			Key:    member.Key,
+			Weight: member.Weight,
+			Meta:   member.Meta,
+		})
+	}
+	place, err := consistent.Place(args.Algorithm, n.hasher, members)
+	if err != nil {
+		n.logger.Error("unable to place keys", "algorithm", args.Algorithm, "err", err)
+		return false
+	}
+	prev := n.place
+	n.place = place
+	if args.Factor > 0 {
+		n.factor = args.Factor
+	}
+
+	var keys []string
+	n.store.Range(func(key string, _ rpcs.State) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sent := true
+	for _, key := range keys {
+		userSt, exist, err := n.store.Get(key)
+		holders := place.LookupN(key, n.factor)
+		if err != nil || !exist || len(holders) == 0 {
+			continue
+		}
+		held := make(map[string]bool)
+		if prev != nil {
+			for _, holder := range prev.LookupN(key, n.factor) {
+				held[holder.Key] = holder.Key != args.Joined
+			}
+		}
+		userSt.Primary = holders[0].Key
+		userSt.Replicas = nil
+		for _, holder := range holders[1:] {
+			userSt.Replicas = append(userSt.Replicas, holder.Key)
+		}
+
+		kept, delivered := false, true
+		syncArgs := rpcs.SyncArgs{
+			Key:       key,
+			UserState: userSt,
+		}
+		for _, holder := range holders {
+			if holder.Key == n.id {
+				kept = true
+				continue
+			} else if held[holder.Key] {
+				continue
+			}
+			reply := rpcs.Ack{}
+			if err := n.call(holder, "Node.RecvState", &syncArgs.Epoch, &syncArgs, &reply); err != nil {
+				n.logger.Warn("cannot call Node.RecvState", "peer", holder.Key, "key", key, "err", err)
+				delivered = false
+			}
+		}
+		switch {
+		case kept:
+			err = n.store.Put(key, userSt)
+		case delivered:
+			err = n.store.Delete(key)
+		default:
+			sent = false
+		}
+		if err != nil {
+			n.logger.Error("unable to store", "key", key, "err", err)
+		}
+	}
+	return sent
+}
+
+// updateView applies a change of the gossip membership
+// to the full view of the ring
+func (n *node) updateView(member gossip.Member) {
+	if member.Meta[gossip.MetaRole] != gossip.RoleNode {
+		return
+	}
+	switch member.State {
+	case gossip.Alive:
+		weight, _ := strconv.Atoi(member.Meta[gossip.MetaWeight])
+		if curr := n.view.Member(member.Name); curr == nil {
+			n.view.AddNode(member.Name, weight, member.Meta)
+		} else if curr.Weight != weight {
+			n.view.Reweight(member.Name, weight)
+		}
+	case gossip.Dead, gossip.Left:
+		n.view.RemoveNode(member.Name)
+	}
+	n.logger.Info("gossip view changed", "member", member.Name, "state", member.State.String(), "members", n.view.Size())
+}
+
+// viewReplicas returns the members following key in the gossip
+// view, picked like the loadbalancer does: away from the failure
+// domains of the node
+func (n *node) viewReplicas(key string) []*consistent.CNode {
+	owner := consistent.CNode{
+		Hash:      n.hasher.Hash(key),
+		ParentKey: n.id,
+	}
+	return n.view.GetNextParents(&owner, n.factor-1)
+}
+
+// meta returns the metadata the node advertises
+func (n *node) meta() map[string]string {
+	meta := transport.Meta(n.addr, n.addrs)
+	meta[consistent.MetaZone] = n.zone
+	meta[consistent.MetaRack] = n.rack
+	meta[gossip.MetaRole] = gossip.RoleNode
+	meta[gossip.MetaWeight] = strconv.Itoa(n.weight)
+	meta[gossip.MetaHasher] = n.hasher.Name()
+	return meta
+}
+
 func (n *node) GetStatus(args *rpcs.Ack, reply *rpcs.Ack) error {
 	return nil
 }
 
 func (n *node) Lookup(args *rpcs.LookupInfo, reply *rpcs.Ack) error {
+	if args.Key == "" || args.Src.Key == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "lookup of %q from %q", args.Key, args.Src.Key)
+	}
+	n.advance(args.Epoch)
 	ex := lookupEx{
 		args: args,
 		rep:  make(chan rpcs.Ack),
@@ -263,6 +820,10 @@ func (n *node) Lookup(args *rpcs.LookupInfo, reply *rpcs.Ack) error {
 }
 
 func (n *node) Replace(args *rpcs.ReplaceArgs, reply *rpcs.Ack) error {
+	if args.Old == "" || args.New.Key == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "replace of %q with %q", args.Old, args.New.Key)
+	}
+	n.advance(args.Epoch)
 	repEx := replaceEx{
 		args: args,
 		rep:  make(chan rpcs.Ack),
@@ -273,37 +834,133 @@ func (n *node) Replace(args *rpcs.ReplaceArgs, reply *rpcs.Ack) error {
 }
 
 func (n *node) RecvState(args *rpcs.SyncArgs, reply *rpcs.Ack) error {
+	if err := n.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	if args.Key == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "state without a key")
+	}
 	stateEx := stateEx{
 		args: args,
-		rep:  make(chan rpcs.Ack),
+		rep:  make(chan error),
 	}
 	n.stateCh <- stateEx
-	*reply = <-stateEx.rep
-	return nil
+	return ack(reply, <-stateEx.rep)
 }
 
 func (n *node) GetRequest(args *rpcs.ReqArgs, reply *rpcs.Ack) error {
+	if err := n.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
+	if args.ID == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "request without a user")
+	}
 	reqEx := requestEx{
 		args: args,
-		rep:  make(chan rpcs.Ack),
+		rep:  make(chan error),
 	}
 	n.reqCh <- reqEx
-	fmt.Println("Request rcvd", args.ID, args.NodeID)
-	*reply = <-reqEx.rep
+	n.logger.Debug("request received", "request", args.ID, "virtual", args.NodeID)
+	return ack(reply, <-reqEx.rep)
+}
+
+func (n *node) Put(args *rpcs.KVArgs, reply *rpcs.Ack) error {
+	rep, err := n.doKV(opPut, args)
+	*reply = rpcs.Ack{Success: rep.Success}
+	return err
+}
+
+func (n *node) Get(args *rpcs.KVArgs, reply *rpcs.KVReply) error {
+	rep, err := n.doKV(opGet, args)
+	*reply = rep
+	return err
+}
+
+func (n *node) Delete(args *rpcs.KVArgs, reply *rpcs.Ack) error {
+	rep, err := n.doKV(opDelete, args)
+	*reply = rpcs.Ack{Success: rep.Success}
+	return err
+}
+
+// doKV checks a key/value request and hands it over
+// to handleRequests
+func (n *node) doKV(op string, args *rpcs.KVArgs) (rpcs.KVReply, error) {
+	if err := n.checkEpoch(args.Epoch); err != nil {
+		return rpcs.KVReply{}, err
+	}
+	if args.Key == "" {
+		return rpcs.KVReply{}, rpcs.Errorf(rpcs.CodeInvalid, "%s without a key", op)
+	}
+	ex := kvEx{
+		op:   op,
+		args: args,
+		rep:  make(chan kvReply),
+	}
+	n.kvCh <- ex
+	rep := <-ex.rep
+	return rep.reply, rep.err
+}
+
+func (n *node) Promote(args *rpcs.PromoteArgs, reply *rpcs.Ack) error {
+	if args.Old == "" || args.New.Key == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "promote of %q to %q", args.Old, args.New.Key)
+	}
+	n.advance(args.Epoch)
+	ex := promoteEx{
+		args: args,
+		rep:  make(chan rpcs.Ack),
+	}
+	n.promoteCh <- ex
+	*reply = <-ex.rep
+	return nil
+}
+
+func (n *node) Place(args *rpcs.PlaceArgs, reply *rpcs.Ack) error {
+	if _, err := consistent.NewAlgorithm(args.Algorithm, n.hasher); err != nil {
+		return rpcs.Errorf(rpcs.CodeInvalid, "%v", err)
+	}
+	n.advance(args.Epoch)
+	ex := placeEx{
+		args: args,
+		rep:  make(chan rpcs.Ack),
+	}
+	n.placeCh <- ex
+	*reply = <-ex.rep
+	return nil
+}
+
+func (n *node) Reweight(args *rpcs.ReweightArgs, reply *rpcs.Ack) error {
+	if args.Weight < 1 {
+		return rpcs.Errorf(rpcs.CodeInvalid, "weight %d is below 1", args.Weight)
+	}
+	ex := weightEx{
+		args: args,
+		rep:  make(chan rpcs.Ack),
+	}
+	n.weightCh <- ex
+	*reply = <-ex.rep
 	return nil
 }
 
 func (n *node) CopyBulk(args *rpcs.LookupInfo, reply *rpcs.BulkStates) error {
+	if err := n.checkEpoch(args.Epoch); err != nil {
+		return err
+	}
 	blkEx := bulkEx{
 		args: args,
-		rep:  make(chan rpcs.BulkStates),
+		rep:  make(chan bulkReply),
 	}
 	n.bulkCh <- blkEx
-	*reply = <-blkEx.rep
-	return nil
+	rep := <-blkEx.rep
+	*reply = rep.states
+	return rep.err
 }
 
 func (n *node) RemoveAll(args *rpcs.RemoveAll, reply *rpcs.Ack) error {
+	if args.ID == "" && !args.All {
+		return rpcs.Errorf(rpcs.CodeInvalid, "remove without a virtual node")
+	}
+	n.advance(args.Epoch)
 	rmvEx := removeEx{
 		args: args,
 		rep:  make(chan rpcs.Ack),
@@ -314,6 +971,10 @@ func (n *node) RemoveAll(args *rpcs.RemoveAll, reply *rpcs.Ack) error {
 }
 
 func (n *node) Copy(args *rpcs.CopyArgs, reply *rpcs.Ack) error {
+	if args.Target == "" {
+		return rpcs.Errorf(rpcs.CodeInvalid, "copy without a target")
+	}
+	n.advance(args.Epoch)
 	cpyEx := copyEx{
 		args: args,
 		rep:  make(chan rpcs.Ack),
@@ -324,6 +985,7 @@ func (n *node) Copy(args *rpcs.CopyArgs, reply *rpcs.Ack) error {
 }
 
 func (n *node) GetReplicas(args *rpcs.ReplicaArgs, ack *rpcs.Ack) error {
+	n.advance(args.Epoch)
 	repEx := replicaEx{
 		args: args,
 		rep:  make(chan rpcs.Ack),
@@ -338,7 +1000,7 @@ func (n *node) joinLB(dst string) error {
 	reply := rpcs.Ack{}
 
 	// Sending join Request to LoadBalancer
-	conn, err := rpc.DialHTTP("tcp", dst)
+	conn, err := n.transport.Dial(n.ctx, dst)
 
 	if err != nil {
 		return err
@@ -346,17 +1008,171 @@ func (n *node) joinLB(dst string) error {
 	defer conn.Close()
 	args := rpcs.JoinArgs{
 		Port:   n.myPort,
+		Addr:   n.addr,
+		Addrs:  n.addrs,
 		Weight: n.weight,
 		ID:     n.id,
+		Hasher: n.hasher.Name(),
+		Zone:   n.zone,
+		Rack:   n.rack,
 	}
 	if err := conn.Call("LoadBalancer.Join", &args, &reply); err != nil {
-		return err
+		return rpcs.FromError(err)
 	} else if !reply.Success {
 		return errors.New("LoadBalancer returned failure")
 	}
 	return nil
 }
 
+// ack sets reply after the outcome of a request and returns err
+func ack(reply *rpcs.Ack, err error) error {
+	*reply = rpcs.Ack{Success: err == nil}
+	return err
+}
+
+// Leave asks the loadbalancer to remove the node, which hands its
+// states over meanwhile, and only then gossips that it left
+func (n *node) Leave() error {
+	args := rpcs.LeaveArgs{ID: n.id}
+	reply := rpcs.Ack{}
+	if err := n.pool.CallContext(n.ctx, []string{n.lb}, "LoadBalancer.Leave", &args, &reply); err != nil {
+		return rpcs.FromError(err)
+	}
+	n.gossip.Leave()
+	n.Close()
+	return nil
+}
+
+// Close stops gossiping without a word, members learn the node
+// is gone by probing it
 func (n *node) Close() {
+	n.cancel()
+	n.gossip.Stop()
 	n.listener.Close()
+	n.pool.Close()
+	n.store.Close()
+}
+
+// call invokes method on the node owning the ring entry
+func (n *node) call(node *consistent.CNode, method string, epoch *uint64, args interface{}, reply interface{}) error {
+	return n.callPeer(transport.Addrs(node.Meta), method, epoch, args, reply)
+}
+
+// defaultCallTimeout is the time a call to another node
+// may take unless configured otherwise
+const defaultCallTimeout = 10 * time.Second
+
+// callPeer invokes method on another node stamping epoch with the
+// epoch of the node. A peer that saw a newer ring rejects the call,
+// the node then learns that epoch and calls once more: the ranges
+// a node serves and replicates are assigned by the loadbalancer,
+// which updates them on every change of the ring. Every attempt
+// gives up after the call timeout
+func (n *node) callPeer(addrs []string, method string, epoch *uint64, args interface{}, reply interface{}) error {
+	*epoch = atomic.LoadUint64(&n.epoch)
+	err := n.callTimeout(addrs, method, args, reply)
+	if newer, ok := rpcs.WrongOwnerEpoch(err); ok {
+		n.advance(newer)
+		*epoch = newer
+		err = n.callTimeout(addrs, method, args, reply)
+	}
+	return err
+}
+
+// callTimeout invokes method on the first of addrs reachable,
+// giving up after the call timeout or once the node is closed
+func (n *node) callTimeout(addrs []string, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(n.ctx, n.callWait)
+	defer cancel()
+	return n.pool.CallContext(ctx, addrs, method, args, reply)
+}
+
+// owns reports whether virtual is one of the virtual nodes
+// of the node
+func (n *node) owns(virtual string) bool {
+	for walk := 0; walk < n.weight; walk++ {
+		if n.view.GetVirKey(n.id, walk) == virtual {
+			return true
+		}
+	}
+	return false
+}
+
+// advance records that the ring of the loadbalancers
+// reached epoch
+func (n *node) advance(epoch uint64) {
+	for {
+		curr := atomic.LoadUint64(&n.epoch)
+		if epoch <= curr || atomic.CompareAndSwapUint64(&n.epoch, curr, epoch) {
+			return
+		}
+	}
+}
+
+// checkEpoch rejects a request routed with a ring older than
+// the newest one the node has seen, the sender has to route it
+// again. Requests without an epoch are always served
+func (n *node) checkEpoch(epoch uint64) error {
+	if curr := atomic.LoadUint64(&n.epoch); epoch > 0 && epoch < curr {
+		n.logger.Info("rejecting request of stale epoch", "epoch", epoch, "current", curr)
+		return rpcs.WrongOwner{Epoch: curr}
+	}
+	n.advance(epoch)
+	return nil
+}
+
+// inRange reports whether hash lies in the range of the ring
+// from start to end, both included. The range wraps around zero
+// when start is past end
+func inRange(hash, start, end uint64) bool {
+	if start <= end {
+		return hash >= start && hash <= end
+	}
+	return hash >= start || hash <= end
+}
+
+// contains reports whether keys holds key
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sameReplicas reports whether keys are those of the
+// replicas, in the same order
+func sameReplicas(keys []string, replicas []*consistent.CNode) bool {
+	if len(keys) != len(replicas) {
+		return false
+	}
+	for walk, replica := range replicas {
+		if keys[walk] != replica.Key {
+			return false
+		}
+	}
+	return true
+}
+
+// containsMember reports whether nodes holds a node of member
+func containsMember(nodes []*consistent.CNode, member string) bool {
+	for _, node := range nodes {
+		if node.ParentKey == member {
+			return true
+		}
+	}
+	return false
+}
+
+// repCNode returns the ring entry of a replica
+func repCNode(replica rpcs.RepNode) *consistent.CNode {
+	meta := transport.Meta(replica.Addr, replica.Addrs)
+	meta[consistent.MetaZone] = replica.Zone
+	meta[consistent.MetaRack] = replica.Rack
+	return &consistent.CNode{
+		Key:       replica.Key,
+		ParentKey: replica.ParentKey,
+		Meta:      meta,
+	}
 }
@@ -7,6 +7,11 @@ import (
 // Node ...
 type Node interface {
 	StartNode(dst string) error
+	// Leave removes the node from the ring, tells the gossip
+	// it left for good and closes it
+	Leave() error
+	// Close stops the node without leaving the ring, as for
+	// a restart. Peers find it gone unless it comes back
 	Close()
 }
 
@@ -17,7 +22,7 @@ type replicaEx struct {
 
 type requestEx struct {
 	args *rpcs.ReqArgs
-	rep  chan rpcs.Ack
+	rep  chan error
 }
 
 type removeEx struct {
@@ -42,10 +47,48 @@ type lookupEx struct {
 
 type bulkEx struct {
 	args *rpcs.LookupInfo
-	rep  chan rpcs.BulkStates
+	rep  chan bulkReply
+}
+
+type bulkReply struct {
+	states rpcs.BulkStates
+	err    error
 }
 
 type stateEx struct {
 	args *rpcs.SyncArgs
+	rep  chan error
+}
+
+type promoteEx struct {
+	args *rpcs.PromoteArgs
 	rep  chan rpcs.Ack
 }
+
+type weightEx struct {
+	args *rpcs.ReweightArgs
+	rep  chan rpcs.Ack
+}
+
+type placeEx struct {
+	args *rpcs.PlaceArgs
+	rep  chan rpcs.Ack
+}
+
+// Operations of a kvEx
+const (
+	opPut    = "put"
+	opGet    = "get"
+	opDelete = "delete"
+)
+
+type kvEx struct {
+	op   string
+	args *rpcs.KVArgs
+	rep  chan kvReply
+}
+
+type kvReply struct {
+	reply rpcs.KVReply
+	err   error
+}
@@ -0,0 +1,30 @@
+package node
+
+import "testing"
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		name             string
+		hash, start, end uint64
+		want             bool
+	}{
+		{"inside", 15, 10, 20, true},
+		{"start", 10, 10, 20, true},
+		{"end", 20, 10, 20, true},
+		{"before", 5, 10, 20, false},
+		{"after", 25, 10, 20, false},
+		{"wrapped high", 95, 90, 10, true},
+		{"wrapped low", 5, 90, 10, true},
+		{"wrapped zero", 0, 90, 10, true},
+		{"wrapped outside", 50, 90, 10, false},
+		{"single hash", 10, 10, 10, true},
+		{"outside single hash", 11, 10, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inRange(tt.hash, tt.start, tt.end); got != tt.want {
+				t.Errorf("inRange(%d, %d, %d) = %v, want %v", tt.hash, tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+)
+
+// stateFile holds the persistent state of a replica
+const stateFile = "raft.state"
+
+// persistent is the state a replica must not forget
+// across restarts
+type persistent struct {
+	Term     uint64
+	Vote     string
+	Log      []Entry
+	Snapshot []byte
+}
+
+// persist writes the persistent state atomically. Must be
+// called with mu held
+func (r *Raft) persist() {
+	if r.config.Dir == "" {
+		return
+	}
+	state := persistent{
+		Term:     r.term,
+		Vote:     r.vote,
+		Log:      r.log,
+		Snapshot: r.snapshot,
+	}
+	if err := r.write(state); err != nil {
+		r.config.Logger.Error("unable to persist raft state", "err", err)
+	}
+}
+
+func (r *Raft) write(state persistent) error {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+	path := filepath.Join(r.config.Dir, stateFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// load restores the persistent state from the directory
+// of the replica, if any
+func (r *Raft) load() error {
+	if r.config.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(r.config.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.Dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state := persistent{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	if len(state.Log) == 0 {
+		state.Log = []Entry{{}}
+	}
+	r.term = state.Term
+	r.vote = state.Vote
+	r.log = state.Log
+	r.snapshot = state.Snapshot
+	return nil
+}
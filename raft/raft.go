@@ -0,0 +1,584 @@
+package raft
+
+import (
+	"conhash/transport"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Errors of Commit
+var (
+	ErrNotLeader = errors.New("not the leader")
+	// ErrLost is returned when leadership was lost before the entry
+	// was applied, the entry may still be applied later on
+	ErrLost    = errors.New("leadership lost")
+	ErrStopped = errors.New("raft stopped")
+)
+
+// Default settings of a replica
+const (
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 256
+	maxAppend                = 64 // entries sent by one AppendEntries
+)
+
+// Roles of a replica
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// Entry is a command of the replicated log. Entries with an
+// empty command are appended by new leaders and never applied
+type Entry struct {
+	Index   uint64 `protobuf:"1"`
+	Term    uint64 `protobuf:"2"`
+	Command []byte `protobuf:"3"`
+}
+
+// Config contains the settings of a replica
+type Config struct {
+	ID    string   // RPC address of the replica
+	Peers []string // RPC addresses of the other replicas
+	// ElectionTimeout is the least time a follower waits for the
+	// leader before standing for election, it waits up to twice
+	// as long. It defaults to a second
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration // time between two heartbeats, ElectionTimeout/5 if 0
+	SnapshotThreshold int           // applied entries kept before a snapshot, 256 if 0
+	Dir               string        // directory of the persistent state, memory only if empty
+	// Apply is called in log order with every committed entry
+	Apply func(Entry)
+	// Snapshot returns the state built by the entries applied so
+	// far and Restore replaces the state with a snapshot
+	Snapshot func() []byte
+	Restore  func([]byte)
+	// Transport carries the RPCs between replicas, net/rpc if nil
+	Transport transport.Transport
+	Logger    *slog.Logger // receives the diagnostics, slog.Default() if nil
+}
+
+// Raft replicates a log of commands among replicas. A leader elected
+// by a majority appends commands and replicates them, an entry stored
+// by a majority is committed and applied by every replica in the same
+// order. Applied entries are compacted into snapshots, replicas that
+// fall behind the snapshot are sent it instead of the entries
+type Raft struct {
+	mu          sync.Mutex
+	config      Config
+	role        int
+	term        uint64
+	vote        string
+	leader      string
+	log         []Entry // log[0] holds the index and term of the snapshot
+	snapshot    []byte
+	commit      uint64
+	applied     uint64
+	next        map[string]uint64
+	match       map[string]uint64
+	contact     map[string]time.Time // last reply of every peer to the leader
+	deadline    time.Time            // end of the election timeout
+	waiters     map[uint64]waiter
+	applyCh     chan struct{}
+	replicateCh chan struct{}
+	pool        *transport.Pool
+	done        chan struct{}
+	stop        sync.Once
+}
+
+// waiter is a command waiting to be applied
+type waiter struct {
+	term uint64
+	rep  chan error
+}
+
+// New returns a follower replica, restoring the persistent
+// state found in config.Dir
+func New(config Config) (*Raft, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = defaultElectionTimeout
+	}
+	if config.HeartbeatInterval <= 0 || config.HeartbeatInterval >= config.ElectionTimeout {
+		config.HeartbeatInterval = config.ElectionTimeout / 5
+	}
+	if config.SnapshotThreshold <= 0 {
+		config.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	r := &Raft{
+		config:      config,
+		log:         []Entry{{}},
+		next:        make(map[string]uint64),
+		match:       make(map[string]uint64),
+		contact:     make(map[string]time.Time),
+		waiters:     make(map[uint64]waiter),
+		applyCh:     make(chan struct{}, 1),
+		replicateCh: make(chan struct{}, 1),
+		pool:        transport.NewPoolWith(config.Transport),
+		done:        make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	// Snapshotted entries are committed
+	r.commit = r.log[0].Index
+	r.resetDeadline()
+	return r, nil
+}
+
+// Register serves the replica on server
+func (r *Raft) Register(server transport.Server) error {
+	return server.RegisterName("Raft", &Service{r: r})
+}
+
+// Start starts the election timer and the application of
+// entries. A replica without peers leads right away
+func (r *Raft) Start() {
+	r.mu.Lock()
+	if len(r.config.Peers) == 0 {
+		r.term++
+		r.vote = r.config.ID
+		r.persist()
+		r.becomeLeader()
+	}
+	r.mu.Unlock()
+	r.wakeApplier()
+
+	go r.run()
+	go r.applyEntries()
+}
+
+// Stop stops the replica, pending commands fail
+func (r *Raft) Stop() {
+	r.stop.Do(func() {
+		close(r.done)
+		r.pool.Close()
+		r.mu.Lock()
+		r.release(ErrStopped)
+		r.mu.Unlock()
+	})
+}
+
+// Leader returns the address of the leader known to the
+// replica, "" if unknown, and the current term
+func (r *Raft) Leader() (string, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader, r.term
+}
+
+// IsLeader reports whether the replica leads
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == leader
+}
+
+// Commit appends command to the log and waits until the
+// replica applied it
+func (r *Raft) Commit(command []byte) error {
+	r.mu.Lock()
+	if r.role != leader {
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+	entry := Entry{
+		Index:   r.lastIndex() + 1,
+		Term:    r.term,
+		Command: command,
+	}
+	r.log = append(r.log, entry)
+	r.persist()
+	rep := make(chan error, 1)
+	r.waiters[entry.Index] = waiter{term: entry.Term, rep: rep}
+	r.advanceCommit()
+	r.mu.Unlock()
+
+	r.kick()
+	select {
+	case err := <-rep:
+		return err
+	case <-r.done:
+		return ErrStopped
+	}
+}
+
+// run heartbeats while leading and stands for election
+// once the leader went silent
+func (r *Raft) run() {
+	ticker := time.NewTicker(r.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.replicateCh:
+		}
+
+		r.mu.Lock()
+		role := r.role
+		expired := time.Now().After(r.deadline)
+		if role == leader && !r.quorum() {
+			r.config.Logger.Warn("lost contact with the majority", "term", r.term)
+			r.stepDown(r.term)
+			role = follower
+		}
+		r.mu.Unlock()
+
+		if role == leader {
+			for _, peer := range r.config.Peers {
+				go r.replicate(peer)
+			}
+		} else if expired {
+			r.campaign()
+		}
+	}
+}
+
+// campaign stands for leader in a new term
+func (r *Raft) campaign() {
+	r.mu.Lock()
+	r.role = candidate
+	r.term++
+	r.vote = r.config.ID
+	r.leader = ""
+	r.resetDeadline()
+	r.persist()
+	args := VoteArgs{
+		Term:      r.term,
+		Candidate: r.config.ID,
+		LastIndex: r.lastIndex(),
+		LastTerm:  r.lastTerm(),
+	}
+	r.mu.Unlock()
+	r.config.Logger.Info("standing for leader", "term", args.Term)
+
+	votes := 1
+	for _, peer := range r.config.Peers {
+		go func(peer string) {
+			reply := VoteReply{}
+			if err := r.pool.CallTimeout([]string{peer}, r.config.ElectionTimeout/2, "Raft.RequestVote", &args, &reply); err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+			} else if reply.Granted && r.role == candidate && r.term == args.Term {
+				votes++
+				if votes >= r.majority() {
+					r.becomeLeader()
+				}
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the log. The empty entry of the new
+// term commits the entries left by former leaders. Must be
+// called with mu held
+func (r *Raft) becomeLeader() {
+	r.config.Logger.Info("leading", "term", r.term)
+	r.role = leader
+	r.leader = r.config.ID
+	now := time.Now()
+	for _, peer := range r.config.Peers {
+		r.next[peer] = r.lastIndex() + 1
+		r.match[peer] = 0
+		r.contact[peer] = now
+	}
+	r.log = append(r.log, Entry{Index: r.lastIndex() + 1, Term: r.term})
+	r.persist()
+	r.advanceCommit()
+	r.kick()
+}
+
+// stepDown follows the leader of term. Must be called with mu held
+func (r *Raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.vote = ""
+		r.leader = ""
+		r.persist()
+	}
+	if r.role == leader {
+		r.config.Logger.Info("stepping down", "term", r.term)
+		r.release(ErrLost)
+		r.leader = ""
+	}
+	if r.role != follower {
+		r.role = follower
+		r.resetDeadline()
+	}
+}
+
+// replicate sends peer the entries it misses, or the
+// snapshot once they were compacted
+func (r *Raft) replicate(peer string) {
+	r.mu.Lock()
+	if r.role != leader {
+		r.mu.Unlock()
+		return
+	}
+	if r.next[peer] <= r.log[0].Index {
+		r.mu.Unlock()
+		r.sendSnapshot(peer)
+		return
+	}
+	prev := r.next[peer] - 1
+	entries := r.log[prev-r.log[0].Index+1:]
+	if len(entries) > maxAppend {
+		entries = entries[:maxAppend]
+	}
+	args := AppendArgs{
+		Term:      r.term,
+		Leader:    r.config.ID,
+		PrevIndex: prev,
+		PrevTerm:  r.termAt(prev),
+		Entries:   append([]Entry(nil), entries...),
+		Commit:    r.commit,
+	}
+	r.mu.Unlock()
+
+	reply := AppendReply{}
+	if err := r.pool.CallTimeout([]string{peer}, r.config.ElectionTimeout/2, "Raft.AppendEntries", &args, &reply); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	} else if r.role != leader || r.term != args.Term {
+		return
+	}
+	r.contact[peer] = time.Now()
+	if reply.Success {
+		if match := prev + uint64(len(args.Entries)); match > r.match[peer] {
+			r.match[peer] = match
+			r.next[peer] = match + 1
+		}
+		r.advanceCommit()
+		if r.next[peer] <= r.lastIndex() {
+			r.kick()
+		}
+	} else {
+		r.next[peer] = reply.Conflict
+		if r.next[peer] < 1 {
+			r.next[peer] = 1
+		}
+		r.kick()
+	}
+}
+
+// sendSnapshot installs the snapshot on peer
+func (r *Raft) sendSnapshot(peer string) {
+	r.mu.Lock()
+	args := SnapshotArgs{
+		Term:      r.term,
+		Leader:    r.config.ID,
+		LastIndex: r.log[0].Index,
+		LastTerm:  r.log[0].Term,
+		Data:      r.snapshot,
+	}
+	r.mu.Unlock()
+
+	reply := SnapshotReply{}
+	if err := r.pool.CallTimeout([]string{peer}, r.config.ElectionTimeout/2, "Raft.InstallSnapshot", &args, &reply); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	} else if r.role != leader || r.term != args.Term {
+		return
+	}
+	r.contact[peer] = time.Now()
+	if args.LastIndex > r.match[peer] {
+		r.match[peer] = args.LastIndex
+		r.next[peer] = args.LastIndex + 1
+	}
+	r.kick()
+}
+
+// advanceCommit commits the newest entry of the current term
+// stored by a majority. Must be called with mu held
+func (r *Raft) advanceCommit() {
+	for index := r.lastIndex(); index > r.commit; index-- {
+		if r.termAt(index) != r.term {
+			break
+		}
+		stored := 1
+		for _, peer := range r.config.Peers {
+			if r.match[peer] >= index {
+				stored++
+			}
+		}
+		if stored >= r.majority() {
+			// Followers learn the commit index right away
+			r.commit = index
+			r.wakeApplier()
+			r.kick()
+			return
+		}
+	}
+}
+
+// quorum reports whether a majority answered the leader within
+// an election timeout, a leader cut off from it steps down
+// rather than wait forever. Must be called with mu held
+func (r *Raft) quorum() bool {
+	reached := 1
+	for _, peer := range r.config.Peers {
+		if time.Since(r.contact[peer]) < r.config.ElectionTimeout {
+			reached++
+		}
+	}
+	return reached >= r.majority()
+}
+
+// applyEntries applies the committed entries in order
+// and compacts the log once it grew long enough
+func (r *Raft) applyEntries() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.applyCh:
+		}
+
+		for {
+			r.mu.Lock()
+			if r.applied < r.log[0].Index {
+				// The snapshot is ahead of the state
+				index, data := r.log[0].Index, r.snapshot
+				r.mu.Unlock()
+				if r.config.Restore != nil {
+					r.config.Restore(data)
+				}
+				r.mu.Lock()
+				r.applied = index
+				r.resolve(index, 0)
+				r.mu.Unlock()
+				continue
+			}
+			if r.applied >= r.commit {
+				r.mu.Unlock()
+				break
+			}
+			entry := r.log[r.applied+1-r.log[0].Index]
+			r.mu.Unlock()
+
+			if len(entry.Command) > 0 && r.config.Apply != nil {
+				r.config.Apply(entry)
+			}
+
+			r.mu.Lock()
+			r.applied = entry.Index
+			r.resolve(entry.Index, entry.Term)
+			compact := r.applied-r.log[0].Index >= uint64(r.config.SnapshotThreshold)
+			r.mu.Unlock()
+
+			if compact && r.config.Snapshot != nil {
+				r.compact(entry.Index, r.config.Snapshot())
+			}
+		}
+	}
+}
+
+// resolve answers the commands waiting for the entries up to
+// index, term is that of the entry at index or 0 for a snapshot.
+// Must be called with mu held
+func (r *Raft) resolve(index uint64, term uint64) {
+	for walk, w := range r.waiters {
+		if walk > index {
+			continue
+		}
+		if walk == index && term != 0 && w.term != term {
+			w.rep <- ErrLost
+		} else {
+			w.rep <- nil
+		}
+		delete(r.waiters, walk)
+	}
+}
+
+// release fails every waiting command. Must be called with mu held
+func (r *Raft) release(err error) {
+	for walk, w := range r.waiters {
+		w.rep <- err
+		delete(r.waiters, walk)
+	}
+}
+
+// compact replaces the entries up to index by the snapshot data
+func (r *Raft) compact(index uint64, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index <= r.log[0].Index || index > r.applied {
+		return
+	}
+	term := r.termAt(index)
+	r.log = append([]Entry{{Index: index, Term: term}}, r.log[index-r.log[0].Index+1:]...)
+	r.snapshot = data
+	r.persist()
+	r.config.Logger.Info("compacted log", "index", index)
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must
+// not precede the snapshot
+func (r *Raft) termAt(index uint64) uint64 {
+	return r.log[index-r.log[0].Index].Term
+}
+
+func (r *Raft) majority() int {
+	return (len(r.config.Peers)+1)/2 + 1
+}
+
+func (r *Raft) resetDeadline() {
+	timeout := r.config.ElectionTimeout
+	r.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+func (r *Raft) kick() {
+	select {
+	case r.replicateCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) wakeApplier() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
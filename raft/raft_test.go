@@ -0,0 +1,321 @@
+package raft
+
+import (
+	"conhash/transport"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quiet discards the diagnostics of the replicas
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testTimeout is the election timeout of the replicas of a test
+const testTimeout = 200 * time.Millisecond
+
+// machine is the state a replica builds: the commands it
+// applied in order
+type machine struct {
+	mu       sync.Mutex
+	commands []string
+	restores int
+}
+
+func (m *machine) apply(entry Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, string(entry.Command))
+}
+
+func (m *machine) snapshot() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return []byte(strings.Join(m.commands, "\n"))
+}
+
+func (m *machine) restore(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = nil
+	if len(data) > 0 {
+		m.commands = strings.Split(string(data), "\n")
+	}
+	m.restores++
+}
+
+func (m *machine) state() ([]string, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...), m.restores
+}
+
+// replica is a member of a test cluster, running while raft is set
+type replica struct {
+	addr     string
+	dir      string
+	raft     *Raft
+	machine  *machine
+	listener *transport.Listener
+}
+
+// cluster runs replicas in the test process
+type cluster struct {
+	t         *testing.T
+	replicas  []*replica
+	threshold int
+}
+
+// newCluster starts size replicas, keeping their persistent
+// state on disk when persist is set
+func newCluster(t *testing.T, size int, threshold int, persist bool) *cluster {
+	t.Helper()
+	c := &cluster{t: t, threshold: threshold}
+	for walk := 0; walk < size; walk++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &replica{addr: listener.Addr().String()}
+		listener.Close()
+		if persist {
+			r.dir = t.TempDir()
+		}
+		c.replicas = append(c.replicas, r)
+	}
+	for walk := range c.replicas {
+		c.start(walk)
+	}
+	t.Cleanup(func() {
+		for walk := range c.replicas {
+			c.stop(walk)
+		}
+	})
+	return c
+}
+
+// start starts replica i with an empty state machine, restoring
+// whatever it persisted
+func (c *cluster) start(i int) {
+	c.t.Helper()
+	r := c.replicas[i]
+	var peers []string
+	for _, other := range c.replicas {
+		if other != r {
+			peers = append(peers, other.addr)
+		}
+	}
+	r.machine = &machine{}
+	raft, err := New(Config{
+		ID:                r.addr,
+		Peers:             peers,
+		ElectionTimeout:   testTimeout,
+		SnapshotThreshold: c.threshold,
+		Dir:               r.dir,
+		Apply:             r.machine.apply,
+		Snapshot:          r.machine.snapshot,
+		Restore:           r.machine.restore,
+		Logger:            quiet,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.listener, err = transport.Listen(r.addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	server := transport.NetRPC().NewServer()
+	raft.Register(server)
+	go server.Serve(r.listener)
+	r.raft = raft
+	raft.Start()
+}
+
+// stop stops replica i as a crash would
+func (c *cluster) stop(i int) {
+	r := c.replicas[i]
+	if r.raft == nil {
+		return
+	}
+	r.raft.Stop()
+	r.listener.Close()
+	r.raft = nil
+}
+
+// leader waits for a single running replica to lead and
+// returns its index
+func (c *cluster) leader() int {
+	c.t.Helper()
+	deadline := time.Now().Add(20 * testTimeout)
+	for time.Now().Before(deadline) {
+		leaders := 0
+		found := -1
+		for walk, r := range c.replicas {
+			if r.raft != nil && r.raft.IsLeader() {
+				leaders++
+				found = walk
+			}
+		}
+		if leaders == 1 {
+			return found
+		}
+		time.Sleep(testTimeout / 10)
+	}
+	c.t.Fatal("no single leader elected")
+	return -1
+}
+
+// commit commits the commands through the leader, retrying
+// when leadership moves
+func (c *cluster) commit(commands ...string) {
+	c.t.Helper()
+	for _, command := range commands {
+		deadline := time.Now().Add(20 * testTimeout)
+		for {
+			err := c.replicas[c.leader()].raft.Commit([]byte(command))
+			if err == nil {
+				break
+			} else if err != ErrNotLeader || time.Now().After(deadline) {
+				c.t.Fatalf("commit of %s: %v", command, err)
+			}
+		}
+	}
+}
+
+// converge waits for every running replica to apply want
+func (c *cluster) converge(want []string) {
+	c.t.Helper()
+	deadline := time.Now().Add(20 * testTimeout)
+	for {
+		done := true
+		for walk, r := range c.replicas {
+			if r.raft == nil {
+				continue
+			}
+			got, _ := r.machine.state()
+			if !reflect.DeepEqual(got, want) {
+				if time.Now().After(deadline) {
+					c.t.Fatalf("replica %d applied %v, want %v", walk, got, want)
+				}
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(testTimeout / 10)
+	}
+}
+
+// commands returns the commands from cmd-start up to cmd-(end-1)
+func commands(start, end int) []string {
+	var commands []string
+	for walk := start; walk < end; walk++ {
+		commands = append(commands, "cmd-"+strconv.Itoa(walk))
+	}
+	return commands
+}
+
+func TestElection(t *testing.T) {
+	c := newCluster(t, 3, 0, false)
+	first := c.leader()
+	_, term := c.replicas[first].raft.Leader()
+
+	c.stop(first)
+	next := c.leader()
+	if next == first {
+		t.Fatal("stopped replica still leads")
+	}
+	addr, after := c.replicas[next].raft.Leader()
+	if after <= term {
+		t.Fatalf("new leader took over in term %d, the old one led in %d", after, term)
+	}
+
+	// The old leader follows the new one once it is back
+	c.start(first)
+	deadline := time.Now().Add(20 * testTimeout)
+	for {
+		known, _ := c.replicas[first].raft.Leader()
+		if known == addr && c.leader() == next {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("restarted replica follows %q, not %s", known, addr)
+		}
+		time.Sleep(testTimeout / 10)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3, 0, false)
+	lead := c.leader()
+	follower := (lead + 1) % 3
+	if err := c.replicas[follower].raft.Commit([]byte("cmd")); err != ErrNotLeader {
+		t.Fatalf("follower committed: %v", err)
+	}
+
+	c.commit(commands(0, 10)...)
+	c.converge(commands(0, 10))
+
+	// A majority keeps committing without the third replica,
+	// which catches up once it is back
+	c.stop(follower)
+	c.commit(commands(10, 20)...)
+	c.converge(commands(0, 20))
+	c.start(follower)
+	c.converge(commands(0, 20))
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	c := newCluster(t, 3, 5, false)
+	lead := c.leader()
+	lagging := (lead + 1) % 3
+	c.stop(lagging)
+
+	c.commit(commands(0, 20)...)
+	c.converge(commands(0, 20))
+	r := c.replicas[c.leader()].raft
+	r.mu.Lock()
+	compacted := r.log[0].Index
+	r.mu.Unlock()
+	if compacted == 0 {
+		t.Fatal("leader did not compact its log")
+	}
+
+	// The entries the replica misses are gone, only the
+	// snapshot brings it up to date
+	c.start(lagging)
+	c.converge(commands(0, 20))
+	if _, restores := c.replicas[lagging].machine.state(); restores == 0 {
+		t.Fatal("lagging replica caught up without a snapshot")
+	}
+	c.commit(commands(20, 25)...)
+	c.converge(commands(0, 25))
+}
+
+func TestPersistence(t *testing.T) {
+	c := newCluster(t, 3, 8, true)
+	c.commit(commands(0, 12)...)
+	c.converge(commands(0, 12))
+	_, term := c.replicas[c.leader()].raft.Leader()
+
+	// Every replica crashes and comes back with an empty state
+	// machine, the log and snapshot on disk rebuild it
+	for walk := range c.replicas {
+		c.stop(walk)
+	}
+	for walk := range c.replicas {
+		c.start(walk)
+	}
+	lead := c.leader()
+	if _, after := c.replicas[lead].raft.Leader(); after <= term {
+		t.Fatalf("leader of term %d after a restart in term %d", after, term)
+	}
+	c.converge(commands(0, 12))
+	c.commit(commands(12, 15)...)
+	c.converge(commands(0, 15))
+}
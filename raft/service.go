@@ -0,0 +1,192 @@
+package raft
+
+// VoteArgs asks for the vote of a replica
+type VoteArgs struct {
+	Term      uint64 `protobuf:"1"`
+	Candidate string `protobuf:"2"`
+	LastIndex uint64 `protobuf:"3"` // index of the last entry of the candidate
+	LastTerm  uint64 `protobuf:"4"`
+}
+
+// VoteReply tells whether the vote was granted
+type VoteReply struct {
+	Term    uint64 `protobuf:"1"`
+	Granted bool   `protobuf:"2"`
+}
+
+// AppendArgs replicates the entries following PrevIndex,
+// no entries make a heartbeat
+type AppendArgs struct {
+	Term      uint64  `protobuf:"1"`
+	Leader    string  `protobuf:"2"`
+	PrevIndex uint64  `protobuf:"3"`
+	PrevTerm  uint64  `protobuf:"4"`
+	Entries   []Entry `protobuf:"5"`
+	Commit    uint64  `protobuf:"6"` // commit index of the leader
+}
+
+// AppendReply tells whether the entries were appended,
+// Conflict is the index the leader should retry from
+type AppendReply struct {
+	Term     uint64 `protobuf:"1"`
+	Success  bool   `protobuf:"2"`
+	Conflict uint64 `protobuf:"3"`
+}
+
+// SnapshotArgs installs the snapshot of the entries
+// up to LastIndex
+type SnapshotArgs struct {
+	Term      uint64 `protobuf:"1"`
+	Leader    string `protobuf:"2"`
+	LastIndex uint64 `protobuf:"3"`
+	LastTerm  uint64 `protobuf:"4"`
+	Data      []byte `protobuf:"5"`
+}
+
+// SnapshotReply carries the term of the replica
+type SnapshotReply struct {
+	Term uint64 `protobuf:"1"`
+}
+
+// Service is the RPC service through which replicas talk
+type Service struct {
+	r *Raft
+}
+
+// RequestVote grants the vote to a candidate whose log is at
+// least as up to date, once per term
+func (s *Service) RequestVote(args *VoteArgs, reply *VoteReply) error {
+	r := s.r
+	if r.stopped() {
+		return ErrStopped
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	upToDate := args.LastTerm > r.lastTerm() ||
+		(args.LastTerm == r.lastTerm() && args.LastIndex >= r.lastIndex())
+	if (r.vote == "" || r.vote == args.Candidate) && upToDate {
+		r.vote = args.Candidate
+		r.persist()
+		r.resetDeadline()
+		reply.Granted = true
+	}
+	return nil
+}
+
+// AppendEntries appends the entries of the leader once the log
+// matches the one of the leader up to PrevIndex
+func (s *Service) AppendEntries(args *AppendArgs, reply *AppendReply) error {
+	r := s.r
+	if r.stopped() {
+		return ErrStopped
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.term || (args.Term == r.term && r.role != follower) {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	r.leader = args.Leader
+	r.resetDeadline()
+
+	// Entries up to the snapshot are committed already
+	entries := args.Entries
+	prev, prevTerm := args.PrevIndex, args.PrevTerm
+	for len(entries) > 0 && prev < r.log[0].Index {
+		prev, prevTerm = entries[0].Index, entries[0].Term
+		entries = entries[1:]
+	}
+	if prev < r.log[0].Index {
+		reply.Conflict = r.log[0].Index + 1
+		return nil
+	}
+	if prev > r.lastIndex() {
+		reply.Conflict = r.lastIndex() + 1
+		return nil
+	}
+	if term := r.termAt(prev); term != prevTerm {
+		// Skip the whole conflicting term at once
+		conflict := prev
+		for conflict > r.log[0].Index+1 && r.termAt(conflict-1) == term {
+			conflict--
+		}
+		reply.Conflict = conflict
+		return nil
+	}
+
+	changed := false
+	for walk, entry := range entries {
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			r.log = r.log[:entry.Index-r.log[0].Index]
+		}
+		r.log = append(r.log, entries[walk:]...)
+		changed = true
+		break
+	}
+	if changed {
+		r.persist()
+	}
+
+	last := prev + uint64(len(entries))
+	if args.Commit > r.commit {
+		r.commit = args.Commit
+		if r.commit > last {
+			r.commit = last
+		}
+		r.wakeApplier()
+	}
+	reply.Success = true
+	return nil
+}
+
+// InstallSnapshot replaces the log up to the snapshot of the leader
+func (s *Service) InstallSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	r := s.r
+	if r.stopped() {
+		return ErrStopped
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.term || (args.Term == r.term && r.role != follower) {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	r.leader = args.Leader
+	r.resetDeadline()
+	if args.LastIndex <= r.commit {
+		return nil
+	}
+
+	// Entries following the snapshot are kept if the logs agree
+	snapshot := Entry{Index: args.LastIndex, Term: args.LastTerm}
+	if args.LastIndex < r.lastIndex() && r.termAt(args.LastIndex) == args.LastTerm {
+		r.log = append([]Entry{snapshot}, r.log[args.LastIndex-r.log[0].Index+1:]...)
+	} else {
+		r.log = []Entry{snapshot}
+	}
+	r.snapshot = args.Data
+	r.commit = args.LastIndex
+	r.persist()
+	r.wakeApplier()
+	r.config.Logger.Info("installed snapshot", "index", args.LastIndex, "leader", args.Leader)
+	return nil
+}
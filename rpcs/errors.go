@@ -0,0 +1,122 @@
+package rpcs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code tells why an RPC failed
+type Code string
+
+// Codes of the errors returned by the RPCs
+const (
+	CodeInvalid     Code = "invalid"      // arguments the receiver cannot accept
+	CodeDuplicateID Code = "duplicate_id" // a member already has the ID
+	CodeNotMember   Code = "not_member"   // no member has the ID
+	CodeUnreachable Code = "unreachable"  // a node did not answer in time
+	CodeNoNodes     Code = "no_nodes"     // the ring has no member to serve
+	CodeWrongOwner  Code = "wrong_owner"  // the request was routed with a stale ring
+	CodeNoLeader    Code = "no_leader"    // no loadbalancer could commit the change
+	CodeRefused     Code = "refused"      // the change would leave the ring unable to serve
+	CodeStorage     Code = "storage"      // the store of a node failed
+	CodeUnknown     Code = "unknown"      // an error outside this model
+)
+
+// codes holds the codes an error message may start with
+var codes = map[Code]bool{
+	CodeInvalid:     true,
+	CodeDuplicateID: true,
+	CodeNotMember:   true,
+	CodeUnreachable: true,
+	CodeNoNodes:     true,
+	CodeWrongOwner:  true,
+	CodeNoLeader:    true,
+	CodeRefused:     true,
+	CodeStorage:     true,
+}
+
+// Error is the error of an RPC. Only the message of an error
+// crosses net/rpc and gRPC, so it starts with the code and
+// FromError recovers both on the other side
+type Error struct {
+	Code    Code
+	Message string
+}
+
+// Errorf returns an error of code with a formatted message
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// FromError returns the RPC error err stands for, nil if err is
+// nil. Errors which did not come from this model, such as a
+// broken connection, have the code CodeUnknown
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var owner WrongOwner
+	if errors.As(err, &owner) {
+		return owner.rpcError()
+	}
+	msg := err.Error()
+	if colon := strings.Index(msg, ": "); colon > 0 && codes[Code(msg[:colon])] {
+		return &Error{
+			Code:    Code(msg[:colon]),
+			Message: msg[colon+2:],
+		}
+	}
+	return &Error{
+		Code:    CodeUnknown,
+		Message: msg,
+	}
+}
+
+// CodeOf returns the code of err, empty if err is nil
+func CodeOf(err error) Code {
+	if e := FromError(err); e != nil {
+		return e.Code
+	}
+	return ""
+}
+
+// WrongOwner is returned by a node to a request carrying an
+// epoch older than Epoch, the epoch of the ring of the node
+type WrongOwner struct {
+	Epoch uint64
+}
+
+func (e WrongOwner) Error() string {
+	return e.rpcError().Error()
+}
+
+func (e WrongOwner) rpcError() *Error {
+	return Errorf(CodeWrongOwner, "epoch %d", e.Epoch)
+}
+
+// WrongOwnerEpoch tells whether err rejected a request routed
+// with a stale ring and the epoch the node expects. It also
+// recognizes the error once it went through an RPC
+func WrongOwnerEpoch(err error) (uint64, bool) {
+	e := FromError(err)
+	if e == nil || e.Code != CodeWrongOwner {
+		return 0, false
+	}
+	var epoch uint64
+	if _, err := fmt.Sscanf(e.Message, "epoch %d", &epoch); err != nil {
+		return 0, false
+	}
+	return epoch, true
+}
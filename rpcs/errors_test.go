@@ -0,0 +1,120 @@
+package rpcs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// Failing is served over net/rpc to return errors to a client
+type Failing struct{}
+
+// Fail returns the error the client asked for
+func (Failing) Fail(args KVArgs, reply *Ack) error {
+	if args.Epoch > 0 {
+		return WrongOwner{Epoch: args.Epoch}
+	}
+	return Errorf(Code(args.Key), "%s", args.Value)
+}
+
+// roundTrip returns the error a net/rpc client gets from Failing
+func roundTrip(t *testing.T, args KVArgs) error {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.Register(Failing{}); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+	return client.Call("Failing.Fail", args, &Ack{})
+}
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		want  *Error
+		epoch uint64
+		owner bool
+	}{
+		{"nil", nil, nil, 0, false},
+		{
+			"rpc error",
+			Errorf(CodeNotMember, "no member n1"),
+			&Error{Code: CodeNotMember, Message: "no member n1"},
+			0, false,
+		},
+		{
+			"wrapped rpc error",
+			fmt.Errorf("join: %w", Errorf(CodeRefused, "last node")),
+			&Error{Code: CodeRefused, Message: "last node"},
+			0, false,
+		},
+		{
+			"wrong owner",
+			WrongOwner{Epoch: 7},
+			&Error{Code: CodeWrongOwner, Message: "epoch 7"},
+			7, true,
+		},
+		{
+			"net/rpc server error",
+			roundTrip(t, KVArgs{Key: string(CodeStorage), Value: []byte("disk full")}),
+			&Error{Code: CodeStorage, Message: "disk full"},
+			0, false,
+		},
+		{
+			"net/rpc wrong owner",
+			roundTrip(t, KVArgs{Epoch: 12}),
+			&Error{Code: CodeWrongOwner, Message: "epoch 12"},
+			12, true,
+		},
+		{
+			// grpctransport sends the message as the status
+			// and turns it back into a server error
+			"grpc wrong owner",
+			rpc.ServerError(WrongOwner{Epoch: 3}.Error()),
+			&Error{Code: CodeWrongOwner, Message: "epoch 3"},
+			3, true,
+		},
+		{
+			"unknown prefix",
+			errors.New("gone: node left"),
+			&Error{Code: CodeUnknown, Message: "gone: node left"},
+			0, false,
+		},
+		{
+			"no prefix",
+			rpc.ErrShutdown,
+			&Error{Code: CodeUnknown, Message: rpc.ErrShutdown.Error()},
+			0, false,
+		},
+		{
+			"malformed epoch",
+			rpc.ServerError("wrong_owner: epoch seven"),
+			&Error{Code: CodeWrongOwner, Message: "epoch seven"},
+			0, false,
+		},
+		{
+			"missing epoch",
+			Errorf(CodeWrongOwner, "stale ring"),
+			&Error{Code: CodeWrongOwner, Message: "stale ring"},
+			0, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FromError(tt.err)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("FromError(%v) = %+v, want %+v", tt.err, got, tt.want)
+			}
+			epoch, owner := WrongOwnerEpoch(tt.err)
+			if epoch != tt.epoch || owner != tt.owner {
+				t.Errorf("WrongOwnerEpoch(%v) = %d, %v, want %d, %v", tt.err, epoch, owner, tt.epoch, tt.owner)
+			}
+		})
+	}
+}
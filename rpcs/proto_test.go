@@ -0,0 +1,156 @@
+package rpcs
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// messages are the Go types of the messages of rpcs.proto
+var messages = []interface{}{
+	JoinArgs{}, LeaveArgs{}, ReweightArgs{}, ReplaceArgs{}, LeaderReply{},
+	RingMember{}, RingReply{}, ExportArgs{}, ExportReply{}, PromoteArgs{},
+	CopyArgs{}, RemoveAll{}, ReqArgs{}, ReqReply{}, KVArgs{}, KVReply{},
+	ReplicaArgs{}, PlaceArgs{}, RepNode{}, State{}, BulkStates{},
+	LookupInfo{}, SyncArgs{}, Ack{},
+}
+
+// protoField is a field of a message of rpcs.proto
+type protoField struct {
+	kind string // type of the field, map<K, V> for a map
+	name string
+	num  int
+}
+
+var (
+	protoMessage = regexp.MustCompile(`^message (\w+) \{$`)
+	protoEntry   = regexp.MustCompile(`^(repeated )?(map<\w+, \w+>|\w+) (\w+) = (\d+);$`)
+	protoService = regexp.MustCompile(`^service (\w+) \{$`)
+	protoRPC     = regexp.MustCompile(`^rpc (\w+)\((\w+)\) returns \((\w+)\);$`)
+)
+
+// parseProto returns the fields of the messages of rpcs.proto
+// and the methods of its services as "Service.Method" mapped to
+// the names of their argument and reply
+func parseProto(t *testing.T) (map[string][]protoField, map[string][2]string) {
+	t.Helper()
+	data, err := os.ReadFile("rpcs.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string][]protoField)
+	methods := make(map[string][2]string)
+	message, service := "", ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		var m []string
+		switch {
+		case line == "}":
+			message, service = "", ""
+		case protoMessage.MatchString(line):
+			message = protoMessage.FindStringSubmatch(line)[1]
+			fields[message] = nil
+		case protoService.MatchString(line):
+			service = protoService.FindStringSubmatch(line)[1]
+		case message != "" && protoEntry.MatchString(line):
+			m = protoEntry.FindStringSubmatch(line)
+			num, _ := strconv.Atoi(m[4])
+			fields[message] = append(fields[message], protoField{kind: m[1] + m[2], name: m[3], num: num})
+		case service != "" && protoRPC.MatchString(line):
+			m = protoRPC.FindStringSubmatch(line)
+			methods[service+"."+m[1]] = [2]string{m[2], m[3]}
+		case message != "" || service != "":
+			t.Fatalf("cannot parse %q", line)
+		}
+	}
+	return fields, methods
+}
+
+// protoKind returns the type in rpcs.proto of the Go type t
+func protoKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int:
+		return "int64"
+	case reflect.Uint64:
+		return "uint64"
+	case reflect.Struct:
+		return t.Name()
+	case reflect.Map:
+		return "map<" + protoKind(t.Key()) + ", " + protoKind(t.Elem()) + ">"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "repeated " + protoKind(t.Elem())
+	}
+	return t.String()
+}
+
+func TestProtoMessages(t *testing.T) {
+	fields, _ := parseProto(t)
+	if len(fields) != len(messages) {
+		t.Errorf("rpcs.proto has %d messages, %d Go types", len(fields), len(messages))
+	}
+	for _, message := range messages {
+		typ := reflect.TypeOf(message)
+		want, exist := fields[typ.Name()]
+		if !exist {
+			t.Errorf("%s is not in rpcs.proto", typ.Name())
+			continue
+		}
+		if len(want) != typ.NumField() {
+			t.Errorf("%s has %d fields in rpcs.proto, %d in Go", typ.Name(), len(want), typ.NumField())
+		}
+		byName := make(map[string]protoField)
+		for _, field := range want {
+			byName[strings.ReplaceAll(field.name, "_", "")] = field
+		}
+		for walk := 0; walk < typ.NumField(); walk++ {
+			field := typ.Field(walk)
+			proto, exist := byName[strings.ToLower(field.Name)]
+			switch {
+			case !exist:
+				t.Errorf("%s.%s is not in rpcs.proto", typ.Name(), field.Name)
+			case field.Tag.Get("protobuf") != strconv.Itoa(proto.num):
+				t.Errorf("%s.%s has tag %q, number %d in rpcs.proto", typ.Name(), field.Name, field.Tag.Get("protobuf"), proto.num)
+			case protoKind(field.Type) != proto.kind:
+				t.Errorf("%s.%s is %s, %s in rpcs.proto", typ.Name(), field.Name, protoKind(field.Type), proto.kind)
+			}
+		}
+	}
+}
+
+func TestProtoServices(t *testing.T) {
+	_, methods := parseProto(t)
+	services := map[string]reflect.Type{
+		"Node":         reflect.TypeOf((*RemoteNode)(nil)).Elem(),
+		"LoadBalancer": reflect.TypeOf((*RemoteLoadBalancer)(nil)).Elem(),
+	}
+	count := 0
+	for service, typ := range services {
+		for walk := 0; walk < typ.NumMethod(); walk++ {
+			method := typ.Method(walk)
+			name := service + "." + method.Name
+			want, exist := methods[name]
+			if !exist {
+				t.Errorf("%s is not in rpcs.proto", name)
+				continue
+			}
+			args, reply := method.Type.In(0).Elem().Name(), method.Type.In(1).Elem().Name()
+			if args != want[0] || reply != want[1] {
+				t.Errorf("%s takes %s and returns %s, %s and %s in rpcs.proto", name, args, reply, want[0], want[1])
+			}
+			count++
+		}
+	}
+	if count != len(methods) {
+		t.Errorf("rpcs.proto has %d methods, %d in Go", len(methods), count)
+	}
+}
@@ -2,21 +2,77 @@ package rpcs
 
 // JoinArgs is used for proving args for join RPCs
 type JoinArgs struct {
-	Port   int
-	ID     string
-	Parent string
-	Weight int
+	Port   int      `protobuf:"1"`
+	Addr   string   `protobuf:"2"` // advertised host:port of the node, ":Port" if empty
+	Addrs  []string `protobuf:"3"` // alternative addresses of the node
+	ID     string   `protobuf:"4"`
+	Parent string   `protobuf:"5"`
+	Weight int      `protobuf:"6"`
+	Hasher string   `protobuf:"7"` // name of the hasher used by the node
+	Zone   string   `protobuf:"8"` // failure domain of the node, may be empty
+	Rack   string   `protobuf:"9"`
 }
 
 // LeaveArgs is called when a node is leaving network
 type LeaveArgs struct {
-	ID string
+	ID string `protobuf:"1"`
+}
+
+// ReweightArgs is used to change the weight of a node
+// without leaving the network
+type ReweightArgs struct {
+	ID     string `protobuf:"1"`
+	Weight int    `protobuf:"2"`
 }
 
 // ReplaceArgs is used to replace any replica with new one
 type ReplaceArgs struct {
-	Old string
-	New RepNode
+	Old   string  `protobuf:"1"`
+	New   RepNode `protobuf:"2"`
+	Epoch uint64  `protobuf:"3"`
+}
+
+// LeaderReply tells which loadbalancer leads in Term,
+// Leader is empty if there is none
+type LeaderReply struct {
+	Leader string `protobuf:"1"`
+	Term   uint64 `protobuf:"2"`
+}
+
+// RingMember is a member of the ring of a loadbalancer
+type RingMember struct {
+	Key    string            `protobuf:"1"`
+	Weight int               `protobuf:"2"`
+	Meta   map[string]string `protobuf:"3"`
+}
+
+// RingReply is the ring of a loadbalancer at Epoch, Hasher
+// names the hash function placing keys and Algorithm the
+// placement algorithm, see consistent.NewAlgorithm
+type RingReply struct {
+	Epoch     uint64       `protobuf:"1"`
+	Hasher    string       `protobuf:"2"`
+	Members   []RingMember `protobuf:"3"`
+	Algorithm string       `protobuf:"4"`
+}
+
+// ExportArgs asks for a snapshot of the ring encoded in
+// Format, see consistent.FormatJSON and FormatBinary
+type ExportArgs struct {
+	Format string `protobuf:"1"`
+}
+
+// ExportReply carries an encoded snapshot of the ring
+type ExportReply struct {
+	Data []byte `protobuf:"1"`
+}
+
+// PromoteArgs is used when the node Old failed, the states it
+// was primary of are handed over to its successor New
+type PromoteArgs struct {
+	Old   string  `protobuf:"1"`
+	New   RepNode `protobuf:"2"`
+	Epoch uint64  `protobuf:"3"`
 }
 
 // type LookupArgs struct {
@@ -26,41 +82,101 @@ type ReplaceArgs struct {
 // CopyArgs is called when keys of a node (Src) need to
 // be copied to their new replicas
 type CopyArgs struct {
-	Target string
+	Target string `protobuf:"1"`
+	Epoch  uint64 `protobuf:"2"`
 }
 
 // RemoveAll is used to call when all keys of a node
 // (ID) needs to be deleted
 type RemoveAll struct {
-	ID string
+	ID    string `protobuf:"1"`
+	Epoch uint64 `protobuf:"2"`
+	// Start and End limit the removal to the states of the
+	// hash range from Start to End, all are removed if both
+	// are 0
+	Start uint64 `protobuf:"3"`
+	End   uint64 `protobuf:"4"`
+	// All removes every state of the receiver instead, those
+	// left over by a member failed over that joins again
+	All bool `protobuf:"5"`
 }
 
-// ReqArgs represents a user request
+// ReqArgs represents a user request, Epoch is the epoch
+// of the ring the request was routed with
 type ReqArgs struct {
-	ID     string
-	NodeID string
+	ID     string `protobuf:"1"`
+	NodeID string `protobuf:"2"`
+	Epoch  uint64 `protobuf:"3"`
 }
 
-// ReplicaArgs is used to convey all list of replica
-// to nodes to add in their ring
+// ReqReply is the reply to a user request, Server is the
+// node that served it
+type ReqReply struct {
+	Success bool   `protobuf:"1"`
+	Server  string `protobuf:"2"`
+}
+
+// KVArgs represents a key/value request of a user, Value
+// is only used by Put
+type KVArgs struct {
+	Key    string `protobuf:"1"`
+	Value  []byte `protobuf:"2"`
+	NodeID string `protobuf:"3"`
+	Epoch  uint64 `protobuf:"4"`
+}
+
+// KVReply is the reply of a Get, Server is the node
+// that served it
+type KVReply struct {
+	Success bool   `protobuf:"1"`
+	Found   bool   `protobuf:"2"`
+	Value   []byte `protobuf:"3"`
+	Server  string `protobuf:"4"`
+}
+
+// ReplicaArgs assigns their replicas to all virtual nodes
+// of a node, replacing the previous assignment
 type ReplicaArgs struct {
-	Replicas []RepNode
+	Replicas []RepNode `protobuf:"1"`
+	Factor   int       `protobuf:"2"` // number of copies of every state, primary included
+	Epoch    uint64    `protobuf:"3"`
+}
+
+// PlaceArgs tells a node the members of the ring and the
+// algorithm placing keys on them, for algorithms other than
+// the ring. Joined is a member that lost its states, the
+// holders of a state placed on it send it theirs
+type PlaceArgs struct {
+	Algorithm string       `protobuf:"1"`
+	Factor    int          `protobuf:"2"` // number of copies of every state, primary included
+	Members   []RingMember `protobuf:"3"`
+	Joined    string       `protobuf:"4"`
+	Epoch     uint64       `protobuf:"5"`
 }
 
 // RepNode represents a replication node info
 // that is transferred to the node to convey
 // replication info
 type RepNode struct {
-	ParentKey string
-	Key       string
-	Port      int
+	ParentKey string   `protobuf:"1"`
+	Key       string   `protobuf:"2"`
+	Addr      string   `protobuf:"3"`
+	Addrs     []string `protobuf:"4"`
+	Zone      string   `protobuf:"5"` // failure domain of the member
+	Rack      string   `protobuf:"6"`
+	// Virtual is the virtual node of the receiver whose states
+	// the replica holds, set in ReplicaArgs
+	Virtual string `protobuf:"7"`
 }
 
 // State is a user state
 type State struct {
-	Primary string
-	Replica string
-	Hash    uint64
+	Primary  string   `protobuf:"1"`
+	Replicas []string `protobuf:"2"`
+	Hash     uint64   `protobuf:"3"`
+	Value    []byte   `protobuf:"4"`
+	Deleted  bool     `protobuf:"5"` // set when the state is a deletion
+	Version  uint64   `protobuf:"6"` // time of the last write at the primary
 }
 
 // // LookupReply ...
@@ -70,24 +186,28 @@ type State struct {
 
 // BulkStates ...
 type BulkStates struct {
-	States map[string]State
+	States map[string]State `protobuf:"1"`
 }
 
 // LookupInfo defines a lookup value...
 type LookupInfo struct {
-	Start uint64
-	End   uint64
-	Key   string
-	Dst   string
+	Start uint64  `protobuf:"1"`
+	End   uint64  `protobuf:"2"`
+	Key   string  `protobuf:"3"`
+	Dst   string  `protobuf:"4"`
+	Since uint64  `protobuf:"5"` // only states of a newer version are copied
+	Epoch uint64  `protobuf:"6"`
+	Src   RepNode `protobuf:"7"` // member the states are copied from
 }
 
 // SyncArgs ...
 type SyncArgs struct {
-	Key       string
-	UserState State
+	Key       string `protobuf:"1"`
+	UserState State  `protobuf:"2"`
+	Epoch     uint64 `protobuf:"3"`
 }
 
 // Ack is used to provide acknowledgments for RPCs
 type Ack struct {
-	Success bool
+	Success bool `protobuf:"1"`
 }
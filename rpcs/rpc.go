@@ -11,13 +11,26 @@ type RemoteNode interface {
 	Replace(args *ReplaceArgs, reply *Ack) error
 	Lookup(args *LookupInfo, reply *Ack) error
 	CopyBulk(args *LookupInfo, reply *BulkStates) error
+	Put(args *KVArgs, reply *Ack) error
+	Get(args *KVArgs, reply *KVReply) error
+	Delete(args *KVArgs, reply *Ack) error
+	Promote(args *PromoteArgs, reply *Ack) error
+	Reweight(args *ReweightArgs, reply *Ack) error
+	Place(args *PlaceArgs, reply *Ack) error
 }
 
 // RemoteLoadBalancer - Students should not use this interface in their code. Use WrapLB() instead.
 type RemoteLoadBalancer interface {
 	Join(args *JoinArgs, reply *Ack) error
-	Forward(args *ReqArgs, reply *Ack) error
+	Forward(args *ReqArgs, reply *ReqReply) error
 	Leave(args *LeaveArgs, reply *Ack) error
+	Reweight(args *ReweightArgs, reply *Ack) error
+	Put(args *KVArgs, reply *Ack) error
+	Get(args *KVArgs, reply *KVReply) error
+	Delete(args *KVArgs, reply *Ack) error
+	Leader(args *Ack, reply *LeaderReply) error
+	GetRing(args *Ack, reply *RingReply) error
+	ExportRing(args *ExportArgs, reply *ExportReply) error
 }
 
 // Node ...
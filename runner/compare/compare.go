@@ -0,0 +1,99 @@
+package main
+
+import (
+	"conhash/consistent"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	members = flag.Int("n", 10, "Number of members")
+	weight  = flag.Int("w", 100, "Weight of every member")
+	keys    = flag.Int("k", 100000, "Number of keys placed")
+	hash    = flag.String("hash", consistent.SHA256, "Hash function of the rings")
+)
+
+// place returns the owner of every key
+func place(ring consistent.Ring) []string {
+	owners := make([]string, *keys)
+	for walk := range owners {
+		if node := ring.Lookup("user-" + strconv.Itoa(walk)); node != nil {
+			owners[walk] = node.ParentKey
+		}
+	}
+	return owners
+}
+
+// variance returns the mean and the coefficient of variation
+// of the number of keys per member
+func variance(ring consistent.Ring, owners []string) (float64, float64) {
+	counts := make(map[string]int)
+	for _, member := range ring.Members() {
+		counts[member.Key] = 0
+	}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+
+	mean := float64(len(owners)) / float64(len(counts))
+	sum := 0.0
+	for _, count := range counts {
+		sum += (float64(count) - mean) * (float64(count) - mean)
+	}
+	return mean, math.Sqrt(sum/float64(len(counts))) / mean
+}
+
+// moved returns the fraction of keys whose owner changed
+func moved(before []string, after []string) float64 {
+	count := 0
+	for walk := range before {
+		if before[walk] != after[walk] {
+			count++
+		}
+	}
+	return float64(count) / float64(len(before))
+}
+
+func compare(algo string, hasher consistent.Hasher) error {
+	ring, err := consistent.NewAlgorithm(algo, hasher)
+	if err != nil {
+		return err
+	}
+	for walk := 0; walk < *members; walk++ {
+		ring.Add("node-"+strconv.Itoa(walk), *weight, nil)
+	}
+
+	base := place(ring)
+	mean, cov := variance(ring, base)
+
+	// One member joins then the first member leaves
+	ring.Add("node-"+strconv.Itoa(*members), *weight, nil)
+	joined := place(ring)
+	ring.Remove("node-0")
+	left := place(ring)
+
+	fmt.Printf("%-12s mean %9.1f  cov %6.4f  moved on join %6.4f  moved on leave %6.4f\n",
+		algo, mean, cov, moved(base, joined), moved(joined, left))
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	hasher, err := consistent.NewHasher(*hash)
+	if err != nil {
+		fmt.Println("Unable to compare", err)
+		return
+	}
+
+	fmt.Println("Members:", *members, "Weight:", *weight, "Keys:", *keys, "Hasher:", *hash)
+	fmt.Printf("Ideal        moved on join %6.4f  moved on leave %6.4f\n",
+		1/float64(*members+1), 1/float64(*members+1))
+	algos := []string{consistent.AlgoRing, consistent.AlgoJump, consistent.AlgoMaglev, consistent.AlgoRendezvous}
+	for _, algo := range algos {
+		if err := compare(algo, hasher); err != nil {
+			fmt.Println("Unable to compare", algo, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"conhash/client"
+	"flag"
+	"fmt"
+)
+
+var (
+	op    = flag.String("o", "get", "Operation: put, get or delete")
+	key   = flag.String("k", "", "Key to operate on")
+	value = flag.String("v", "", "Value stored by put")
+	dst   = flag.String("d", ":8080", "HostPort of the loadbalancer")
+)
+
+func main() {
+	flag.Parse()
+
+	if *key == "" {
+		fmt.Println("A key is required")
+		return
+	}
+
+	kv, err := client.Dial(*dst)
+	if err != nil {
+		fmt.Println("Unable to connect to LoadBalancer", err)
+		return
+	}
+	defer kv.Close()
+
+	switch *op {
+	case "put":
+		err = kv.Put(*key, []byte(*value))
+	case "get":
+		var val []byte
+		var found bool
+		if val, found, err = kv.Get(*key); err == nil {
+			if found {
+				fmt.Println(string(val))
+			} else {
+				fmt.Println("Not found")
+			}
+		}
+	case "delete":
+		err = kv.Delete(*key)
+	default:
+		fmt.Println("Unknown operation", *op)
+		return
+	}
+
+	if err != nil {
+		fmt.Println("Failure", err)
+	} else if *op != "get" {
+		fmt.Println("Success")
+	}
+}
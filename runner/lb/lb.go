@@ -1,13 +1,45 @@
 package main
 
 import (
+	"conhash/consistent"
 	"conhash/loadbalancer"
+	"conhash/logging"
+	"conhash/transport"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	port = flag.Int("p", 8080, "Port number of LoadBalancer")
+	hash = flag.String("hash", consistent.SHA256, "Hash function of the ring")
+	load = flag.Float64("c", 0, "Capacity factor of bounded loads of reads, 0 disables them")
+	algo = flag.String("a", consistent.AlgoRing, "Placement algorithm of keys: ring, jump, maglev or rendezvous")
+	rf   = flag.Int("r", 2, "Replication factor, primary included")
+	rt   = flag.Duration("rt", time.Second, "Time a request may take on one node before reads fail over, 0 waits")
+	addr = flag.String("addr", "", "HostPort advertised to the nodes, :port if empty")
+	gsp  = flag.Duration("gossip", time.Second, "Gossip protocol period")
+	call = flag.Duration("call", 10*time.Second, "Time any other call to a node may take")
+	tran = flag.String("transport", transport.NameNetRPC, "RPC transport, netrpc or grpc, the same for the whole cluster")
+
+	interval = flag.Duration("health", time.Second, "Time between two probes of every node, 0 disables failure detection")
+	timeout  = flag.Duration("timeout", 500*time.Millisecond, "Time a probe of a node may take")
+	suspect  = flag.Int("suspect", 1, "Failed probes before a node is suspected")
+	dead     = flag.Int("dead", 3, "Failed probes before a node is removed")
+	recovery = flag.Int("recover", 2, "Successful probes in a row before a suspected node is trusted again")
+
+	mates = flag.String("peers", "", "Comma separated HostPorts of the other loadbalancers")
+	elect = flag.Duration("election", time.Second, "Raft election timeout")
+	state = flag.String("raft", "", "Directory of the raft state, memory only if empty")
+
+	ringFile   = flag.String("ring", "", "File the ring is written to on every change and loaded from on start")
+	ringFormat = flag.String("ring-format", consistent.FormatJSON, "Format of the ring file, json or binary")
+	httpAddr   = flag.String("http", "", "Address of the HTTP/JSON API, such as :8081, disabled if empty")
+
+	logFormat = flag.String("log", logging.FormatText, "Format of the logs, text or json")
+	logLevel  = flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
 )
 
 func createLock() error {
@@ -21,8 +53,54 @@ func createLock() error {
 }
 
 func main() {
-	lb := loadbalancer.New()
-	err := lb.StartLB(*port)
+	flag.Parse()
+	hasher, err := consistent.NewHasher(*hash)
+	if err != nil {
+		fmt.Println("Unable to start LoadBalancer", err)
+		return
+	}
+	rpcTransport, err := transport.Lookup(*tran)
+	if err != nil {
+		fmt.Println("Unable to start LoadBalancer", err)
+		return
+	}
+	logger, err := logging.New(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Println("Unable to start LoadBalancer", err)
+		return
+	}
+	var peers []string
+	if *mates != "" {
+		peers = strings.Split(*mates, ",")
+	}
+	lb, err := loadbalancer.New(loadbalancer.Config{
+		Hasher:            hasher,
+		LoadFactor:        *load,
+		Algorithm:         *algo,
+		ReplicationFactor: *rf,
+		HealthInterval:    *interval,
+		HealthTimeout:     *timeout,
+		SuspectAfter:      *suspect,
+		DeadAfter:         *dead,
+		RecoverAfter:      *recovery,
+		RequestTimeout:    *rt,
+		CallTimeout:       *call,
+		Addr:              *addr,
+		GossipInterval:    *gsp,
+		Peers:             peers,
+		ElectionTimeout:   *elect,
+		RaftDir:           *state,
+		RingFile:          *ringFile,
+		RingFormat:        *ringFormat,
+		Transport:         rpcTransport,
+		HTTPAddr:          *httpAddr,
+		Logger:            logger,
+	})
+	if err != nil {
+		fmt.Println("Unable to start LoadBalancer", err)
+		return
+	}
+	err = lb.StartLB(*port)
 
 	if err != nil {
 		return
@@ -29,7 +29,7 @@ func main() {
 	reply := rpcs.Ack{}
 
 	if err := conn.Call("LoadBalancer.Leave", &args, &reply); err != nil {
-		fmt.Println("Unable to call LB RPC", err)
+		diagnose(err)
 	} else if reply.Success {
 		fmt.Println("Leave Success")
 		return
@@ -38,3 +38,22 @@ func main() {
 		return
 	}
 }
+
+// diagnose explains why the leave failed
+func diagnose(err error) {
+	e := rpcs.FromError(err)
+	switch e.Code {
+	case rpcs.CodeNotMember:
+		fmt.Println("Leave Failed,", *id, "is not a member of the ring")
+	case rpcs.CodeRefused:
+		fmt.Println("Leave Failed, the ring keeps its last 2 members")
+	case rpcs.CodeUnreachable:
+		fmt.Println("Leave Failed, members could not take over the ranges of", *id+":", e.Message)
+	case rpcs.CodeNoLeader:
+		fmt.Println("Leave Failed, no loadbalancer leads the ring:", e.Message)
+	case rpcs.CodeUnknown:
+		fmt.Println("Unable to call LB RPC", err)
+	default:
+		fmt.Println("Leave Failed,", e.Code+":", e.Message)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build grpc
+
+package main
+
+// The gRPC transport is only built with -tags grpc
+import _ "conhash/transport/grpctransport"
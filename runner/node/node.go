@@ -1,10 +1,16 @@
 package main
 
 import (
+	"conhash/consistent"
+	"conhash/logging"
 	"conhash/node"
+	"conhash/store"
+	"conhash/transport"
 	"flag"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -12,12 +18,75 @@ var (
 	weight = flag.Int("w", 1, "Weight of the node")
 	id     = flag.String("i", strconv.Itoa(*port), "ID of the node")
 	dst    = flag.String("d", ":8080", "HostPort of the loadbalancer")
+	hash   = flag.String("hash", consistent.SHA256, "Hash function of the ring")
+	zone   = flag.String("zone", "", "Zone of the node")
+	rack   = flag.String("rack", "", "Rack of the node")
+	listen = flag.String("l", "", "HostPort to listen on, :port if empty")
+	addr   = flag.String("a", "", "HostPort advertised to peers, the listen address if empty")
+	alts   = flag.String("alt", "", "Comma separated alternative HostPorts advertised to peers")
+	engine = flag.String("store", store.EngineMemory, "Storage engine of the states: memory, log or lsm")
+	dir    = flag.String("dir", "", "Directory of the states, data-<ID> if empty")
+	seeds  = flag.String("seeds", "", "Comma separated gossip HostPorts tried besides the loadbalancer")
+	gsp    = flag.Duration("gossip", time.Second, "Gossip protocol period")
+	call   = flag.Duration("call", 10*time.Second, "Time a call to another node may take")
+	tran   = flag.String("transport", transport.NameNetRPC, "RPC transport, netrpc or grpc, the same for the whole cluster")
+
+	logFormat = flag.String("log", logging.FormatText, "Format of the logs, text or json")
+	logLevel  = flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
 )
 
 func main() {
 	flag.Parse()
-	node := node.New(*port, *id, *weight)
-	err := node.StartNode(*dst)
+	hasher, err := consistent.NewHasher(*hash)
+	if err != nil {
+		fmt.Println("Unable to start Node", err)
+		return
+	}
+	rpcTransport, err := transport.Lookup(*tran)
+	if err != nil {
+		fmt.Println("Unable to start Node", err)
+		return
+	}
+	logger, err := logging.New(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Println("Unable to start Node", err)
+		return
+	}
+	if *dir == "" {
+		*dir = "data-" + *id
+	}
+	states, err := store.Open(*engine, *dir, logger.With("component", "store", "id", *id))
+	if err != nil {
+		fmt.Println("Unable to start Node", err)
+		return
+	}
+	var addrs []string
+	if *alts != "" {
+		addrs = strings.Split(*alts, ",")
+	}
+	var peers []string
+	if *seeds != "" {
+		peers = strings.Split(*seeds, ",")
+	}
+	node := node.New(node.Config{
+		Port:   *port,
+		Listen: *listen,
+		Addr:   *addr,
+		Addrs:  addrs,
+		ID:     *id,
+		Weight: *weight,
+		Hasher: hasher,
+		Zone:   *zone,
+		Rack:   *rack,
+		Store:  states,
+		Seeds:  peers,
+
+		GossipInterval: *gsp,
+		CallTimeout:    *call,
+		Transport:      rpcTransport,
+		Logger:         logger,
+	})
+	err = node.StartNode(*dst)
 
 	if err != nil {
 		fmt.Println("Unable to start Node", err)
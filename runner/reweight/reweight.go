@@ -0,0 +1,42 @@
+package main
+
+import (
+	"conhash/rpcs"
+	"flag"
+	"fmt"
+	"net/rpc"
+)
+
+var (
+	id     = flag.String("i", "node", "ID of the Node")
+	weight = flag.Int("w", 1, "New weight of the node")
+	dst    = flag.String("d", ":8080", "HostPort of the loadbalancer")
+)
+
+func main() {
+	flag.Parse()
+
+	conn, err := rpc.DialHTTP("tcp", *dst)
+
+	if err != nil {
+		fmt.Println("Unable to connect to LoadBalancer", err)
+		return
+	}
+	defer conn.Close()
+
+	args := rpcs.ReweightArgs{
+		ID:     *id,
+		Weight: *weight,
+	}
+	reply := rpcs.Ack{}
+
+	if err := conn.Call("LoadBalancer.Reweight", &args, &reply); err != nil {
+		fmt.Println("Unable to call LB RPC", err)
+	} else if reply.Success {
+		fmt.Println("Reweight Success")
+		return
+	} else {
+		fmt.Println("Reweight Failed")
+		return
+	}
+}
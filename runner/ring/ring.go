@@ -0,0 +1,46 @@
+package main
+
+import (
+	"conhash/consistent"
+	"conhash/rpcs"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+)
+
+// The runner exports the ring of a loadbalancer, to the console
+// or to a file that a loadbalancer can later start from
+var (
+	dst    = flag.String("d", ":8080", "HostPort of the loadbalancer")
+	format = flag.String("format", consistent.FormatJSON, "Format of the snapshot, json or binary")
+	out    = flag.String("o", "", "File the snapshot is written to, the console if empty")
+)
+
+func main() {
+	flag.Parse()
+
+	conn, err := rpc.DialHTTP("tcp", *dst)
+	if err != nil {
+		fmt.Println("Unable to connect to LoadBalancer", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	args := rpcs.ExportArgs{Format: *format}
+	reply := rpcs.ExportReply{}
+	if err := conn.Call("LoadBalancer.ExportRing", &args, &reply); err != nil {
+		fmt.Println("Unable to export ring", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(reply.Data)
+		fmt.Println()
+		return
+	}
+	if err := os.WriteFile(*out, reply.Data, 0644); err != nil {
+		fmt.Println("Unable to write snapshot", err)
+		os.Exit(1)
+	}
+	fmt.Println("Wrote", len(reply.Data), "bytes to", *out)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"conhash/client"
 	"conhash/rpcs"
 	"flag"
 	"fmt"
@@ -8,12 +9,18 @@ import (
 )
 
 var (
-	id  = flag.String("i", "user", "ID of the User")
-	dst = flag.String("d", ":8080", "HostPort of the loadbalancer")
+	id     = flag.String("i", "user", "ID of the User")
+	dst    = flag.String("d", ":8080", "HostPort of the loadbalancer")
+	direct = flag.Bool("direct", false, "Route the request to its node using the ring of the loadbalancer")
+	wait   = flag.Duration("t", client.DefaultTimeout, "Time the node may take to answer a routed request")
 )
 
 func main() {
 	flag.Parse()
+	if *direct {
+		route()
+		return
+	}
 
 	conn, err := rpc.DialHTTP("tcp", *dst)
 
@@ -26,15 +33,55 @@ func main() {
 	args := rpcs.ReqArgs{
 		ID: *id,
 	}
-	reply := rpcs.Ack{}
+	reply := rpcs.ReqReply{}
 
 	if err := conn.Call("LoadBalancer.Forward", &args, &reply); err != nil {
-		fmt.Println("Unable to call LB RPC", err)
+		diagnose(err)
 	} else if reply.Success {
-		fmt.Println("Success")
+		fmt.Println("Success, served by", reply.Server)
 		return
 	} else {
 		fmt.Println("Failure")
 		return
 	}
 }
+
+// route sends the request to its node without going
+// through the loadbalancer
+func route() {
+	router, err := client.NewRouter(*dst)
+	if err != nil {
+		fmt.Println("Unable to fetch ring from LoadBalancer", err)
+		return
+	}
+	defer router.Close()
+	router.SetTimeout(*wait)
+
+	server, err := router.Request(*id)
+	if err != nil {
+		diagnose(err)
+		return
+	}
+	fmt.Println("Success, served by", server, "at epoch", router.Epoch())
+}
+
+// diagnose explains why the request failed
+func diagnose(err error) {
+	e := rpcs.FromError(err)
+	switch e.Code {
+	case rpcs.CodeNoNodes:
+		fmt.Println("Failure, no node has joined the ring yet")
+	case rpcs.CodeUnreachable:
+		fmt.Println("Failure, no node serving", *id, "answered:", e.Message)
+	case rpcs.CodeWrongOwner:
+		fmt.Println("Failure, the ring changed while routing the request, try again")
+	case rpcs.CodeStorage:
+		fmt.Println("Failure, the node could not store the state of", *id+":", e.Message)
+	case rpcs.CodeInvalid:
+		fmt.Println("Failure, the request was rejected:", e.Message)
+	case rpcs.CodeUnknown:
+		fmt.Println("Unable to call LB RPC", err)
+	default:
+		fmt.Println("Failure,", e.Code+":", e.Message)
+	}
+}
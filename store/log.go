@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"conhash/rpcs"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// logFile is the name of the log inside its directory
+const logFile = "states.log"
+
+// compactSize is the size under which a log is never compacted
+const compactSize = 1 << 20
+
+// logStore appends every change to a file and keeps the offset
+// of the latest record of every key in memory. The log is
+// rewritten once more than half of it is overwritten records
+type logStore struct {
+	mu      sync.RWMutex
+	dir     string
+	file    *os.File
+	size    int64 // offset of the next record
+	garbage int64 // bytes of records that are no longer live
+	index   map[string]entry
+	logger  *slog.Logger
+}
+
+// entry locates a record inside a file
+type entry struct {
+	offset int64
+	size   int
+}
+
+// OpenLog opens the log kept in dir, creating it if needed.
+// Writes reach the operating system before returning so they
+// survive a crash of the node. Diagnostics go to logger,
+// slog.Default() if nil
+func OpenLog(dir string, logger *slog.Logger) (Store, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &logStore{
+		dir:    dir,
+		file:   file,
+		index:  make(map[string]entry),
+		logger: logger,
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load rebuilds the index from the log and cuts off a
+// record torn by a crash
+func (s *logStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.logger.Warn("truncating torn log", "dir", s.dir, "offset", offset, "err", err)
+			break
+		}
+		s.track(rec, entry{offset: offset, size: size})
+		offset += int64(size)
+	}
+	s.size = offset
+	return s.file.Truncate(offset)
+}
+
+// track updates the index and the garbage count with
+// the record written at e
+func (s *logStore) track(rec record, e entry) {
+	if old, exist := s.index[rec.key]; exist {
+		s.garbage += int64(old.size)
+	}
+	if rec.op == opDelete {
+		s.garbage += int64(e.size)
+		delete(s.index, rec.key)
+		return
+	}
+	s.index[rec.key] = e
+}
+
+// read returns the record at e
+func (s *logStore) read(e entry) (record, error) {
+	buf := make([]byte, e.size)
+	if _, err := s.file.ReadAt(buf, e.offset); err != nil {
+		return record{}, err
+	}
+	rec, _, err := readRecord(bytes.NewReader(buf))
+	return rec, err
+}
+
+func (s *logStore) Get(key string) (rpcs.State, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exist := s.index[key]
+	if !exist {
+		return rpcs.State{}, false, nil
+	}
+	rec, err := s.read(e)
+	if err != nil {
+		return rpcs.State{}, false, err
+	}
+	return rec.state, true, nil
+}
+
+func (s *logStore) Put(key string, state rpcs.State) error {
+	return s.append(record{op: opPut, key: key, state: state})
+}
+
+func (s *logStore) Delete(key string) error {
+	s.mu.RLock()
+	_, exist := s.index[key]
+	s.mu.RUnlock()
+	if !exist {
+		return nil
+	}
+	return s.append(record{op: opDelete, key: key})
+}
+
+// append writes rec at the end of the log
+func (s *logStore) append(rec record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := encodeRecord(rec)
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		// Drop whatever part of the record was written
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.track(rec, entry{offset: s.size, size: len(buf)})
+	s.size += int64(len(buf))
+
+	if s.size >= compactSize && s.garbage*2 > s.size {
+		if err := s.compact(); err != nil {
+			s.logger.Error("unable to compact log", "dir", s.dir, "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *logStore) Range(fn func(key string, state rpcs.State) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys() {
+		rec, err := s.read(s.index[key])
+		if err != nil {
+			return err
+		}
+		if !fn(key, rec.state) {
+			break
+		}
+	}
+	return nil
+}
+
+// keys returns the live keys in order
+func (s *logStore) keys() []string {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compact copies the live records into a new log which
+// then atomically replaces the current one
+func (s *logStore) compact() error {
+	path := filepath.Join(s.dir, logFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	index := make(map[string]entry, len(s.index))
+	var offset int64
+	for _, key := range s.keys() {
+		e := s.index[key]
+		buf := make([]byte, e.size)
+		if _, err := s.file.ReadAt(buf, e.offset); err != nil {
+			return abort(err)
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return abort(err)
+		}
+		index[key] = entry{offset: offset, size: e.size}
+		offset += int64(e.size)
+	}
+	if err := writer.Flush(); err != nil {
+		return abort(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return abort(err)
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.size = offset
+	s.garbage = 0
+	s.index = index
+	return syncDir(s.dir)
+}
+
+func (s *logStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
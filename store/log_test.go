@@ -0,0 +1,65 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLogCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLog(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := s.(*logStore)
+
+	// Overwrite a few keys until the log passes compactSize,
+	// more than half of it is then garbage
+	value := strings.Repeat("v", 4096)
+	round := 0
+	for ; log.size < compactSize/2; round++ {
+		for _, key := range []string{"a", "b", "c"} {
+			state := testState(key, round)
+			state.Value = []byte(value + strconv.Itoa(round))
+			if err := s.Put(key, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.Delete("c")
+	for log.size < compactSize && log.garbage > 0 {
+		state := testState("a", round)
+		state.Value = []byte(value + strconv.Itoa(round))
+		s.Put("a", state)
+		round++
+	}
+	if log.garbage != 0 {
+		t.Fatalf("log of %d bytes holds %d bytes of garbage", log.size, log.garbage)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, logFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != log.size || info.Size() >= compactSize/2 {
+		t.Fatalf("compacted log is %d bytes, %d tracked", info.Size(), log.size)
+	}
+	if _, err := os.Stat(filepath.Join(dir, logFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary log is left: %v", err)
+	}
+
+	a, _, _ := s.Get("a")
+	b, _, _ := s.Get("b")
+	s.Close()
+	s, err = OpenLog(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkState(t, s, "a", &a)
+	checkState(t, s, "b", &b)
+	checkState(t, s, "c", nil)
+}
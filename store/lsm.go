@@ -0,0 +1,561 @@
+package store
+
+import (
+	"bufio"
+	"conhash/rpcs"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Files of an LSM store inside its directory
+const (
+	walFile      = "wal.log"
+	manifestFile = "MANIFEST"
+	tableExt     = ".sst"
+)
+
+// Limits of an LSM store
+const (
+	flushSize   = 4 << 20 // bytes of the memtable before it is flushed
+	maxTables   = 4       // tables before they are merged into one
+	sparseEvery = 16      // records between two entries of a table index
+)
+
+// lsmStore is a small log-structured merge tree. Changes go to a
+// write-ahead log and a memtable, which is flushed into an immutable
+// table sorted by key once large enough. Tables are merged into one
+// when there are too many of them. The manifest lists the live
+// tables, so a crash never exposes a half written one
+type lsmStore struct {
+	mu       sync.RWMutex
+	dir      string
+	wal      *os.File
+	walSize  int64
+	memtable map[string]record
+	memSize  int
+	tables   []*table // oldest first
+	seq      int      // sequence number of the last table
+	logger   *slog.Logger
+}
+
+// table is an immutable file of records sorted by key with a
+// sparse index of their offsets
+type table struct {
+	name  string
+	path  string
+	file  *os.File
+	size  int64
+	index []tableEntry
+}
+
+type tableEntry struct {
+	key    string
+	offset int64
+}
+
+// OpenLSM opens the LSM store kept in dir, creating it if needed.
+// Diagnostics go to logger, slog.Default() if nil
+func OpenLSM(dir string, logger *slog.Logger) (Store, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &lsmStore{
+		dir:      dir,
+		memtable: make(map[string]record),
+		logger:   logger,
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load opens the tables of the manifest, removes the others
+// and replays the write-ahead log into the memtable
+func (s *lsmStore) load() error {
+	live := make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(s.dir, manifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range strings.Fields(string(data)) {
+		t, err := openTable(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		live[name] = true
+		s.tables = append(s.tables, t)
+		s.seq = tableSeq(name)
+	}
+
+	// Leftovers of a flush or merge interrupted by a crash
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if (strings.HasSuffix(name, tableExt) && !live[name]) || strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+		if strings.HasSuffix(name, tableExt) && tableSeq(name) > s.seq {
+			s.seq = tableSeq(name)
+		}
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(s.dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.wal)
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.logger.Warn("truncating torn write-ahead log", "dir", s.dir, "offset", s.walSize, "err", err)
+			break
+		}
+		s.memtable[rec.key] = rec
+		s.memSize += size
+		s.walSize += int64(size)
+	}
+	return s.wal.Truncate(s.walSize)
+}
+
+// tableSeq returns the sequence number in the name of a table
+func tableSeq(name string) int {
+	seq := 0
+	fmt.Sscanf(name, "%d"+tableExt, &seq)
+	return seq
+}
+
+// find returns the latest record of key
+func (s *lsmStore) find(key string) (record, bool, error) {
+	if rec, exist := s.memtable[key]; exist {
+		return rec, true, nil
+	}
+	for walk := len(s.tables) - 1; walk >= 0; walk-- {
+		rec, exist, err := s.tables[walk].get(key)
+		if err != nil || exist {
+			return rec, exist, err
+		}
+	}
+	return record{}, false, nil
+}
+
+func (s *lsmStore) Get(key string) (rpcs.State, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, exist, err := s.find(key)
+	if err != nil || !exist || rec.op == opDelete {
+		return rpcs.State{}, false, err
+	}
+	return rec.state, true, nil
+}
+
+func (s *lsmStore) Put(key string, state rpcs.State) error {
+	return s.write(record{op: opPut, key: key, state: state})
+}
+
+func (s *lsmStore) Delete(key string) error {
+	return s.write(record{op: opDelete, key: key})
+}
+
+// write logs rec and applies it to the memtable
+func (s *lsmStore) write(rec record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := encodeRecord(rec)
+	if _, err := s.wal.WriteAt(buf, s.walSize); err != nil {
+		s.wal.Truncate(s.walSize)
+		return err
+	}
+	s.walSize += int64(len(buf))
+	s.memtable[rec.key] = rec
+	s.memSize += len(buf)
+
+	if s.memSize >= flushSize {
+		if err := s.flush(); err != nil {
+			s.logger.Error("unable to flush memtable", "dir", s.dir, "err", err)
+		}
+	}
+	return nil
+}
+
+// flush writes the memtable into a new table and empties
+// the write-ahead log
+func (s *lsmStore) flush() error {
+	keys := make([]string, 0, len(s.memtable))
+	for key := range s.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w, err := s.createTable()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := w.add(s.memtable[key]); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	t, err := w.finish()
+	if err != nil {
+		return err
+	}
+	if err := s.setTables(append(s.tables, t)); err != nil {
+		t.remove()
+		return err
+	}
+
+	// Replaying the log again after a crash at this point
+	// only rewrites what the table already holds
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.walSize = 0
+	s.memtable = make(map[string]record)
+	s.memSize = 0
+
+	if len(s.tables) > maxTables {
+		return s.merge()
+	}
+	return nil
+}
+
+// merge replaces all tables with one. Deletions are dropped
+// since no older table is left for them to hide
+func (s *lsmStore) merge() error {
+	w, err := s.createTable()
+	if err != nil {
+		return err
+	}
+	err = mergeTables(s.tables, func(rec record) error {
+		if rec.op == opDelete {
+			return nil
+		}
+		return w.add(rec)
+	})
+	if err != nil {
+		w.abort()
+		return err
+	}
+	t, err := w.finish()
+	if err != nil {
+		return err
+	}
+
+	old := s.tables
+	if err := s.setTables([]*table{t}); err != nil {
+		t.remove()
+		return err
+	}
+	for _, t := range old {
+		t.remove()
+	}
+	return nil
+}
+
+// setTables writes the manifest of tables and makes them live
+func (s *lsmStore) setTables(tables []*table) error {
+	var names []string
+	for _, t := range tables {
+		names = append(names, t.name)
+	}
+	path := filepath.Join(s.dir, manifestFile)
+	if err := writeFileSync(path+".tmp", []byte(strings.Join(names, "\n")+"\n")); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.tables = tables
+	if err := syncDir(s.dir); err != nil {
+		s.logger.Error("unable to sync", "dir", s.dir, "err", err)
+	}
+	return nil
+}
+
+// writeFileSync writes data to path and flushes it to disk
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *lsmStore) Range(fn func(key string, state rpcs.State) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.memtable))
+	for key := range s.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	memtable := &sliceCursor{}
+	for _, key := range keys {
+		memtable.recs = append(memtable.recs, s.memtable[key])
+	}
+
+	err := mergeCursors(append(tableCursors(s.tables), memtable), func(rec record) error {
+		if rec.op == opDelete {
+			return nil
+		}
+		if !fn(rec.key, rec.state) {
+			return io.EOF
+		}
+		return nil
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *lsmStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.wal != nil {
+		err = s.wal.Close()
+	}
+	for _, t := range s.tables {
+		t.file.Close()
+	}
+	return err
+}
+
+// createTable starts writing the next table
+func (s *lsmStore) createTable() (*tableWriter, error) {
+	s.seq++
+	name := fmt.Sprintf("%06d%s", s.seq, tableExt)
+	file, err := os.Create(filepath.Join(s.dir, name) + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		table: &table{
+			name: name,
+			path: filepath.Join(s.dir, name),
+		},
+	}, nil
+}
+
+// tableWriter writes the records of a table in key order
+type tableWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	table  *table
+	count  int
+}
+
+func (w *tableWriter) add(rec record) error {
+	if w.count%sparseEvery == 0 {
+		w.table.index = append(w.table.index, tableEntry{key: rec.key, offset: w.table.size})
+	}
+	buf := encodeRecord(rec)
+	if _, err := w.writer.Write(buf); err != nil {
+		return err
+	}
+	w.table.size += int64(len(buf))
+	w.count++
+	return nil
+}
+
+// finish flushes the table to disk and opens it for reading
+func (w *tableWriter) finish() (*table, error) {
+	if err := w.writer.Flush(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := os.Rename(w.file.Name(), w.table.path); err != nil {
+		w.abort()
+		return nil, err
+	}
+	w.table.file = w.file
+	return w.table, nil
+}
+
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// openTable opens a table and builds its sparse index
+func openTable(path string) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{
+		name: filepath.Base(path),
+		path: path,
+		file: file,
+	}
+	reader := bufio.NewReader(file)
+	for count := 0; ; count++ {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("table %s: %v", path, err)
+		}
+		if count%sparseEvery == 0 {
+			t.index = append(t.index, tableEntry{key: rec.key, offset: t.size})
+		}
+		t.size += int64(size)
+	}
+	return t, nil
+}
+
+// get returns the record of key by scanning the block of
+// the index entry that may hold it
+func (t *table) get(key string) (record, bool, error) {
+	block := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if block < 0 {
+		return record{}, false, nil
+	}
+	start, end := t.index[block].offset, t.size
+	if block+1 < len(t.index) {
+		end = t.index[block+1].offset
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(t.file, start, end-start))
+	for {
+		rec, _, err := readRecord(reader)
+		if err == io.EOF || (err == nil && rec.key > key) {
+			return record{}, false, nil
+		} else if err != nil {
+			return record{}, false, err
+		} else if rec.key == key {
+			return rec, true, nil
+		}
+	}
+}
+
+// remove closes and deletes the table
+func (t *table) remove() {
+	t.file.Close()
+	os.Remove(t.path)
+}
+
+// cursor walks records in key order
+type cursor interface {
+	next() (record, bool, error)
+}
+
+type sliceCursor struct {
+	recs []record
+}
+
+func (c *sliceCursor) next() (record, bool, error) {
+	if len(c.recs) == 0 {
+		return record{}, false, nil
+	}
+	rec := c.recs[0]
+	c.recs = c.recs[1:]
+	return rec, true, nil
+}
+
+type tableCursor struct {
+	reader *bufio.Reader
+}
+
+func (c *tableCursor) next() (record, bool, error) {
+	rec, _, err := readRecord(c.reader)
+	if err == io.EOF {
+		return record{}, false, nil
+	}
+	return rec, err == nil, err
+}
+
+func tableCursors(tables []*table) []cursor {
+	var cursors []cursor
+	for _, t := range tables {
+		cursors = append(cursors, &tableCursor{
+			reader: bufio.NewReader(io.NewSectionReader(t.file, 0, t.size)),
+		})
+	}
+	return cursors
+}
+
+// mergeTables calls fn with the latest record of every key
+// of the tables in key order
+func mergeTables(tables []*table, fn func(rec record) error) error {
+	return mergeCursors(tableCursors(tables), fn)
+}
+
+// mergeCursors calls fn with the latest record of every key in
+// key order, cursors are given from the oldest to the newest
+func mergeCursors(cursors []cursor, fn func(rec record) error) error {
+	heads := make([]record, len(cursors))
+	valid := make([]bool, len(cursors))
+	for walk, c := range cursors {
+		rec, ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		heads[walk], valid[walk] = rec, ok
+	}
+
+	for {
+		// The newest cursor holding the smallest key wins
+		latest := -1
+		for walk := range cursors {
+			if valid[walk] && (latest < 0 || heads[walk].key <= heads[latest].key) {
+				latest = walk
+			}
+		}
+		if latest < 0 {
+			return nil
+		}
+		key := heads[latest].key
+		if err := fn(heads[latest]); err != nil {
+			return err
+		}
+		for walk, c := range cursors {
+			if valid[walk] && heads[walk].key == key {
+				rec, ok, err := c.next()
+				if err != nil {
+					return err
+				}
+				heads[walk], valid[walk] = rec, ok
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"conhash/rpcs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// liveTables returns the names of the tables in the manifest of dir
+func liveTables(t *testing.T, dir string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+// flushed writes the memtable of s into a table as a full
+// memtable would
+func flushed(t *testing.T, s Store) {
+	t.Helper()
+	lsm := s.(*lsmStore)
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if err := lsm.flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLSMFlush(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := testState("a", 1), testState("b", 1)
+	s.Put("a", a)
+	s.Put("b", b)
+	flushed(t, s)
+
+	if tables := liveTables(t, dir); len(tables) != 1 {
+		t.Fatalf("manifest lists %v after a flush", tables)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFile)); err != nil || info.Size() != 0 {
+		t.Fatalf("write-ahead log is not emptied: %v", err)
+	}
+
+	// A deletion in the memtable hides the state of a table
+	s.Delete("a")
+	checkState(t, s, "a", nil)
+	checkState(t, s, "b", &b)
+	s.Close()
+
+	s, err = OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkState(t, s, "a", nil)
+	checkState(t, s, "b", &b)
+}
+
+func TestLSMMerge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every table overwrites or deletes some keys of the older ones
+	want := make(map[string]rpcs.State)
+	for round := 0; round <= maxTables; round++ {
+		for walk := round; walk < 40; walk += 2 {
+			key := "k" + strconv.Itoa(walk)
+			want[key] = testState(key, round)
+			s.Put(key, want[key])
+		}
+		del := "k" + strconv.Itoa(round*3)
+		s.Delete(del)
+		delete(want, del)
+		flushed(t, s)
+	}
+
+	tables := liveTables(t, dir)
+	if len(tables) != 1 {
+		t.Fatalf("manifest lists %v after %d flushes", tables, maxTables+1)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), tableExt) && file.Name() != tables[0] {
+			t.Fatalf("merged table %s is left", file.Name())
+		}
+	}
+
+	check := func(s Store) {
+		got := make(map[string]rpcs.State)
+		err := s.Range(func(key string, state rpcs.State) bool {
+			got[key] = state
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("store holds %d keys, want %d", len(got), len(want))
+		}
+		for key, state := range want {
+			checkState(t, s, key, &state)
+		}
+	}
+	check(s)
+	s.Close()
+
+	s, err = OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestLSMLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testState("a", 1)
+	s.Put("a", a)
+	flushed(t, s)
+	s.Close()
+
+	// A flush interrupted by a crash before the manifest named its table
+	stale := filepath.Join(dir, "999999"+tableExt)
+	for _, path := range []string{stale, stale + ".tmp"} {
+		if err := os.WriteFile(path, []byte("torn"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = OpenLSM(dir, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkState(t, s, "a", &a)
+	for _, path := range []string{stale, stale + ".tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s is left: %v", path, err)
+		}
+	}
+
+	// The next table must not reuse the name of the stale one
+	s.Put("b", testState("b", 1))
+	flushed(t, s)
+	if tables := liveTables(t, dir); tableSeq(tables[len(tables)-1]) <= 999999 {
+		t.Fatalf("manifest lists %v", tables)
+	}
+}
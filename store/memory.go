@@ -0,0 +1,67 @@
+package store
+
+import (
+	"conhash/rpcs"
+	"sort"
+	"sync"
+)
+
+// memory keeps the states in a map, they are lost
+// when the node stops
+type memory struct {
+	mu     sync.RWMutex
+	states map[string]rpcs.State
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory() Store {
+	return &memory{
+		states: make(map[string]rpcs.State),
+	}
+}
+
+func (m *memory) Get(key string) (rpcs.State, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, exist := m.states[key]
+	return state, exist, nil
+}
+
+func (m *memory) Put(key string, state rpcs.State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[key] = state
+	return nil
+}
+
+func (m *memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, key)
+	return nil
+}
+
+func (m *memory) Range(fn func(key string, state rpcs.State) bool) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range sortedKeys(m.states) {
+		if !fn(key, m.states[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memory) Close() error {
+	return nil
+}
+
+// sortedKeys returns the keys of the states in order
+func sortedKeys(states map[string]rpcs.State) []string {
+	keys := make([]string, 0, len(states))
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
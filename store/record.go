@@ -0,0 +1,174 @@
+package store
+
+import (
+	"conhash/rpcs"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Operations recorded in the files of the persistent engines
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// A record is framed by the checksum and the length of
+// its payload
+const (
+	headerSize = 8
+	maxPayload = 64 << 20
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// record is a change of one key
+type record struct {
+	op    byte
+	key   string
+	state rpcs.State
+}
+
+// encodeRecord returns the framed bytes of rec
+func encodeRecord(rec record) []byte {
+	payload := []byte{rec.op}
+	payload = appendBytes(payload, []byte(rec.key))
+	if rec.op == opPut {
+		payload = appendState(payload, rec.state)
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// readRecord reads the next record and returns it with its size.
+// It returns io.EOF at the end of r and errCorrupt or
+// io.ErrUnexpectedEOF for a damaged or torn record
+func readRecord(r io.Reader) (record, int, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return record{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size == 0 || size > maxPayload {
+		return record{}, 0, errCorrupt
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header) {
+		return record{}, 0, errCorrupt
+	}
+
+	d := decoder{buf: payload[1:]}
+	rec := record{
+		op:  payload[0],
+		key: string(d.bytes()),
+	}
+	switch rec.op {
+	case opPut:
+		rec.state = d.state()
+	case opDelete:
+	default:
+		return record{}, 0, errCorrupt
+	}
+	if d.err != nil {
+		return record{}, 0, d.err
+	}
+	return rec, headerSize + int(size), nil
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendState(buf []byte, state rpcs.State) []byte {
+	buf = appendBytes(buf, []byte(state.Primary))
+	buf = binary.AppendUvarint(buf, uint64(len(state.Replicas)))
+	for _, replica := range state.Replicas {
+		buf = appendBytes(buf, []byte(replica))
+	}
+	buf = binary.AppendUvarint(buf, state.Hash)
+	buf = appendBytes(buf, state.Value)
+	deleted := byte(0)
+	if state.Deleted {
+		deleted = 1
+	}
+	buf = append(buf, deleted)
+	return binary.AppendUvarint(buf, state.Version)
+}
+
+// decoder reads the fields of a payload and remembers
+// the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	size := d.uvarint()
+	if d.err != nil {
+		return nil
+	} else if size > uint64(len(d.buf)) {
+		d.err = errCorrupt
+		return nil
+	}
+	b := d.buf[:size:size]
+	d.buf = d.buf[size:]
+	if size == 0 {
+		return nil
+	}
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	} else if len(d.buf) == 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) state() rpcs.State {
+	state := rpcs.State{
+		Primary: string(d.bytes()),
+	}
+	count := d.uvarint()
+	if count > uint64(len(d.buf)) {
+		d.err = errCorrupt
+		return state
+	}
+	for walk := uint64(0); walk < count && d.err == nil; walk++ {
+		state.Replicas = append(state.Replicas, string(d.bytes()))
+	}
+	state.Hash = d.uvarint()
+	state.Value = d.bytes()
+	state.Deleted = d.byte() == 1
+	state.Version = d.uvarint()
+	return state
+}
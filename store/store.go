@@ -0,0 +1,57 @@
+package store
+
+import (
+	"conhash/rpcs"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Store keeps the states of a node. Implementations are
+// safe for concurrent use
+type Store interface {
+	// Get returns the state of key and whether it exists
+	Get(key string) (rpcs.State, bool, error)
+	// Put stores the state of key
+	Put(key string, state rpcs.State) error
+	// Delete removes key
+	Delete(key string) error
+	// Range calls fn for every key in order until fn returns
+	// false. fn must not modify the store
+	Range(fn func(key string, state rpcs.State) bool) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// Names of the storage engines
+const (
+	EngineMemory = "memory"
+	EngineLog    = "log"
+	EngineLSM    = "lsm"
+)
+
+// Open returns the store of the engine registered under name,
+// the persistent engines keep their files in dir and report
+// their diagnostics to logger, slog.Default() if nil
+func Open(name string, dir string, logger *slog.Logger) (Store, error) {
+	switch name {
+	case EngineMemory:
+		return NewMemory(), nil
+	case EngineLog:
+		return OpenLog(dir, logger)
+	case EngineLSM:
+		return OpenLSM(dir, logger)
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", name)
+}
+
+// syncDir flushes the entries of dir so that a rename
+// survives a crash of the machine
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"conhash/rpcs"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// quiet discards the diagnostics of the stores
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// engines are the persistent engines with the file their
+// changes are appended to
+var engines = []struct {
+	name string
+	file string
+}{
+	{EngineLog, logFile},
+	{EngineLSM, walFile},
+}
+
+// testState returns the state written for key in round
+func testState(key string, round int) rpcs.State {
+	return rpcs.State{
+		Primary:  "n1",
+		Replicas: []string{"n2", "n3"},
+		Hash:     uint64(len(key)),
+		Value:    []byte(key + "@" + strconv.Itoa(round)),
+		Version:  uint64(round),
+	}
+}
+
+// checkState fails t unless the store holds want for key,
+// or misses key if want is nil
+func checkState(t *testing.T, s Store, key string, want *rpcs.State) {
+	t.Helper()
+	got, exist, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	if want == nil {
+		if exist {
+			t.Fatalf("%s is left: %+v", key, got)
+		}
+		return
+	}
+	if !exist || !reflect.DeepEqual(got, *want) {
+		t.Fatalf("%s is %+v (found %v), want %+v", key, got, exist, *want)
+	}
+}
+
+// rangeKeys returns the keys the store ranges over in order
+func rangeKeys(t *testing.T, s Store) []string {
+	t.Helper()
+	var keys []string
+	err := s.Range(func(key string, state rpcs.State) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestOpen(t *testing.T) {
+	for _, name := range []string{EngineMemory, EngineLog, EngineLSM} {
+		s, err := Open(name, t.TempDir(), quiet)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		s.Close()
+	}
+	if _, err := Open("bolt", t.TempDir(), quiet); err == nil {
+		t.Error("unknown engine accepted")
+	}
+}
+
+func TestPutDeleteReopen(t *testing.T) {
+	for _, engine := range append(engines, struct{ name, file string }{EngineMemory, ""}) {
+		t.Run(engine.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"c", "a", "b", "d"} {
+				if err := s.Put(key, testState(key, 1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b := testState("b", 2)
+			if err := s.Put("b", b); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("missing"); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(s Store) {
+				a, d := testState("a", 1), testState("d", 1)
+				checkState(t, s, "a", &a)
+				checkState(t, s, "b", &b)
+				checkState(t, s, "c", nil)
+				checkState(t, s, "d", &d)
+				if keys := rangeKeys(t, s); !reflect.DeepEqual(keys, []string{"a", "b", "d"}) {
+					t.Fatalf("Range walks %v", keys)
+				}
+			}
+			check(s)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if engine.name == EngineMemory {
+				return
+			}
+
+			s, err = Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			check(s)
+		})
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	for _, engine := range engines {
+		t.Run(engine.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := testState("a", 1), testState("b", 1)
+			s.Put("a", a)
+			s.Put("b", b)
+			s.Close()
+
+			// A crash in the middle of the last write
+			path := filepath.Join(dir, engine.file)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, info.Size()-3); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkState(t, s, "a", &a)
+			checkState(t, s, "b", nil)
+
+			// Writes after the cut must not land behind the torn record
+			c := testState("c", 1)
+			if err := s.Put("c", c); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			s, err = Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			checkState(t, s, "a", &a)
+			checkState(t, s, "c", &c)
+		})
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	for _, engine := range engines {
+		t.Run(engine.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testState("a", 1)
+			s.Put("a", a)
+			s.Put("b", testState("b", 1))
+			s.Close()
+
+			// Flip the last byte, the checksum of b no longer matches
+			path := filepath.Join(dir, engine.file)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[len(data)-1] ^= 0xff
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = Open(engine.name, dir, quiet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			checkState(t, s, "a", &a)
+			checkState(t, s, "b", nil)
+		})
+	}
+}
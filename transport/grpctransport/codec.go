@@ -0,0 +1,330 @@
+//go:build grpc
+
+package grpctransport
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// errWireType is returned when a field of a message does not
+// have the wire type its Go field requires
+var errWireType = errors.New("unexpected wire type")
+
+// codec encodes the messages of the services in the protobuf wire
+// format without generated code. Every field of a message has its
+// number in a tag such as `protobuf:"3"`, as in rpcs/rpcs.proto: strings,
+// byte slices, booleans, integers, structs, slices of strings or
+// structs and maps of strings to strings or structs are supported
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	msg := reflect.ValueOf(v)
+	if msg.Kind() != reflect.Ptr || msg.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	return appendMessage(nil, msg.Elem())
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	msg := reflect.ValueOf(v)
+	if msg.Kind() != reflect.Ptr || msg.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode into %T", v)
+	}
+	msg.Elem().Set(reflect.Zero(msg.Elem().Type()))
+	return decodeMessage(data, msg.Elem())
+}
+
+// numbering holds the field numbers of a struct type
+type numbering struct {
+	nums  []protowire.Number       // number of every field
+	index map[protowire.Number]int // field of every number
+}
+
+// numberings caches the numbering of every struct type by
+// its reflect.Type
+var numberings sync.Map
+
+// fieldNumbers returns the numbering of the struct type t read
+// from the protobuf tags of its fields. A field without a valid
+// tag or sharing its number fails the whole type
+func fieldNumbers(t reflect.Type) (*numbering, error) {
+	if cached, ok := numberings.Load(t); ok {
+		return cached.(*numbering), nil
+	}
+	numbers := &numbering{
+		nums:  make([]protowire.Number, t.NumField()),
+		index: make(map[protowire.Number]int),
+	}
+	for walk := 0; walk < t.NumField(); walk++ {
+		field := t.Field(walk)
+		num, err := strconv.Atoi(field.Tag.Get("protobuf"))
+		if err != nil || !protowire.Number(num).IsValid() {
+			return nil, fmt.Errorf("field %s of %s has no valid protobuf tag", field.Name, t)
+		}
+		if prev, exist := numbers.index[protowire.Number(num)]; exist {
+			return nil, fmt.Errorf("fields %s and %s of %s share number %d", t.Field(prev).Name, field.Name, t, num)
+		}
+		numbers.nums[walk] = protowire.Number(num)
+		numbers.index[protowire.Number(num)] = walk
+	}
+	numberings.Store(t, numbers)
+	return numbers, nil
+}
+
+// appendMessage appends the fields of the struct msg to b,
+// zero values are left out like in proto3
+func appendMessage(b []byte, msg reflect.Value) ([]byte, error) {
+	numbers, err := fieldNumbers(msg.Type())
+	for walk := 0; walk < msg.NumField() && err == nil; walk++ {
+		b, err = appendField(b, numbers.nums[walk], msg.Field(walk))
+	}
+	return b, err
+}
+
+func appendField(b []byte, num protowire.Number, field reflect.Value) ([]byte, error) {
+	switch field.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if field.IsZero() {
+			return b, nil
+		}
+		return appendValue(b, num, field)
+	case reflect.Struct:
+		if field.IsZero() {
+			return b, nil
+		}
+		return appendValue(b, num, field)
+	case reflect.Ptr:
+		if field.IsNil() {
+			return b, nil
+		}
+		return appendValue(b, num, field.Elem())
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			if field.Len() == 0 {
+				return b, nil
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, field.Bytes()), nil
+		}
+		var err error
+		for walk := 0; walk < field.Len() && err == nil; walk++ {
+			b, err = appendValue(b, num, field.Index(walk))
+		}
+		return b, err
+	case reflect.Map:
+		return appendMap(b, num, field)
+	}
+	return nil, fmt.Errorf("cannot encode field of type %s", field.Type())
+}
+
+// appendValue appends a single value of field num, even if zero
+func appendValue(b []byte, num protowire.Number, value reflect.Value) ([]byte, error) {
+	switch value.Kind() {
+	case reflect.String:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, value.String()), nil
+	case reflect.Bool:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(value.Bool())), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(value.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, value.Uint()), nil
+	case reflect.Struct:
+		inner, err := appendMessage(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, inner), nil
+	}
+	return nil, fmt.Errorf("cannot encode value of type %s", value.Type())
+}
+
+// appendMap appends a map as repeated entries holding the
+// key in field 1 and the value in field 2, sorted by key
+func appendMap(b []byte, num protowire.Number, field reflect.Value) ([]byte, error) {
+	if field.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("cannot encode map of type %s", field.Type())
+	}
+	keys := field.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	for _, key := range keys {
+		entry, err := appendValue(nil, 1, key)
+		if err == nil {
+			entry, err = appendValue(entry, 2, field.MapIndex(key))
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+// decodeMessage decodes the fields of b into the struct msg,
+// unknown fields are skipped
+func decodeMessage(b []byte, msg reflect.Value) error {
+	numbers, err := fieldNumbers(msg.Type())
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if walk, exist := numbers.index[num]; exist {
+			n = decodeField(b, typ, msg.Field(walk))
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n == errWire {
+			return errWireType
+		} else if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// errWire is returned by decodeField in place of a length when
+// the wire type does not match, other negative lengths are the
+// error codes of protowire
+const errWire = -100
+
+// decodeField decodes a value of field and returns the
+// number of bytes it took, or a negative error code
+func decodeField(b []byte, typ protowire.Type, field reflect.Value) int {
+	switch field.Kind() {
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			if typ != protowire.BytesType {
+				return errWire
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n >= 0 {
+				field.SetBytes(append([]byte(nil), v...))
+			}
+			return n
+		}
+		elem := reflect.New(field.Type().Elem()).Elem()
+		n := decodeValue(b, typ, elem)
+		if n >= 0 {
+			field.Set(reflect.Append(field, elem))
+		}
+		return n
+	case reflect.Map:
+		if typ != protowire.BytesType {
+			return errWire
+		}
+		entry, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+		key := reflect.New(field.Type().Key()).Elem()
+		value := reflect.New(field.Type().Elem()).Elem()
+		for len(entry) > 0 {
+			num, typ, m := protowire.ConsumeTag(entry)
+			if m < 0 {
+				return m
+			}
+			entry = entry[m:]
+			switch num {
+			case 1:
+				m = decodeValue(entry, typ, key)
+			case 2:
+				m = decodeValue(entry, typ, value)
+			default:
+				m = protowire.ConsumeFieldValue(num, typ, entry)
+			}
+			if m < 0 {
+				return m
+			}
+			entry = entry[m:]
+		}
+		field.SetMapIndex(key, value)
+		return n
+	case reflect.Ptr:
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return decodeValue(b, typ, field.Elem())
+	}
+	return decodeValue(b, typ, field)
+}
+
+// decodeValue decodes a single value into value, a struct
+// is merged with the fields it already holds
+func decodeValue(b []byte, typ protowire.Type, value reflect.Value) int {
+	switch value.Kind() {
+	case reflect.String:
+		if typ != protowire.BytesType {
+			return errWire
+		}
+		v, n := protowire.ConsumeString(b)
+		if n >= 0 {
+			value.SetString(v)
+		}
+		return n
+	case reflect.Bool:
+		if typ != protowire.VarintType {
+			return errWire
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n >= 0 {
+			value.SetBool(protowire.DecodeBool(v))
+		}
+		return n
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if typ != protowire.VarintType {
+			return errWire
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n >= 0 {
+			value.SetInt(int64(v))
+		}
+		return n
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if typ != protowire.VarintType {
+			return errWire
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n >= 0 {
+			value.SetUint(v)
+		}
+		return n
+	case reflect.Struct:
+		if typ != protowire.BytesType {
+			return errWire
+		}
+		inner, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		if err := decodeMessage(inner, value); err != nil {
+			return errWire
+		}
+		return n
+	}
+	return errWire
+}
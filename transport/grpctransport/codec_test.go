@@ -0,0 +1,95 @@
+//go:build grpc
+
+package grpctransport
+
+import (
+	"conhash/rpcs"
+	"google.golang.org/protobuf/encoding/protowire"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// filled returns a value of t with every field set
+func filled(t reflect.Type) reflect.Value {
+	value := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		value.SetString("s")
+	case reflect.Bool:
+		value.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		value.SetInt(-7)
+	case reflect.Uint64:
+		value.SetUint(1 << 40)
+	case reflect.Struct:
+		for walk := 0; walk < t.NumField(); walk++ {
+			value.Field(walk).Set(filled(t.Field(walk).Type))
+		}
+	case reflect.Slice:
+		value = reflect.Append(value, filled(t.Elem()), filled(t.Elem()))
+	case reflect.Map:
+		value = reflect.MakeMap(t)
+		value.SetMapIndex(filled(t.Key()), filled(t.Elem()))
+	}
+	return value
+}
+
+// TestCodecNumbers encodes every field of the messages alone and
+// checks it goes under the number rpcs.proto gives it, which the
+// tests of rpcs check against the protobuf tags
+func TestCodecNumbers(t *testing.T) {
+	messages := []interface{}{
+		rpcs.JoinArgs{}, rpcs.RingReply{}, rpcs.PlaceArgs{}, rpcs.KVArgs{},
+		rpcs.RepNode{}, rpcs.State{}, rpcs.BulkStates{}, rpcs.LookupInfo{},
+		rpcs.RemoveAll{}, rpcs.SyncArgs{},
+	}
+	for _, message := range messages {
+		typ := reflect.TypeOf(message)
+		full := filled(typ)
+		for walk := 0; walk < typ.NumField(); walk++ {
+			field := typ.Field(walk)
+			msg := reflect.New(typ)
+			msg.Elem().Field(walk).Set(full.Field(walk))
+			data, err := codec{}.Marshal(msg.Interface())
+			if err != nil {
+				t.Fatalf("%s.%s: %v", typ.Name(), field.Name, err)
+			}
+			num, _, n := protowire.ConsumeTag(data)
+			if n < 0 {
+				t.Fatalf("%s.%s: %v", typ.Name(), field.Name, protowire.ParseError(n))
+			}
+			if want := field.Tag.Get("protobuf"); strconv.Itoa(int(num)) != want {
+				t.Errorf("%s.%s encoded as field %d, tagged %s", typ.Name(), field.Name, num, want)
+			}
+		}
+
+		msg := reflect.New(typ)
+		msg.Elem().Set(full)
+		data, err := codec{}.Marshal(msg.Interface())
+		if err != nil {
+			t.Fatalf("%s: %v", typ.Name(), err)
+		}
+		decoded := reflect.New(typ)
+		if err := (codec{}).Unmarshal(data, decoded.Interface()); err != nil {
+			t.Fatalf("%s: %v", typ.Name(), err)
+		}
+		if !reflect.DeepEqual(decoded.Elem().Interface(), full.Interface()) {
+			t.Errorf("%s decoded as %+v, want %+v", typ.Name(), decoded.Elem().Interface(), full.Interface())
+		}
+	}
+}
+
+func TestCodecNeedsTags(t *testing.T) {
+	untagged := struct{ Key string }{Key: "k"}
+	if _, err := (codec{}).Marshal(&untagged); err == nil {
+		t.Error("field without a protobuf tag was encoded")
+	}
+	shared := struct {
+		A string `protobuf:"1"`
+		B string `protobuf:"1"`
+	}{}
+	if err := (codec{}).Unmarshal(nil, &shared); err == nil {
+		t.Error("fields sharing a number were decoded")
+	}
+}
@@ -0,0 +1,174 @@
+//go:build grpc
+
+// Package grpctransport carries the RPCs of the cluster over gRPC
+// so that programs outside Go can talk to it through the services
+// of rpcs/rpcs.proto. The package registers the transport under
+// transport.NameGRPC when it is imported
+package grpctransport
+
+import (
+	"conhash/transport"
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+)
+
+// Package is the protobuf package of the services
+const Package = "conhash"
+
+func init() {
+	transport.Register(Transport())
+}
+
+// Transport returns the gRPC transport
+func Transport() transport.Transport {
+	return grpcTransport{}
+}
+
+type grpcTransport struct{}
+
+func (grpcTransport) Name() string { return transport.NameGRPC }
+
+func (grpcTransport) NewServer() transport.Server {
+	return &server{grpc.NewServer(grpc.ForceServerCodec(codec{}))}
+}
+
+func (grpcTransport) Dial(ctx context.Context, addr string) (transport.Conn, error) {
+	cc, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect right away so that an unreachable server fails
+	// the dial, like it does with net/rpc
+	cc.Connect()
+	for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+		if state == connectivity.TransientFailure || !cc.WaitForStateChange(ctx, state) {
+			cc.Close()
+			return nil, fmt.Errorf("unable to connect to %s", addr)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{cc: cc, ctx: ctx, cancel: cancel}, nil
+}
+
+// server serves the services registered with it as gRPC
+// services of Package
+type server struct {
+	grpc *grpc.Server
+}
+
+// RegisterName serves the suitable methods of rcvr as the
+// unary methods of the service Package.name
+func (s *server) RegisterName(name string, rcvr interface{}) error {
+	value := reflect.ValueOf(rcvr)
+	desc := grpc.ServiceDesc{
+		ServiceName: Package + "." + name,
+		HandlerType: (*interface{})(nil),
+	}
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	for walk := 0; walk < value.NumMethod(); walk++ {
+		method := value.Type().Method(walk)
+		kind := method.Type
+		if kind.NumIn() != 3 || kind.NumOut() != 1 || kind.Out(0) != errType ||
+			kind.In(1).Kind() != reflect.Ptr || kind.In(2).Kind() != reflect.Ptr {
+			continue
+		}
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: method.Name,
+			Handler:    handler(value.Method(walk), kind.In(1).Elem(), kind.In(2).Elem()),
+		})
+	}
+	if len(desc.Methods) == 0 {
+		return fmt.Errorf("%s has no method to serve", name)
+	}
+	s.grpc.RegisterService(&desc, rcvr)
+	return nil
+}
+
+func (s *server) Serve(listener net.Listener) error {
+	return s.grpc.Serve(listener)
+}
+
+// handler calls method with the decoded arguments and returns
+// its reply. Errors of the method go back with their message
+func handler(method reflect.Value, args reflect.Type, reply reflect.Type) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := reflect.New(args)
+		if err := dec(in.Interface()); err != nil {
+			return nil, err
+		}
+		out := reflect.New(reply)
+		if err, _ := method.Call([]reflect.Value{in, out})[0].Interface().(error); err != nil {
+			return nil, status.Error(codes.Unknown, err.Error())
+		}
+		return out.Interface(), nil
+	}
+}
+
+// conn is a gRPC connection behaving like an rpc.Client
+type conn struct {
+	cc     *grpc.ClientConn
+	ctx    context.Context // cancelled on Close
+	cancel context.CancelFunc
+}
+
+// Call invokes method, "Service.Method", and waits for its reply
+func (c *conn) Call(method string, args interface{}, reply interface{}) error {
+	full := "/" + Package + "." + strings.Replace(method, ".", "/", 1)
+	return convert(c.cc.Invoke(c.ctx, full, args, reply))
+}
+
+// Go invokes method asynchronously, the call is sent on done
+// once it completes
+func (c *conn) Go(method string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+	call := &rpc.Call{
+		ServiceMethod: method,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+	}
+	go func() {
+		call.Error = c.Call(method, args, reply)
+		select {
+		case call.Done <- call:
+		default:
+		}
+	}()
+	return call
+}
+
+func (c *conn) Close() error {
+	c.cancel()
+	return c.cc.Close()
+}
+
+// convert returns the error net/rpc would have returned
+// in place of a gRPC status
+func convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.Canceled:
+		return rpc.ErrShutdown
+	}
+	return rpc.ServerError(st.Message())
+}
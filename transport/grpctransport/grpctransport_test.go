@@ -0,0 +1,23 @@
+//go:build grpc
+
+package grpctransport
+
+import (
+	"conhash/rpcs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// An error of a method keeps its code and epoch through the
+// status the handler returns and the conversion of the client
+func TestConvertKeepsCode(t *testing.T) {
+	err := convert(status.Error(codes.Unknown, rpcs.WrongOwner{Epoch: 9}.Error()))
+	if epoch, ok := rpcs.WrongOwnerEpoch(err); !ok || epoch != 9 {
+		t.Errorf("WrongOwnerEpoch(%v) = %d, %v, want 9, true", err, epoch, ok)
+	}
+	err = convert(status.Error(codes.Unknown, rpcs.Errorf(rpcs.CodeNotMember, "no member n1").Error()))
+	if code := rpcs.CodeOf(err); code != rpcs.CodeNotMember {
+		t.Errorf("CodeOf(%v) = %s, want %s", err, code, rpcs.CodeNotMember)
+	}
+}
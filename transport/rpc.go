@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the transports
+const (
+	NameNetRPC = "netrpc"
+	NameGRPC   = "grpc"
+)
+
+// Transport carries the RPCs between the members of a cluster,
+// every member of a cluster must use the same one
+type Transport interface {
+	// Name returns the name the transport is registered under
+	Name() string
+	// NewServer returns a server for the services of a member
+	NewServer() Server
+	// Dial connects to the server at addr, giving up once
+	// ctx is done
+	Dial(ctx context.Context, addr string) (Conn, error)
+}
+
+// Server serves services in the style of net/rpc: the exported
+// methods of a receiver of the form M(args *A, reply *R) error
+// are called as "Name.M"
+type Server interface {
+	RegisterName(name string, rcvr interface{}) error
+	// Serve serves the connections of listener until it
+	// is closed
+	Serve(listener net.Listener) error
+}
+
+// Conn is a connection to a server. Errors returned by the
+// remote methods come back as rpc.ServerError and a broken
+// connection as rpc.ErrShutdown, just like with rpc.Client,
+// which implements Conn
+type Conn interface {
+	Call(method string, args interface{}, reply interface{}) error
+	Go(method string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+var (
+	mu         sync.Mutex
+	transports = map[string]Transport{NameNetRPC: netRPC{}}
+)
+
+// Register makes a transport available under its name
+func Register(transport Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[transport.Name()] = transport
+}
+
+// Lookup returns the transport registered under name,
+// net/rpc if name is empty
+func Lookup(name string) (Transport, error) {
+	if name == "" {
+		name = NameNetRPC
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if transport, exist := transports[name]; exist {
+		return transport, nil
+	}
+	if name == NameGRPC {
+		return nil, errors.New("transport grpc needs a build with -tags grpc")
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// Names returns the names of the registered transports
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NetRPC returns the transport of net/rpc over HTTP
+func NetRPC() Transport {
+	return netRPC{}
+}
+
+// netRPC serves and calls net/rpc over HTTP
+type netRPC struct{}
+
+func (netRPC) Name() string { return NameNetRPC }
+
+func (netRPC) NewServer() Server {
+	return &netServer{rpc.NewServer()}
+}
+
+func (netRPC) Dial(ctx context.Context, addr string) (Conn, error) {
+	return dialHTTP(ctx, addr)
+}
+
+// netServer serves a net/rpc server over HTTP
+type netServer struct {
+	*rpc.Server
+}
+
+func (s *netServer) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, s.Server)
+	return http.Serve(listener, mux)
+}
+
+// dialHTTP is rpc.DialHTTP giving up once ctx is done
+func dialHTTP(ctx context.Context, addr string) (*rpc.Client, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
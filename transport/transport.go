@@ -0,0 +1,346 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTimeout matches with errors.Is the TimeoutError of
+// a call the node did not reply to in time
+var ErrTimeout = errors.New("call timed out")
+
+// TimeoutError is returned by CallContext and CallTimeout
+// when the deadline of a call passed before Addr replied
+type TimeoutError struct {
+	Addr   string
+	Method string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Method + " on " + e.Addr + " timed out"
+}
+
+// Is makes the error match ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Timeout tells that the error is a timeout, like net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Metadata keys under which ring members keep the RPC
+// address of their node and its comma separated alternatives
+const (
+	MetaAddr  = "addr"
+	MetaAddrs = "addrs"
+)
+
+// PortAddr returns the local RPC address of a node
+// listening on port
+func PortAddr(port int) string {
+	return ":" + strconv.Itoa(port)
+}
+
+// Meta returns the metadata of a member reachable at
+// addr or any of the alternatives
+func Meta(addr string, alternatives []string) map[string]string {
+	meta := map[string]string{
+		MetaAddr: addr,
+	}
+	if len(alternatives) > 0 {
+		meta[MetaAddrs] = strings.Join(alternatives, ",")
+	}
+	return meta
+}
+
+// Addrs returns the addresses of a member from its
+// metadata, the advertised address first
+func Addrs(meta map[string]string) []string {
+	var addrs []string
+	if addr := meta[MetaAddr]; addr != "" {
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range strings.Split(meta[MetaAddrs], ",") {
+		if addr != "" && addr != meta[MetaAddr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Pool maintains one connection per address and dials
+// lazily. It is safe for concurrent use
+type Pool struct {
+	mu        sync.Mutex
+	transport Transport
+	conns     map[string]Conn
+}
+
+// NewPool returns an empty pool of net/rpc connections
+func NewPool() *Pool {
+	return NewPoolWith(nil)
+}
+
+// NewPoolWith returns an empty pool of connections of
+// transport, net/rpc if nil
+func NewPoolWith(transport Transport) *Pool {
+	if transport == nil {
+		transport = NetRPC()
+	}
+	return &Pool{
+		transport: transport,
+		conns:     make(map[string]Conn),
+	}
+}
+
+// dialTimeout bounds the dial of a connection by Get, the
+// calls with a context are bounded by their context instead
+const dialTimeout = 10 * time.Second
+
+// Get returns the connection to addr, dialing it
+// if there is none yet
+func (p *Pool) Get(addr string) (Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return p.get(ctx, addr)
+}
+
+// get returns the connection to addr, dialing it until ctx is
+// done if there is none yet. The dial happens outside of the lock
+// so that an unresponsive address does not hold up the others
+func (p *Pool) get(ctx context.Context, addr string) (Conn, error) {
+	p.mu.Lock()
+	conn, exist := p.conns[addr]
+	p.mu.Unlock()
+	if exist {
+		return conn, nil
+	}
+
+	conn, err := p.transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if curr, exist := p.conns[addr]; exist {
+		// Another call dialed addr in the meantime
+		conn.Close()
+		return curr, nil
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// broken reports whether err tells that the connection of a call
+// broke. The call was not sent if it is rpc.ErrShutdown, it may
+// have been served if the connection broke while it was pending
+func broken(err error) bool {
+	return err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF
+}
+
+// Call invokes method on the node at addr. A connection that
+// broke is dropped so the next call redials
+func (p *Pool) Call(addr string, method string, args interface{}, reply interface{}) error {
+	conn, err := p.Get(addr)
+	if err != nil {
+		return err
+	}
+	err = conn.Call(method, args, reply)
+	if broken(err) {
+		p.dropConn(addr, conn)
+	}
+	return err
+}
+
+// CallAny invokes method on the first of addrs that can be
+// reached, the others are only tried when dialing fails or
+// the connection was shut down
+func (p *Pool) CallAny(addrs []string, method string, args interface{}, reply interface{}) error {
+	err := errors.New("no address to call")
+	for _, addr := range addrs {
+		var conn Conn
+		if conn, err = p.Get(addr); err != nil {
+			continue
+		}
+		err = conn.Call(method, args, reply)
+		if broken(err) {
+			p.dropConn(addr, conn)
+		}
+		if err != rpc.ErrShutdown {
+			return err
+		}
+	}
+	return err
+}
+
+// CallTimeout is CallContext with a deadline timeout from
+// now, 0 waits forever
+func (p *Pool) CallTimeout(addrs []string, timeout time.Duration, method string, args interface{}, reply interface{}) error {
+	if timeout <= 0 {
+		return p.CallAny(addrs, method, args, reply)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.CallContext(ctx, addrs, method, args, reply)
+}
+
+// CallContext is CallAny giving up once ctx is done, with a
+// TimeoutError if its deadline passed and the error of ctx
+// otherwise. reply is only written when the call succeeds in
+// time, and the connection of a call given up is dropped since
+// its reply may never come
+func (p *Pool) CallContext(ctx context.Context, addrs []string, method string, args interface{}, reply interface{}) error {
+	err := errors.New("no address to call")
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			return contextError(ctx, addr, method)
+		}
+		var conn Conn
+		if conn, err = p.get(ctx, addr); err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx, addr, method)
+			}
+			continue
+		}
+
+		// A late reply must not race with the caller
+		fresh := reflect.New(reflect.TypeOf(reply).Elem())
+		call := conn.Go(method, args, fresh.Interface(), make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			if err = call.Error; err == nil {
+				reflect.ValueOf(reply).Elem().Set(fresh.Elem())
+				return nil
+			}
+			if broken(err) {
+				p.dropConn(addr, conn)
+			}
+			if err != rpc.ErrShutdown {
+				return err
+			}
+		case <-ctx.Done():
+			p.dropConn(addr, conn)
+			return contextError(ctx, addr, method)
+		}
+	}
+	return err
+}
+
+// contextError returns the error of a call to addr given
+// up because ctx is done
+func contextError(ctx context.Context, addr string, method string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Addr: addr, Method: method}
+	}
+	return ctx.Err()
+}
+
+// Drop closes and forgets the connection to addr
+func (p *Pool) Drop(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn, exist := p.conns[addr]; exist {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// dropConn closes conn, a connection to addr a call failed on,
+// and forgets it unless it was replaced already. Another call may
+// have redialed addr in the meantime, its connection is kept
+func (p *Pool) dropConn(addr string, conn Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[addr] == conn {
+		delete(p.conns, addr)
+	}
+	conn.Close()
+}
+
+// Close closes all connections of the pool
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// Listener is a net.Listener closing the connections it accepted
+// when it is closed. net/rpc hijacks the connections it serves over
+// HTTP, closing the listener alone would keep serving them
+type Listener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// Listen announces on the TCP address addr
+func Listen(addr string) (*Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		Listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+// Accept waits for the next connection and tracks it
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	tracked := &trackedConn{Conn: conn, listener: l}
+	l.conns[tracked] = true
+	return tracked, nil
+}
+
+// Close stops listening and closes every accepted connection
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.(*trackedConn).Conn.Close()
+		delete(l.conns, conn)
+	}
+	return err
+}
+
+// trackedConn forgets itself once closed
+type trackedConn struct {
+	net.Conn
+	listener *Listener
+}
+
+func (c *trackedConn) Close() error {
+	c.listener.mu.Lock()
+	delete(c.listener.conns, c)
+	c.listener.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Echo is a service replying with its argument
+type Echo struct{}
+
+func (Echo) Echo(args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+// serveEcho serves Echo over net/rpc and returns its address
+func serveEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := NetRPC().NewServer()
+	server.RegisterName("Echo", Echo{})
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+// serveSilent accepts connections and never answers, as a
+// stalled node would, and returns its address
+func serveSilent(t *testing.T) string {
+	t.Helper()
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPoolDialsOutsideLock(t *testing.T) {
+	live, silent := serveEcho(t), serveSilent(t)
+	pool := NewPool()
+	defer pool.Close()
+
+	stalled := make(chan error)
+	go func() {
+		reply := ""
+		args := "ping"
+		stalled <- pool.CallTimeout([]string{silent}, time.Second, "Echo.Echo", &args, &reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The dial of the silent address must not hold up the others
+	start := time.Now()
+	reply, args := "", "ping"
+	if err := pool.Call(live, "Echo.Echo", &args, &reply); err != nil || reply != "ping" {
+		t.Fatalf("call answered %q: %v", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("call waited %v for the dial of another address", elapsed)
+	}
+	if err := <-stalled; err == nil {
+		t.Fatalf("call of a silent address returned %v", err)
+	}
+}
+
+func TestPoolSharesConnections(t *testing.T) {
+	live := serveEcho(t)
+	pool := NewPool()
+	defer pool.Close()
+
+	conns := make([]Conn, 8)
+	var wg sync.WaitGroup
+	for walk := range conns {
+		wg.Add(1)
+		go func(walk int) {
+			defer wg.Done()
+			conn, err := pool.Get(live)
+			if err != nil {
+				t.Error(err)
+			}
+			conns[walk] = conn
+		}(walk)
+	}
+	wg.Wait()
+	for _, conn := range conns {
+		if conn != conns[0] {
+			t.Fatal("concurrent dials kept more than one connection")
+		}
+	}
+	if len(pool.conns) != 1 {
+		t.Fatalf("pool holds %d connections", len(pool.conns))
+	}
+}
+
+// stallTransport dials connections whose calls never complete,
+// closing a connection does not end them either
+type stallTransport struct {
+	started chan bool // receives once a call is sent
+}
+
+func (stallTransport) Name() string      { return "stall" }
+func (stallTransport) NewServer() Server { return nil }
+
+func (s stallTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	return &stallConn{started: s.started}, nil
+}
+
+// stallConn is a connection of stallTransport
+type stallConn struct {
+	started chan bool
+	mu      sync.Mutex
+	closed  bool
+}
+
+func (c *stallConn) Call(method string, args interface{}, reply interface{}) error {
+	select {}
+}
+
+func (c *stallConn) Go(method string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	c.started <- true
+	return &rpc.Call{ServiceMethod: method, Args: args, Reply: reply, Done: done}
+}
+
+func (c *stallConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *stallConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestPoolTimeoutRacesRedial(t *testing.T) {
+	const addr = "stalled"
+	pool := NewPoolWith(stallTransport{started: make(chan bool)})
+	defer pool.Close()
+
+	for walk := 0; walk < 8; walk++ {
+		timedOut := make(chan error)
+		go func() {
+			reply, args := "", "ping"
+			timedOut <- pool.CallTimeout([]string{addr}, 50*time.Millisecond, "Echo.Echo", &args, &reply)
+		}()
+		<-pool.transport.(stallTransport).started
+		stale, err := pool.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The address is redialed while the call waits
+		pool.Drop(addr)
+		fresh, err := pool.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh == stale {
+			t.Fatal("dropped connection was not redialed")
+		}
+		if err := <-timedOut; err == nil {
+			t.Fatal("stalled call succeeded")
+		}
+
+		if !stale.(*stallConn).isClosed() {
+			t.Fatal("connection of the timed out call is still open")
+		}
+		if fresh.(*stallConn).isClosed() {
+			t.Fatal("timed out call closed the redialed connection")
+		}
+		if curr, _ := pool.Get(addr); curr != fresh {
+			t.Fatal("timed out call dropped the redialed connection")
+		}
+	}
+}